@@ -6,6 +6,7 @@ SPDX-License-Identifier: Apache-2.0
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -44,10 +45,24 @@ sprayproxy server --backend http://localhost:8081 --backend http://localhost:808
 		insecureSkipWebhookVerify := viper.GetBool("insecure-skip-webhook-verify")
 		crtFile := viper.GetString("metrics-cert")
 		keyFile := viper.GetString("metrics-key")
+		tlsOptions := server.TLSOptions{
+			CertFile:     viper.GetString("tls-cert"),
+			KeyFile:      viper.GetString("tls-key"),
+			MinVersion:   viper.GetString("tls-min-version"),
+			CipherSuites: viper.GetStringSlice("tls-cipher-suites"),
+			ClientCAFile: viper.GetString("tls-client-ca"),
+		}
 		server, err := server.NewServer(host, port, insecureSkipTLSVerify, insecureSkipWebhookVerify, enableDynamicBackends, backends)
 		if err != nil {
 			return err
 		}
+		if tlsOptions.CertFile != "" || tlsOptions.KeyFile != "" {
+			if err := server.EnableTLS(tlsOptions); err != nil {
+				return err
+			}
+		} else if tlsOptions.ClientCAFile != "" {
+			return errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+		}
 
 		metrics.InitMetrics(nil)
 		stopCh := setupSignalHandler()
@@ -89,6 +104,10 @@ func init() {
 	viper.SetDefault("metrics-port", metrics.MetricsPort)
 	viper.SetDefault("metrics-cert", "")
 	viper.SetDefault("metrics-key", "")
+	viper.SetDefault("tls-cert", "")
+	viper.SetDefault("tls-key", "")
+	viper.SetDefault("tls-min-version", "1.2")
+	viper.SetDefault("tls-client-ca", "")
 
 	viper.SetEnvPrefix("SPRAYPROXY_SERVER")
 	// Replace "-" with underscores "_"
@@ -103,6 +122,11 @@ func init() {
 	serverCmd.Flags().Int("metrics-port", metrics.MetricsPort, fmt.Sprintf("Port for the prometheus metrics endpoint.  Defaults to %d", metrics.MetricsPort))
 	serverCmd.Flags().String("metrics-cert", "", "TLS Certificate file for the prometheus metric endpoint.  Defaults to empty, meaning TLS will not be used")
 	serverCmd.Flags().String("metrics-key", "", "TLS Key file for the prometheus metric endpoint.  Defaults to empty, meaning TLS will not be used")
+	serverCmd.Flags().String("tls-cert", "", "TLS Certificate file for the proxy endpoint, reloaded on changes.  Defaults to empty, meaning TLS will not be used")
+	serverCmd.Flags().String("tls-key", "", "TLS Key file for the proxy endpoint, reloaded on changes.  Defaults to empty, meaning TLS will not be used")
+	serverCmd.Flags().String("tls-min-version", "1.2", "Minimum TLS version of the proxy endpoint, 1.2 or 1.3.  Defaults to 1.2")
+	serverCmd.Flags().StringSlice("tls-cipher-suites", []string{}, "TLS 1.2 cipher suites of the proxy endpoint, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.  Defaults to the Go defaults")
+	serverCmd.Flags().String("tls-client-ca", "", "CA file client certificates of the backend registration API are verified with, reloaded on changes.  Defaults to empty, meaning client certificates are not requested")
 
 	viper.BindPFlags(serverCmd.Flags())
 
@@ -0,0 +1,108 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync/atomic"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/filewatch"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// file holding the source IP ranges allowed to send webhooks, in the format of the GitHub meta API
+const envSourceRangesFile = "SPRAYPROXY_ALLOWED_SOURCE_RANGES_FILE"
+
+// sourceAllowlist rejects inbound requests from outside the allowed IP ranges. The ranges are
+// reloaded when their file changes. Nil allowlists accept all requests.
+type sourceAllowlist struct {
+	file    string
+	logger  *zap.Logger
+	current atomic.Pointer[[]netip.Prefix]
+}
+
+// sourceAllowlistFromEnv loads the ranges of the file set by the
+// SPRAYPROXY_ALLOWED_SOURCE_RANGES_FILE env var, or returns nil if it is not set.
+func sourceAllowlistFromEnv(logger *zap.Logger) (*sourceAllowlist, error) {
+	file := os.Getenv(envSourceRangesFile)
+	if file == "" {
+		return nil, nil
+	}
+	a := &sourceAllowlist{file: file, logger: logger}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads the ranges from the file. It accepts the response of the GitHub meta API, whose
+// "hooks" list holds the ranges webhooks are sent from, or the list alone. The current ranges are
+// only replaced if the new ones are valid.
+func (a *sourceAllowlist) load() error {
+	data, err := os.ReadFile(a.file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", envSourceRangesFile, err)
+	}
+	var meta struct {
+		Hooks []string `json:"hooks"`
+	}
+	cidrs := []string{}
+	if err := json.Unmarshal(data, &meta); err == nil {
+		cidrs = meta.Hooks
+	} else if err := json.Unmarshal(data, &cidrs); err != nil {
+		return fmt.Errorf("invalid %s, expected the GitHub meta API response or a list of CIDR ranges: %v", envSourceRangesFile, err)
+	}
+	if len(cidrs) == 0 {
+		return fmt.Errorf("invalid %s, no CIDR range", envSourceRangesFile)
+	}
+	ranges := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", envSourceRangesFile, err)
+		}
+		ranges = append(ranges, prefix.Masked())
+	}
+	a.current.Store(&ranges)
+	return nil
+}
+
+// allowed indicates if the client IP is in one of the ranges. The client IP is resolved by gin,
+// from the X-Forwarded-For header of the trusted proxies, or the remote address of the connection.
+func (a *sourceAllowlist) allowed(clientIP string) (bool, error) {
+	if a == nil {
+		return true, nil
+	}
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false, errors.New("invalid client IP " + clientIP)
+	}
+	addr = addr.Unmap()
+	for _, prefix := range *a.current.Load() {
+		if prefix.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// watch reloads the ranges when the file changes, until stopCh is closed.
+func (a *sourceAllowlist) watch(stopCh <-chan struct{}) {
+	filewatch.Watch(stopCh, []string{a.file}, "source ranges", a.logger, func() {
+		if err := a.load(); err != nil {
+			metrics.IncSourceRangesReloadCount("failure")
+			a.logger.Error("failed to reload allowed source ranges, keeping the current ones", zap.Error(err))
+			return
+		}
+		metrics.IncSourceRangesReloadCount("success")
+		a.logger.Info(fmt.Sprintf("reloaded %d allowed source ranges", len(*a.current.Load())))
+	})
+}
@@ -0,0 +1,133 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// excerpt of the GitHub meta API response
+const githubMeta = `{
+  "verifiable_password_authentication": false,
+  "hooks": ["192.30.252.0/22", "185.199.108.0/22", "2a0a:a440::/29"],
+  "web": ["192.30.252.0/20"]
+}`
+
+func writeSourceRanges(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "meta.json")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envSourceRangesFile, file)
+	return file
+}
+
+func TestSourceAllowlist(t *testing.T) {
+	allowlist, err := sourceAllowlistFromEnv(zap.NewNop())
+	if err != nil || allowlist != nil {
+		t.Errorf("expected no allowlist by default, got %v, %v", allowlist, err)
+	}
+	if allowed, _ := allowlist.allowed("203.0.113.1"); !allowed {
+		t.Errorf("expected nil allowlist to accept all requests")
+	}
+
+	writeSourceRanges(t, githubMeta)
+	allowlist, err = sourceAllowlistFromEnv(zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for clientIP, expected := range map[string]bool{
+		"192.30.252.1":         true,
+		"185.199.111.255":      true,
+		"192.30.240.1":         false, // web range, not hooks
+		"2a0a:a440::1":         true,
+		"2001:db8::1":          false,
+		"::ffff:192.30.252.10": true,
+		"not an ip":            false,
+	} {
+		if allowed, _ := allowlist.allowed(clientIP); allowed != expected {
+			t.Errorf("expected %s to be allowed %t, got %t", clientIP, expected, allowed)
+		}
+	}
+
+	writeSourceRanges(t, `["10.0.0.0/8"]`)
+	allowlist, err = sourceAllowlistFromEnv(zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error for a list of ranges: %v", err)
+	}
+	if allowed, _ := allowlist.allowed("10.1.2.3"); !allowed {
+		t.Errorf("expected 10.1.2.3 to be allowed")
+	}
+
+	for name, content := range map[string]string{
+		"no hooks":      `{"web": ["192.30.252.0/20"]}`,
+		"invalid range": `{"hooks": ["192.30.252.0/33"]}`,
+		"not json":      `hooks: [192.30.252.0/22]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeSourceRanges(t, content)
+			if _, err := sourceAllowlistFromEnv(zap.NewNop()); err == nil {
+				t.Errorf("expected error for %s", content)
+			}
+		})
+	}
+	t.Setenv(envSourceRangesFile, filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := sourceAllowlistFromEnv(zap.NewNop()); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+}
+
+func TestSourceAllowlistReload(t *testing.T) {
+	file := writeSourceRanges(t, githubMeta)
+	allowlist, err := sourceAllowlistFromEnv(zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go allowlist.watch(stopCh)
+	// let the watcher start before changing the file
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(file, []byte(`{"hooks": ["203.0.113.0/24"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if allowed, _ := allowlist.allowed("203.0.113.1"); allowed {
+			return
+		}
+	}
+	t.Errorf("expected the allowed source ranges to be reloaded")
+}
+
+func TestHandleProxySourceAllowlist(t *testing.T) {
+	writeSourceRanges(t, `{"hooks": ["192.0.2.0/24"]}`)
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for remoteAddr, expected := range map[string]int{
+		"192.0.2.1:1234":   http.StatusOK,
+		"203.0.113.1:1234": http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = newProxyRequest()
+		ctx.Request.RemoteAddr = remoteAddr
+		proxy.HandleProxy(ctx)
+		if w.Code != expected {
+			t.Errorf("%s: expected status code %d, got %d", remoteAddr, expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// the request waits in the queue for a worker
+	asyncQueued = "queued"
+	// the request is being forwarded to the backends
+	asyncForwarding = "forwarding"
+	// every backend answered or failed
+	asyncCompleted = "completed"
+	// the request was still queued when the proxy stopped
+	asyncDropped = "dropped"
+)
+
+// AsyncDelivery is a request accepted in asynchronous mode, along with the outcome of its
+// forwards once completed.
+type AsyncDelivery struct {
+	RequestID   string           `json:"requestId"`
+	DeliveryID  string           `json:"deliveryId,omitempty"`
+	Event       string           `json:"event,omitempty"`
+	State       string           `json:"state"`
+	Result      string           `json:"result,omitempty"`
+	ReceivedAt  time.Time        `json:"receivedAt"`
+	StartedAt   *time.Time       `json:"startedAt,omitempty"`
+	CompletedAt *time.Time       `json:"completedAt,omitempty"`
+	Backends    []backendOutcome `json:"backends,omitempty"`
+}
+
+// asyncJob is a request waiting in the queue to be forwarded.
+type asyncJob struct {
+	requestID       string
+	deliveryID      string
+	req             *http.Request
+	body            []byte
+	backends        []string
+	zapCommonFields []zapcore.Field
+}
+
+// asyncForwarder queues the accepted requests in memory for a pool of workers, and keeps the
+// outcome of the most recent ones, up to maxResults. When full, the oldest outcome is dropped.
+type asyncForwarder struct {
+	workers    int
+	queue      chan *asyncJob
+	maxResults int
+	mu         sync.Mutex
+	// deliveries are ordered by reception, oldest first
+	deliveries *list.List
+	index      map[string]*list.Element
+}
+
+func newAsyncForwarder(workers, queueSize, maxResults int) *asyncForwarder {
+	return &asyncForwarder{
+		workers:    workers,
+		queue:      make(chan *asyncJob, queueSize),
+		maxResults: maxResults,
+		deliveries: list.New(),
+		index:      map[string]*list.Element{},
+	}
+}
+
+// asyncForwarderFromEnv returns the async forwarder configured by SPRAYPROXY_ASYNC* env vars,
+// or nil if asynchronous mode is disabled.
+func asyncForwarderFromEnv() (*asyncForwarder, error) {
+	if v := os.Getenv("SPRAYPROXY_ASYNC"); v == "" {
+		return nil, nil
+	} else if enabled, err := strconv.ParseBool(v); err != nil {
+		return nil, fmt.Errorf("invalid SPRAYPROXY_ASYNC %q", v)
+	} else if !enabled {
+		return nil, nil
+	}
+	settings := map[string]int{
+		"SPRAYPROXY_ASYNC_WORKERS":     4,
+		"SPRAYPROXY_ASYNC_QUEUE_SIZE":  1000,
+		"SPRAYPROXY_ASYNC_MAX_RESULTS": 10000,
+	}
+	for env := range settings {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid %s %q", env, v)
+			}
+			settings[env] = n
+		}
+	}
+	return newAsyncForwarder(settings["SPRAYPROXY_ASYNC_WORKERS"], settings["SPRAYPROXY_ASYNC_QUEUE_SIZE"],
+		settings["SPRAYPROXY_ASYNC_MAX_RESULTS"]), nil
+}
+
+// enqueue queues the job for the workers and tracks the delivery. Returns false if the queue is
+// full, in which case the delivery is not tracked and no other delivery is dropped.
+func (a *asyncForwarder) enqueue(job *asyncJob, d *AsyncDelivery) bool {
+	// the workers wait for the lock to update the delivery, so it is tracked first
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case a.queue <- job:
+		metrics.SetAsyncQueueLength(len(a.queue))
+	default:
+		return false
+	}
+	a.push(d)
+	return true
+}
+
+// track records the delivery, dropping the oldest one if full.
+func (a *asyncForwarder) track(d *AsyncDelivery) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.push(d)
+}
+
+// push records the delivery, dropping the oldest one if full. a.mu must be held.
+func (a *asyncForwarder) push(d *AsyncDelivery) {
+	if a.deliveries.Len() >= a.maxResults {
+		oldest := a.deliveries.Front()
+		a.deliveries.Remove(oldest)
+		delete(a.index, oldest.Value.(*AsyncDelivery).RequestID)
+	}
+	a.index[d.RequestID] = a.deliveries.PushBack(d)
+}
+
+// update applies the change to the delivery, if it is still tracked.
+func (a *asyncForwarder) update(requestID string, change func(d *AsyncDelivery)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if elem, ok := a.index[requestID]; ok {
+		change(elem.Value.(*AsyncDelivery))
+	}
+}
+
+// get returns a copy of the delivery, or nil if it is not tracked.
+func (a *asyncForwarder) get(requestID string) *AsyncDelivery {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	elem, ok := a.index[requestID]
+	if !ok {
+		return nil
+	}
+	d := *elem.Value.(*AsyncDelivery)
+	return &d
+}
+
+// list returns copies of the deliveries in the given state, or all of them if empty, oldest first.
+func (a *asyncForwarder) list(state string) []*AsyncDelivery {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deliveries := []*AsyncDelivery{}
+	for elem := a.deliveries.Front(); elem != nil; elem = elem.Next() {
+		if d := *elem.Value.(*AsyncDelivery); state == "" || d.State == state {
+			deliveries = append(deliveries, &d)
+		}
+	}
+	return deliveries
+}
+
+// AsyncEnabled indicates if requests are accepted before being forwarded in the background.
+func (p *SprayProxy) AsyncEnabled() bool {
+	return p.async != nil
+}
+
+// runAsync starts the async workers, which forward the queued requests until stopCh is closed.
+// The requests still queued then are dropped.
+func (p *SprayProxy) runAsync(stopCh <-chan struct{}) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < p.async.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := p.client
+			for {
+				// stopping takes precedence over the queued requests
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				select {
+				case <-stopCh:
+					return
+				case job := <-p.async.queue:
+					metrics.SetAsyncQueueLength(len(p.async.queue))
+					p.forwardAsync(client, job)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	dropped := 0
+	for {
+		select {
+		case job := <-p.async.queue:
+			p.async.update(job.requestID, func(d *AsyncDelivery) { d.State = asyncDropped })
+			dropped++
+		default:
+			if dropped > 0 {
+				p.logger.Warn(fmt.Sprintf("dropped %d queued requests on shutdown", dropped))
+			}
+			metrics.SetAsyncQueueLength(0)
+			return
+		}
+	}
+}
+
+// forwardAsync sprays a queued request to its backends, and records the outcome.
+func (p *SprayProxy) forwardAsync(client *http.Client, job *asyncJob) {
+	start := time.Now()
+	p.async.update(job.requestID, func(d *AsyncDelivery) {
+		startedAt := start.UTC()
+		d.State = asyncForwarding
+		d.StartedAt = &startedAt
+	})
+	results := p.spray(client, job.req, job.body, job.backends, job.zapCommonFields)
+	p.recordSpray(job.requestID, job.deliveryID, job.req, job.body, results, start, job.zapCommonFields)
+	outcomes := []backendOutcome{}
+	for _, result := range results {
+		outcome := newBackendOutcome(result)
+		outcome.Error = result.errorMessage()
+		outcomes = append(outcomes, outcome)
+	}
+	result := "proxied"
+	if !p.responsePolicy.accepted(results) {
+		result = "failed to proxy"
+	}
+	p.async.update(job.requestID, func(d *AsyncDelivery) {
+		completedAt := time.Now().UTC()
+		d.State = asyncCompleted
+		d.Result = result
+		d.CompletedAt = &completedAt
+		d.Backends = outcomes
+	})
+}
+
+// ListAsyncDeliveries lists the tracked asynchronous deliveries, filtered by the state query
+// parameter.
+func (p *SprayProxy) ListAsyncDeliveries(c *gin.Context) {
+	state := c.Query("state")
+	switch state {
+	case "", asyncQueued, asyncForwarding, asyncCompleted, asyncDropped:
+	default:
+		c.String(http.StatusBadRequest, fmt.Sprintf("invalid state %q", state))
+		return
+	}
+	c.JSON(http.StatusOK, p.async.list(state))
+}
+
+// GetAsyncDelivery gives the state and outcome of a single asynchronous delivery, by request ID.
+func (p *SprayProxy) GetAsyncDelivery(c *gin.Context) {
+	d := p.async.get(c.Param("id"))
+	if d == nil {
+		c.String(http.StatusNotFound, "delivery not found")
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// queueAsync accepts the request for forwarding in the background. The request is copied with a
+// detached context, as the inbound one is not usable once the handler returns, and its context is
+// canceled.
+func (p *SprayProxy) queueAsync(c *gin.Context, deliveryID string, body []byte, backends []string, zapCommonFields []zapcore.Field) {
+	requestID := c.GetString("requestId")
+	req := c.Request.Clone(context.Background())
+	req.Body = http.NoBody
+	job := &asyncJob{
+		requestID:       requestID,
+		deliveryID:      deliveryID,
+		req:             req,
+		body:            body,
+		backends:        backends,
+		zapCommonFields: append(zapCommonFields, zap.Bool("async", true)),
+	}
+	d := &AsyncDelivery{
+		RequestID:  requestID,
+		DeliveryID: deliveryID,
+		Event:      req.Header.Get("X-GitHub-Event"),
+		State:      asyncQueued,
+		ReceivedAt: time.Now().UTC(),
+	}
+	if !p.async.enqueue(job, d) {
+		if p.dedup != nil && deliveryID != "" {
+			// the sender may retry, which is not a duplicate
+			p.dedup.release(deliveryID, backends)
+		}
+		c.String(http.StatusServiceUnavailable, "queue full")
+		p.logger.Error("failed to queue request: queue full", zapCommonFields...)
+		return
+	}
+	c.Header("X-Request-Id", requestID)
+	c.String(http.StatusAccepted, "queued")
+}
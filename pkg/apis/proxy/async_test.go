@@ -0,0 +1,192 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func sendAsyncRequest(proxy *SprayProxy, requestID string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	ctx.Set("requestId", requestID)
+	proxy.HandleProxy(ctx)
+	return w
+}
+
+func getAsyncDelivery(t *testing.T, proxy *SprayProxy, requestID string) *AsyncDelivery {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/deliveries/"+requestID, nil)
+	ctx.Params = gin.Params{{Key: "id", Value: requestID}}
+	proxy.GetAsyncDelivery(ctx)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	d := &AsyncDelivery{}
+	if err := json.Unmarshal(w.Body.Bytes(), d); err != nil {
+		t.Fatalf("failed to decode delivery %q: %v", w.Body.String(), err)
+	}
+	return d
+}
+
+func TestAsyncForward(t *testing.T) {
+	release := make(chan struct{})
+	ok := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	t.Setenv("SPRAYPROXY_ASYNC", "true")
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{ok.URL: "", failing.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	proxy.Start(stopCh)
+
+	// the request is accepted while the backend is still blocked
+	w := sendAsyncRequest(proxy, "req-1")
+	if w.Code != http.StatusAccepted || w.Header().Get("X-Request-Id") != "req-1" {
+		t.Fatalf("expected request to be accepted, got %d %q", w.Code, w.Body.String())
+	}
+	if d := getAsyncDelivery(t, proxy, "req-1"); d.State == asyncCompleted {
+		t.Errorf("expected delivery not to be completed before the backend answered")
+	}
+	close(release)
+
+	var d *AsyncDelivery
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if d = getAsyncDelivery(t, proxy, "req-1"); d.State == asyncCompleted {
+			break
+		}
+	}
+	if d.State != asyncCompleted || d.Result != "proxied" || d.StartedAt == nil || d.CompletedAt == nil {
+		t.Fatalf("expected completed delivery, got %+v", d)
+	}
+	if len(d.Backends) != 2 {
+		t.Fatalf("expected outcome of 2 backends, got %+v", d.Backends)
+	}
+	for _, outcome := range d.Backends {
+		if outcome.Backend == failing.URL && (outcome.ErrorClass != "http-5xx" || outcome.Error == "") {
+			t.Errorf("expected failing backend outcome with error, got %+v", outcome)
+		}
+		if outcome.Backend == ok.URL && outcome.Status != http.StatusOK {
+			t.Errorf("expected successful backend outcome, got %+v", outcome)
+		}
+	}
+}
+
+func TestAsyncQueueFull(t *testing.T) {
+	t.Setenv("SPRAYPROXY_ASYNC", "true")
+	t.Setenv("SPRAYPROXY_ASYNC_QUEUE_SIZE", "1")
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{"http://localhost:1": ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	// the workers are not started, so the queue fills up
+	if w := sendAsyncRequest(proxy, "req-1"); w.Code != http.StatusAccepted {
+		t.Errorf("expected status code %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if w := sendAsyncRequest(proxy, "req-2"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if d := proxy.async.get("req-2"); d != nil {
+		t.Errorf("expected rejected delivery not to be tracked, got %+v", d)
+	}
+	// the retry of a rejected delivery is not a duplicate
+	proxy.dedup = newDedupCache(time.Minute, 10, DedupPolicyDrop)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	ctx.Request.Header.Set(deliveryHeader, "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if duplicate, _, _ := proxy.dedup.check("72d3162e-cc78-11e3-81ab-4c9367dc0958", nil, time.Now()); duplicate {
+		t.Errorf("expected the rejected delivery to be forgotten")
+	}
+
+	// queued requests are dropped on shutdown
+	stopCh := make(chan struct{})
+	close(stopCh)
+	proxy.runAsync(stopCh)
+	if d := proxy.async.get("req-1"); d == nil || d.State != asyncDropped {
+		t.Errorf("expected dropped delivery, got %+v", d)
+	}
+}
+
+func TestAsyncForwarderTracking(t *testing.T) {
+	async := newAsyncForwarder(1, 10, 2)
+	for _, id := range []string{"a", "b", "c"} {
+		async.track(&AsyncDelivery{RequestID: id, State: asyncQueued})
+	}
+	if async.get("a") != nil {
+		t.Errorf("expected oldest delivery to be dropped")
+	}
+	async.update("c", func(d *AsyncDelivery) { d.State = asyncCompleted })
+	if list := async.list(asyncQueued); len(list) != 1 || list[0].RequestID != "b" {
+		t.Errorf("expected a single queued delivery, got %+v", list)
+	}
+	if list := async.list(""); len(list) != 2 || list[1].RequestID != "c" {
+		t.Errorf("expected deliveries in reception order, got %+v", list)
+	}
+}
+
+func TestAsyncForwarderQueueFull(t *testing.T) {
+	async := newAsyncForwarder(1, 1, 1)
+	if !async.enqueue(&asyncJob{requestID: "a"}, &AsyncDelivery{RequestID: "a", State: asyncQueued}) {
+		t.Fatalf("expected delivery to be queued")
+	}
+	if async.enqueue(&asyncJob{requestID: "b"}, &AsyncDelivery{RequestID: "b", State: asyncQueued}) {
+		t.Fatalf("expected delivery to be rejected with a full queue")
+	}
+	if async.get("a") == nil || async.get("b") != nil {
+		t.Errorf("expected the rejected delivery not to replace the queued one, got %+v", async.list(""))
+	}
+}
+
+func TestAsyncForwarderFromEnv(t *testing.T) {
+	for _, value := range []string{"", "false"} {
+		t.Setenv("SPRAYPROXY_ASYNC", value)
+		if async, err := asyncForwarderFromEnv(); err != nil || async != nil {
+			t.Errorf("expected asynchronous mode to be disabled for %q, got %v, %v", value, async, err)
+		}
+	}
+	for env, value := range map[string]string{
+		"SPRAYPROXY_ASYNC":             "yes please",
+		"SPRAYPROXY_ASYNC_WORKERS":     "0",
+		"SPRAYPROXY_ASYNC_QUEUE_SIZE":  "many",
+		"SPRAYPROXY_ASYNC_MAX_RESULTS": "-1",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_ASYNC", "true")
+			t.Setenv(env, value)
+			if _, err := asyncForwarderFromEnv(); err == nil {
+				t.Errorf("expected error for %s=%s", env, value)
+			}
+		})
+	}
+
+	t.Setenv("SPRAYPROXY_ASYNC", "true")
+	t.Setenv("SPRAYPROXY_OUTBOX_DIR", t.TempDir())
+	if _, err := NewSprayProxy(false, true, false, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error for asynchronous mode with outbox")
+	}
+}
@@ -0,0 +1,329 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"golang.org/x/net/http/httpguts"
+)
+
+var (
+	backendNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	// IDs of the backends without name, which names must not be mistaken for
+	backendHashIDRegex = regexp.MustCompile(`^[0-9a-f]{12}$`)
+	// label keys and values follow the Kubernetes syntax, keys may have a DNS subdomain prefix
+	labelPrefixRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+	labelNameRegex   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+)
+
+// headers which cannot be injected, as they are managed by the HTTP client
+var reservedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
+
+// validateBackend checks the settings of a backend.
+func validateBackend(b *v1alpha1.Backend) error {
+	u, err := url.Parse(b.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, expected an absolute http or https url", b.URL)
+	}
+	if b.Name != "" && (len(b.Name) > 63 || !backendNameRegex.MatchString(b.Name)) {
+		return fmt.Errorf("invalid name %q, expected a lowercase DNS label", b.Name)
+	}
+	if backendHashIDRegex.MatchString(b.Name) {
+		return fmt.Errorf("invalid name %q, 12 hexadecimal characters are reserved for the IDs of backends without name", b.Name)
+	}
+	for key, value := range b.Labels {
+		if err := validateLabel(key, value); err != nil {
+			return err
+		}
+	}
+	if b.TTL != "" {
+		if ttl, err := time.ParseDuration(b.TTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid ttl %q, expected a positive duration", b.TTL)
+		}
+	}
+	if b.Timeout != "" {
+		if timeout, err := time.ParseDuration(b.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q, expected a positive duration", b.Timeout)
+		}
+	}
+	if err := validateBackendRetryPolicy(b.Retry); err != nil {
+		return err
+	}
+	if b.HealthCheck != nil {
+		if b.HealthCheck.Path != "" && !strings.HasPrefix(b.HealthCheck.Path, "/") {
+			return fmt.Errorf("invalid health check path %q, expected an absolute path", b.HealthCheck.Path)
+		}
+		for _, code := range b.HealthCheck.StatusCodes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid health check status code %d", code)
+			}
+		}
+	}
+	for name, value := range b.Headers {
+		if !httpguts.ValidHeaderFieldName(name) || reservedHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid value for header %q", name)
+		}
+	}
+	if err := validateBackendTLS(b.TLS); err != nil {
+		return err
+	}
+	if err := validateRoutingRules(b.Routing); err != nil {
+		return err
+	}
+	return validatePathRewrite(b.PathRewrite)
+}
+
+// backendLimits bound the settings of the backends registered through the API, which are less
+// trusted than the proxy configuration.
+type backendLimits struct {
+	maxTimeout       time.Duration
+	maxRetryAttempts int
+	maxRetryBackoff  time.Duration
+	// allowInsecureTLS lets the API disable the verification of the backend certificates
+	allowInsecureTLS bool
+	// tlsFilesDir is the directory the TLS files set with the API must be in, they cannot be set
+	// when empty
+	tlsFilesDir string
+}
+
+// backendLimitsFromEnv returns the default backend limits, overridden by the
+// SPRAYPROXY_BACKEND_MAX_*, SPRAYPROXY_BACKEND_ALLOW_INSECURE_TLS and
+// SPRAYPROXY_BACKEND_TLS_FILES_DIR env vars.
+func backendLimitsFromEnv() (backendLimits, error) {
+	limits := backendLimits{
+		maxTimeout:       2 * time.Minute,
+		maxRetryAttempts: 10,
+		maxRetryBackoff:  time.Minute,
+	}
+	if v := os.Getenv("SPRAYPROXY_BACKEND_MAX_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return limits, fmt.Errorf("invalid SPRAYPROXY_BACKEND_MAX_TIMEOUT %q", v)
+		}
+		limits.maxTimeout = timeout
+	}
+	if v := os.Getenv("SPRAYPROXY_BACKEND_MAX_RETRY_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return limits, fmt.Errorf("invalid SPRAYPROXY_BACKEND_MAX_RETRY_ATTEMPTS %q", v)
+		}
+		limits.maxRetryAttempts = attempts
+	}
+	if v := os.Getenv("SPRAYPROXY_BACKEND_MAX_RETRY_BACKOFF"); v != "" {
+		backoff, err := time.ParseDuration(v)
+		if err != nil || backoff < 0 {
+			return limits, fmt.Errorf("invalid SPRAYPROXY_BACKEND_MAX_RETRY_BACKOFF %q", v)
+		}
+		limits.maxRetryBackoff = backoff
+	}
+	if v := os.Getenv("SPRAYPROXY_BACKEND_ALLOW_INSECURE_TLS"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return limits, fmt.Errorf("invalid SPRAYPROXY_BACKEND_ALLOW_INSECURE_TLS %q", v)
+		}
+		limits.allowInsecureTLS = allow
+	}
+	if v := os.Getenv("SPRAYPROXY_BACKEND_TLS_FILES_DIR"); v != "" {
+		if !filepath.IsAbs(v) {
+			return limits, fmt.Errorf("invalid SPRAYPROXY_BACKEND_TLS_FILES_DIR %q, expected an absolute path", v)
+		}
+		limits.tlsFilesDir = filepath.Clean(v)
+	}
+	return limits, nil
+}
+
+// validate checks the settings of a backend registered through the API against the limits. The
+// settings are expected to be valid, see validateBackend.
+func (l backendLimits) validate(b *v1alpha1.Backend) error {
+	if b.Timeout != "" {
+		if timeout, _ := time.ParseDuration(b.Timeout); timeout > l.maxTimeout {
+			return fmt.Errorf("timeout %q exceeds the maximum of %s", b.Timeout, l.maxTimeout)
+		}
+	}
+	if b.Retry != nil {
+		if b.Retry.MaxAttempts > l.maxRetryAttempts {
+			return fmt.Errorf("retry max attempts %d exceeds the maximum of %d", b.Retry.MaxAttempts, l.maxRetryAttempts)
+		}
+		for _, backoff := range []string{b.Retry.InitialBackoff, b.Retry.MaxBackoff} {
+			if d, _ := time.ParseDuration(backoff); d > l.maxRetryBackoff {
+				return fmt.Errorf("retry backoff %q exceeds the maximum of %s", backoff, l.maxRetryBackoff)
+			}
+		}
+	}
+	if b.TLS != nil && b.TLS.InsecureSkipVerify && !l.allowInsecureTLS {
+		return errors.New("insecureSkipVerify is not allowed, see SPRAYPROXY_BACKEND_ALLOW_INSECURE_TLS")
+	}
+	return validateBackendTLSFiles(b.TLS, l.tlsFilesDir)
+}
+
+// backendRegexes holds the compiled regular expressions of a backend, keyed by expression.
+type backendRegexes map[string]*regexp.Regexp
+
+// compileBackendRegexes compiles the regular expressions of the routing rules and path rewrite of
+// the backend. Invalid expressions, which are rejected by validateBackend, are left out.
+func compileBackendRegexes(b *v1alpha1.Backend) backendRegexes {
+	exprs := []string{}
+	if b.Routing != nil {
+		for _, filter := range append(append([]v1alpha1.EventFilter{}, b.Routing.Include...), b.Routing.Exclude...) {
+			exprs = append(exprs, filter.RepositoryRegexes...)
+		}
+	}
+	if b.PathRewrite != nil && b.PathRewrite.Replace != nil {
+		exprs = append(exprs, b.PathRewrite.Replace.Pattern)
+	}
+	if len(exprs) == 0 {
+		return nil
+	}
+	regexes := backendRegexes{}
+	for _, expr := range exprs {
+		if re, err := regexp.Compile(expr); err == nil {
+			regexes[expr] = re
+		}
+	}
+	return regexes
+}
+
+func validateLabel(key, value string) error {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if len(prefix) > 253 || !labelPrefixRegex.MatchString(prefix) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+	}
+	if len(name) > 63 || !labelNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	if len(value) > 63 || (value != "" && !labelNameRegex.MatchString(value)) {
+		return fmt.Errorf("invalid value for label %q", key)
+	}
+	return nil
+}
+
+func validateBackendRetryPolicy(retry *v1alpha1.RetryPolicy) error {
+	if retry == nil {
+		return nil
+	}
+	if retry.MaxAttempts < 0 {
+		return fmt.Errorf("invalid retry max attempts %d", retry.MaxAttempts)
+	}
+	for _, backoff := range []string{retry.InitialBackoff, retry.MaxBackoff} {
+		if backoff == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(backoff); err != nil || d < 0 {
+			return fmt.Errorf("invalid retry backoff %q", backoff)
+		}
+	}
+	for _, code := range retry.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid retry status code %d", code)
+		}
+	}
+	return nil
+}
+
+// backendNameConflict returns the URL of another backend with the same name, if any.
+func backendNameConflict(backends map[string]*v1alpha1.Backend, b *v1alpha1.Backend) (string, bool) {
+	if b.Name == "" {
+		return "", false
+	}
+	for url, other := range backends {
+		if url != b.URL && other.Name == b.Name {
+			return url, true
+		}
+	}
+	return "", false
+}
+
+// backendID identifies the backend in the API. It is the backend name, or a hash of the URL for
+// backends without name.
+func backendID(b *v1alpha1.Backend) string {
+	if b.Name != "" {
+		return b.Name
+	}
+	sum := sha256.Sum256([]byte(b.URL))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// findBackend returns the backend of the snapshot with the ID.
+func findBackend(snapshot *backendSnapshot, id string) (*v1alpha1.Backend, bool) {
+	for _, url := range snapshot.urls {
+		if b, _ := snapshot.get(url); backendID(b) == id {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// backendClient returns the client used to forward requests to the backend, which is the
+// given client with the transport of the backend, and the backend timeout if it overrides it.
+// The backend timeout is capped by the limits, as the backend may have been registered before
+// they were lowered.
+func (p *SprayProxy) backendClient(client *http.Client, url string, b *v1alpha1.Backend) *http.Client {
+	backendClient := *client
+	if b != nil && b.Timeout != "" {
+		backendClient.Timeout, _ = time.ParseDuration(b.Timeout)
+		if backendClient.Timeout > p.limits.maxTimeout {
+			backendClient.Timeout = p.limits.maxTimeout
+		}
+	}
+	backendClient.Transport = p.backendTransport(url, b)
+	return &backendClient
+}
+
+// backendRetryPolicy returns the proxy retry policy, overridden by the backend settings, which are
+// capped by the limits.
+func (p *SprayProxy) backendRetryPolicy(b *v1alpha1.Backend) RetryPolicy {
+	policy := p.retryPolicy
+	if b == nil || b.Retry == nil {
+		return policy
+	}
+	if b.Retry.MaxAttempts > 0 {
+		policy.MaxAttempts = b.Retry.MaxAttempts
+		if policy.MaxAttempts > p.limits.maxRetryAttempts {
+			policy.MaxAttempts = p.limits.maxRetryAttempts
+		}
+	}
+	if b.Retry.InitialBackoff != "" {
+		policy.InitialBackoff, _ = time.ParseDuration(b.Retry.InitialBackoff)
+		if policy.InitialBackoff > p.limits.maxRetryBackoff {
+			policy.InitialBackoff = p.limits.maxRetryBackoff
+		}
+	}
+	if b.Retry.MaxBackoff != "" {
+		policy.MaxBackoff, _ = time.ParseDuration(b.Retry.MaxBackoff)
+		if policy.MaxBackoff > p.limits.maxRetryBackoff {
+			policy.MaxBackoff = p.limits.maxRetryBackoff
+		}
+	}
+	if len(b.Retry.StatusCodes) > 0 {
+		policy.RetryableStatusCodes = b.Retry.StatusCodes
+	}
+	return policy
+}
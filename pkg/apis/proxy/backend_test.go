@@ -0,0 +1,236 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+func TestValidateBackend(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		backend v1alpha1.Backend
+		valid   bool
+	}{
+		{name: "url only", backend: v1alpha1.Backend{URL: "https://cluster-a.example.com/hook"}, valid: true},
+		{name: "all settings", valid: true, backend: v1alpha1.Backend{
+			URL:         "https://cluster-a.example.com",
+			Name:        "cluster-a",
+			Labels:      map[string]string{"env": "staging", "example.com/team": "build", "empty": ""},
+			Owner:       "build-team",
+			Description: "staging cluster",
+			Timeout:     "30s",
+			Retry:       &v1alpha1.RetryPolicy{MaxAttempts: 3, InitialBackoff: "100ms", MaxBackoff: "1s", StatusCodes: []int{503}},
+			TLS: &v1alpha1.TLSConfig{
+				ServerName:       "cluster-a.internal",
+				CAFile:           "/etc/tls/ca.crt",
+				CertFile:         "/etc/tls/tls.crt",
+				KeyFile:          "/etc/tls/tls.key",
+				PinnedPublicKeys: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+			},
+			Headers: map[string]string{"X-Cluster": "a"},
+			Paused:  true,
+		}},
+		{name: "missing url", backend: v1alpha1.Backend{}},
+		{name: "relative url", backend: v1alpha1.Backend{URL: "/hook"}},
+		{name: "unsupported scheme", backend: v1alpha1.Backend{URL: "ftp://cluster-a"}},
+		{name: "invalid name", backend: v1alpha1.Backend{URL: "http://cluster-a", Name: "Cluster A"}},
+		{name: "name like a backend ID", backend: v1alpha1.Backend{URL: "http://cluster-a", Name: backendID(&v1alpha1.Backend{URL: "http://cluster-b"})}},
+		{name: "invalid label key", backend: v1alpha1.Backend{URL: "http://cluster-a", Labels: map[string]string{"-env": "staging"}}},
+		{name: "invalid label prefix", backend: v1alpha1.Backend{URL: "http://cluster-a", Labels: map[string]string{"Example.com/env": "staging"}}},
+		{name: "invalid label value", backend: v1alpha1.Backend{URL: "http://cluster-a", Labels: map[string]string{"env": "not valid"}}},
+		{name: "invalid timeout", backend: v1alpha1.Backend{URL: "http://cluster-a", Timeout: "0s"}},
+		{name: "invalid retry attempts", backend: v1alpha1.Backend{URL: "http://cluster-a", Retry: &v1alpha1.RetryPolicy{MaxAttempts: -1}}},
+		{name: "invalid retry backoff", backend: v1alpha1.Backend{URL: "http://cluster-a", Retry: &v1alpha1.RetryPolicy{MaxBackoff: "soon"}}},
+		{name: "invalid retry status code", backend: v1alpha1.Backend{URL: "http://cluster-a", Retry: &v1alpha1.RetryPolicy{StatusCodes: []int{42}}}},
+		{name: "invalid header name", backend: v1alpha1.Backend{URL: "http://cluster-a", Headers: map[string]string{"X Cluster": "a"}}},
+		{name: "invalid header value", backend: v1alpha1.Backend{URL: "http://cluster-a", Headers: map[string]string{"X-Cluster": "a\nb"}}},
+		{name: "client certificate without key", backend: v1alpha1.Backend{URL: "https://cluster-a", TLS: &v1alpha1.TLSConfig{CertFile: "/etc/tls/tls.crt"}}},
+		{name: "invalid pinned public key", backend: v1alpha1.Backend{URL: "https://cluster-a", TLS: &v1alpha1.TLSConfig{PinnedPublicKeys: []string{"c2hhMjU2"}}}},
+		{name: "reserved header", backend: v1alpha1.Backend{URL: "http://cluster-a", Headers: map[string]string{"host": "cluster-b"}}},
+	} {
+		err := validateBackend(&test.backend)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestBackendSettings(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	injected := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+	}))
+	defer injected.Close()
+	slowAttempts := int32(0)
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&slowAttempts, 1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	pausedCalled := int32(0)
+	paused := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&pausedCalled, 1)
+	}))
+	defer paused.Close()
+
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.backends = newBackendRegistry(map[string]*v1alpha1.Backend{
+		injected.URL: {URL: injected.URL, Headers: map[string]string{"X-Cluster": "a", "X-GitHub-Event": "ping"}},
+		slow.URL:     {URL: slow.URL, Timeout: "50ms", Retry: &v1alpha1.RetryPolicy{MaxAttempts: 2, InitialBackoff: "1ms"}},
+		paused.URL:   {URL: paused.URL, Paused: true},
+	})
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	ctx.Request.Header.Set("X-GitHub-Event", "push")
+	proxy.HandleProxy(ctx)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status code %d for the backend timeout, got %d", http.StatusBadGateway, w.Code)
+	}
+	header := <-headers
+	if header.Get("X-Cluster") != "a" || header.Get("X-GitHub-Event") != "ping" {
+		t.Errorf("expected injected headers to be set, got %v", header)
+	}
+	if attempts := atomic.LoadInt32(&slowAttempts); attempts != 2 {
+		t.Errorf("expected 2 attempts to the slow backend, got %d", attempts)
+	}
+	if called := atomic.LoadInt32(&pausedCalled); called != 0 {
+		t.Errorf("expected paused backend not to be called, got %d requests", called)
+	}
+}
+
+func TestUpdateBackend(t *testing.T) {
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, test := range []struct {
+		name     string
+		handler  gin.HandlerFunc
+		body     string
+		expected int
+	}{
+		{name: "register", handler: proxy.RegisterBackend, body: `{"url":"http://cluster-a","name":"cluster-a","owner":"build-team"}`, expected: http.StatusOK},
+		{name: "register with used name", handler: proxy.RegisterBackend, body: `{"url":"http://cluster-b","name":"cluster-a"}`, expected: http.StatusConflict},
+		{name: "register with invalid settings", handler: proxy.RegisterBackend, body: `{"url":"http://cluster-b","timeout":"never"}`, expected: http.StatusBadRequest},
+		{name: "update unknown backend", handler: proxy.UpdateBackend, body: `{"url":"http://cluster-b"}`, expected: http.StatusNotFound},
+		{name: "register above the timeout limit", handler: proxy.RegisterBackend, body: `{"url":"http://cluster-b","timeout":"1h"}`, expected: http.StatusBadRequest},
+		{name: "register with insecure TLS", handler: proxy.RegisterBackend, body: `{"url":"https://cluster-b","tls":{"insecureSkipVerify":true}}`, expected: http.StatusBadRequest},
+		{name: "register with TLS files", handler: proxy.RegisterBackend, body: `{"url":"https://cluster-b","tls":{"caFile":"/etc/ssl/certs/ca.crt"}}`, expected: http.StatusBadRequest},
+		{name: "update with invalid settings", handler: proxy.UpdateBackend, body: `{"url":"http://cluster-a","name":"Cluster A"}`, expected: http.StatusBadRequest},
+		{name: "update above the retry limits", handler: proxy.UpdateBackend, body: `{"url":"http://cluster-a","retry":{"maxAttempts":100}}`, expected: http.StatusBadRequest},
+		{name: "update with TLS files", handler: proxy.UpdateBackend, body: `{"url":"http://cluster-a","tls":{"certFile":"/var/run/secrets/tls.crt","keyFile":"/var/run/secrets/tls.key"}}`, expected: http.StatusBadRequest},
+		{name: "update", handler: proxy.UpdateBackend, body: `{"url":"http://cluster-a","name":"cluster-a","owner":"release-team","paused":true,"ttl":"1h"}`, expected: http.StatusOK},
+	} {
+		if w := sendBackendRequest(test.handler, test.body); w.Code != test.expected {
+			t.Errorf("%s: expected status code %d, got %d: %s", test.name, test.expected, w.Code, w.Body.String())
+		}
+	}
+
+	// static backends are only changed by the proxy configuration
+	if _, _, err := proxy.addBackend(&v1alpha1.Backend{URL: "http://static", Name: "static", Static: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w := sendBackendRequest(proxy.UpdateBackend, `{"url":"http://static","name":"static","owner":"build-team"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected status code %d for the static backend update, got %d", http.StatusConflict, w.Code)
+	}
+	if w := sendBackendRequest(proxy.UnregisterBackend, `{"url":"http://static"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected status code %d for the static backend unregistration, got %d", http.StatusConflict, w.Code)
+	}
+	if b, _ := proxy.backends.get("http://static"); b == nil || b.Owner != "" {
+		t.Errorf("expected static backend to be unchanged, got %+v", b)
+	}
+	if w := sendBackendRequest(proxy.UpdateBackend, `{"url":"http://cluster-a","name":"static"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected status code %d for the used name, got %d", http.StatusConflict, w.Code)
+	}
+
+	b, ok := proxy.backends.get("http://cluster-a")
+	if !ok {
+		t.Fatalf("expected backend to be registered")
+	}
+	if b.Owner != "release-team" || !b.Paused {
+		t.Errorf("expected backend settings to be updated, got %+v", b)
+	}
+	if b.CreatedAt == nil || b.UpdatedAt == nil || b.UpdatedAt.Before(*b.CreatedAt) {
+		t.Errorf("expected created and updated timestamps, got %v and %v", b.CreatedAt, b.UpdatedAt)
+	}
+	if b.ExpiresAt == nil {
+		t.Errorf("expected lease to start with the new ttl")
+	}
+}
+
+func TestBackendLimits(t *testing.T) {
+	t.Setenv("SPRAYPROXY_BACKEND_MAX_TIMEOUT", "10s")
+	t.Setenv("SPRAYPROXY_BACKEND_MAX_RETRY_ATTEMPTS", "3")
+	t.Setenv("SPRAYPROXY_BACKEND_MAX_RETRY_BACKOFF", "2s")
+	t.Setenv("SPRAYPROXY_BACKEND_ALLOW_INSECURE_TLS", "true")
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, test := range []struct {
+		name    string
+		backend v1alpha1.Backend
+		valid   bool
+	}{
+		{name: "within the limits", valid: true, backend: v1alpha1.Backend{URL: "https://cluster-a", Timeout: "10s",
+			Retry: &v1alpha1.RetryPolicy{MaxAttempts: 3, InitialBackoff: "1s", MaxBackoff: "2s"}, TLS: &v1alpha1.TLSConfig{InsecureSkipVerify: true}}},
+		{name: "timeout", backend: v1alpha1.Backend{URL: "https://cluster-a", Timeout: "11s"}},
+		{name: "retry attempts", backend: v1alpha1.Backend{URL: "https://cluster-a", Retry: &v1alpha1.RetryPolicy{MaxAttempts: 4}}},
+		{name: "retry initial backoff", backend: v1alpha1.Backend{URL: "https://cluster-a", Retry: &v1alpha1.RetryPolicy{InitialBackoff: "3s"}}},
+		{name: "retry max backoff", backend: v1alpha1.Backend{URL: "https://cluster-a", Retry: &v1alpha1.RetryPolicy{MaxBackoff: "1m"}}},
+	} {
+		err := proxy.limits.validate(&test.backend)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	// backends registered before the limits were lowered are capped
+	b := &v1alpha1.Backend{URL: "http://cluster-a", Timeout: "1h", Retry: &v1alpha1.RetryPolicy{MaxAttempts: 100, InitialBackoff: "1m", MaxBackoff: "1h"}}
+	if client := proxy.backendClient(proxy.client, b.URL, b); client.Timeout != 10*time.Second {
+		t.Errorf("expected timeout to be capped to 10s, got %s", client.Timeout)
+	}
+	policy := proxy.backendRetryPolicy(b)
+	if policy.MaxAttempts != 3 || policy.InitialBackoff != 2*time.Second || policy.MaxBackoff != 2*time.Second {
+		t.Errorf("expected retry policy to be capped, got %+v", policy)
+	}
+}
+
+func TestBackendLimitsInvalidEnv(t *testing.T) {
+	for _, env := range []string{
+		"SPRAYPROXY_BACKEND_MAX_TIMEOUT",
+		"SPRAYPROXY_BACKEND_MAX_RETRY_ATTEMPTS",
+		"SPRAYPROXY_BACKEND_MAX_RETRY_BACKOFF",
+		"SPRAYPROXY_BACKEND_ALLOW_INSECURE_TLS",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, "-1")
+			if _, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{}); err == nil {
+				t.Errorf("expected an error for invalid %s", env)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+const (
+	// CA bundle the backend certificates are verified with, instead of the system roots
+	envBackendCAFile = "SPRAYPROXY_BACKEND_CA_FILE"
+	// client certificate and key presented to the backends
+	envBackendCertFile = "SPRAYPROXY_BACKEND_CLIENT_CERT_FILE"
+	envBackendKeyFile  = "SPRAYPROXY_BACKEND_CLIENT_KEY_FILE"
+)
+
+// backendTLSFromEnv returns the TLS settings of all backends, set by the SPRAYPROXY_BACKEND_CA_FILE,
+// SPRAYPROXY_BACKEND_CLIENT_CERT_FILE and SPRAYPROXY_BACKEND_CLIENT_KEY_FILE env vars. It returns
+// nil if none is set.
+func backendTLSFromEnv() (*v1alpha1.TLSConfig, error) {
+	settings := &v1alpha1.TLSConfig{
+		CAFile:   os.Getenv(envBackendCAFile),
+		CertFile: os.Getenv(envBackendCertFile),
+		KeyFile:  os.Getenv(envBackendKeyFile),
+	}
+	if settings.CAFile == "" && settings.CertFile == "" && settings.KeyFile == "" {
+		return nil, nil
+	}
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return nil, fmt.Errorf("%s and %s must be set together", envBackendCertFile, envBackendKeyFile)
+	}
+	return settings, nil
+}
+
+// validateBackendTLS checks the TLS settings of a backend. The files are only read when
+// connecting to the backend.
+func validateBackendTLS(settings *v1alpha1.TLSConfig) error {
+	if settings == nil {
+		return nil
+	}
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return errors.New("invalid tls settings, certFile and keyFile must be set together")
+	}
+	for _, pin := range settings.PinnedPublicKeys {
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("invalid tls pinned public key %q, expected a base64 encoded SHA-256 hash", pin)
+		}
+	}
+	return nil
+}
+
+// validateBackendTLSFiles checks that the TLS files of a backend registered with the API are in
+// the directory, as the proxy would otherwise read any file on behalf of the API callers. The files
+// cannot be set if the directory is empty.
+func validateBackendTLSFiles(settings *v1alpha1.TLSConfig, dir string) error {
+	if settings == nil {
+		return nil
+	}
+	for _, file := range []string{settings.CAFile, settings.CertFile, settings.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if dir == "" {
+			return errors.New("tls files are not allowed, see SPRAYPROXY_BACKEND_TLS_FILES_DIR")
+		}
+		if rel, err := filepath.Rel(dir, filepath.Clean(file)); !filepath.IsAbs(file) || err != nil ||
+			rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid tls file %q, expected a file in %s", file, dir)
+		}
+	}
+	return nil
+}
+
+// tlsFile is a CA bundle or a client certificate loaded from files, along with the versions of
+// the files it was loaded from.
+type tlsFile struct {
+	versions    []string
+	pool        *x509.CertPool
+	certificate *tls.Certificate
+	// failed holds the versions of the files which could not be loaded, so they are not logged again
+	failed []string
+}
+
+// tlsFiles loads the CA bundles and client certificates of the backends. The files are read again
+// on every connection, and reloaded if they changed, so rotated certificates are used for new
+// connections. Failed reloads keep the previous content.
+type tlsFiles struct {
+	logger *zap.Logger
+	mu     sync.Mutex
+	files  map[string]*tlsFile
+}
+
+func newTLSFiles(logger *zap.Logger) *tlsFiles {
+	return &tlsFiles{logger: logger, files: map[string]*tlsFile{}}
+}
+
+// get returns the content loaded from the paths, reloading it with load if the files changed.
+func (f *tlsFiles) get(key string, paths []string, load func(t *tlsFile, data [][]byte) error) (*tlsFile, error) {
+	data := make([][]byte, len(paths))
+	versions := make([]string, len(paths))
+	var err error
+	for i, path := range paths {
+		if data[i], err = os.ReadFile(path); err != nil {
+			break
+		}
+		versions[i] = fileVersion(data[i])
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current := f.files[key]
+	if err == nil && current != nil && (equalVersions(current.versions, versions) || equalVersions(current.failed, versions)) {
+		return current, nil
+	}
+	next := &tlsFile{versions: versions}
+	if err == nil {
+		err = load(next, data)
+	}
+	if err != nil {
+		if current == nil {
+			return nil, err
+		}
+		if !equalVersions(current.failed, versions) {
+			f.logger.Error("failed to reload backend TLS files, keeping the current ones", zap.Error(err), zap.Strings("files", paths))
+		}
+		current.failed = versions
+		return current, nil
+	}
+	if current != nil {
+		f.logger.Info("reloaded backend TLS files", zap.Strings("files", paths))
+	}
+	f.files[key] = next
+	return next, nil
+}
+
+func equalVersions(a, b []string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pool returns the CA certificates of the PEM bundle.
+func (f *tlsFiles) pool(caFile string) (*x509.CertPool, error) {
+	loaded, err := f.get("ca:"+caFile, []string{caFile}, func(t *tlsFile, data [][]byte) error {
+		t.pool = x509.NewCertPool()
+		if !t.pool.AppendCertsFromPEM(data[0]) {
+			return fmt.Errorf("no certificate found in CA bundle %s", caFile)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA bundle: %v", err)
+	}
+	return loaded.pool, nil
+}
+
+// certificate returns the client certificate of the PEM files.
+func (f *tlsFiles) certificate(certFile, keyFile string) (*tls.Certificate, error) {
+	loaded, err := f.get("cert:"+certFile+":"+keyFile, []string{certFile, keyFile}, func(t *tlsFile, data [][]byte) error {
+		certificate, err := tls.X509KeyPair(data[0], data[1])
+		if err != nil {
+			return err
+		}
+		t.certificate = &certificate
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	return loaded.certificate, nil
+}
+
+// load reads the files of the settings.
+func (f *tlsFiles) load(settings *v1alpha1.TLSConfig) error {
+	if settings.CAFile != "" {
+		if _, err := f.pool(settings.CAFile); err != nil {
+			return err
+		}
+	}
+	if settings.CertFile != "" {
+		if _, err := f.certificate(settings.CertFile, settings.KeyFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backendTLSConfig returns the TLS configuration of the connections to the backend, whose
+// settings override the proxy ones. It returns nil if the defaults apply.
+func (p *SprayProxy) backendTLSConfig(backendURL string, b *v1alpha1.Backend) *tls.Config {
+	settings := v1alpha1.TLSConfig{}
+	if p.backendTLS != nil {
+		settings = *p.backendTLS
+	}
+	if b != nil && b.TLS != nil {
+		settings.InsecureSkipVerify = b.TLS.InsecureSkipVerify
+		settings.ServerName = b.TLS.ServerName
+		settings.PinnedPublicKeys = b.TLS.PinnedPublicKeys
+		if b.TLS.CAFile != "" {
+			settings.CAFile = b.TLS.CAFile
+		}
+		if b.TLS.CertFile != "" {
+			settings.CertFile, settings.KeyFile = b.TLS.CertFile, b.TLS.KeyFile
+		}
+	} else if !p.insecureTLS && p.backendTLS == nil {
+		return nil
+	}
+	serverName := settings.ServerName
+	if serverName == "" {
+		if u, err := url.Parse(backendURL); err == nil {
+			serverName = u.Hostname()
+		}
+	}
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: p.insecureTLS || settings.InsecureSkipVerify,
+	}
+	if settings.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return p.tlsFiles.certificate(settings.CertFile, settings.KeyFile)
+		}
+	}
+	if settings.CAFile == "" && len(settings.PinnedPublicKeys) == 0 {
+		return config
+	}
+	// the CA bundle may change, so the certificate is verified here rather than by crypto/tls
+	verifyCA := !config.InsecureSkipVerify && settings.CAFile != ""
+	if verifyCA {
+		config.InsecureSkipVerify = true
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		chains := state.VerifiedChains
+		if verifyCA {
+			roots, err := p.tlsFiles.pool(settings.CAFile)
+			if err != nil {
+				return err
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			chains, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				DNSName:       serverName,
+			})
+			if err != nil {
+				return err
+			}
+		} else if len(chains) == 0 {
+			// the certificate is not verified, only the presented chain can be pinned
+			chains = [][]*x509.Certificate{state.PeerCertificates}
+		}
+		return verifyPinnedPublicKeys(chains, settings.PinnedPublicKeys)
+	}
+	return config
+}
+
+// verifyPinnedPublicKeys checks that a certificate of the chains has one of the pinned public
+// keys, if any.
+func verifyPinnedPublicKeys(chains [][]*x509.Certificate, pins []string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			hash := base64.StdEncoding.EncodeToString(sum[:])
+			for _, pin := range pins {
+				if hash == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("backend certificate does not match the pinned public keys")
+}
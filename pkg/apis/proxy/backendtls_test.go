@@ -0,0 +1,283 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+// testCA issues the certificates of the backend TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate and key in PEM format, for 127.0.0.1 or a client.
+func (ca *testCA) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "sprayproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// pin returns the pinned public key of the certificate.
+func (ca *testCA) pin() string {
+	sum := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newMTLSBackend starts a backend which requires client certificates issued by the CA, and
+// responds with the serial number of the client certificate.
+func newMTLSBackend(t *testing.T, ca *testCA) *httptest.Server {
+	cert, key := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	certificate, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Client-Serial", req.TLS.PeerCertificates[0].SerialNumber.String())
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// clientSerial sends a request to the backend over a new connection, and returns the serial
+// number of the client certificate it received.
+func clientSerial(proxy *SprayProxy, url string, b *v1alpha1.Backend) (int, error) {
+	client := proxy.backendClient(proxy.client, url, b)
+	// the TLS files are only read by the handshake of new connections
+	client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return strconv.Atoi(resp.Header.Get("X-Client-Serial"))
+}
+
+func TestBackendTLSFromEnv(t *testing.T) {
+	settings, err := backendTLSFromEnv()
+	if err != nil || settings != nil {
+		t.Errorf("expected no backend TLS settings by default, got %v, %v", settings, err)
+	}
+	t.Setenv(envBackendCertFile, "/etc/tls/tls.crt")
+	if _, err := backendTLSFromEnv(); err == nil {
+		t.Errorf("expected error for a client certificate without key")
+	}
+	t.Setenv(envBackendKeyFile, "/etc/tls/tls.key")
+	if _, err := NewSprayProxy(false, true, false, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error for missing client certificate files")
+	}
+	t.Setenv(envBackendCertFile, "")
+	t.Setenv(envBackendKeyFile, "")
+	empty := filepath.Join(t.TempDir(), "ca.crt")
+	writeFile(t, empty, []byte{})
+	t.Setenv(envBackendCAFile, empty)
+	if _, err := NewSprayProxy(false, true, false, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error for an empty CA bundle")
+	}
+}
+
+func TestValidateBackendTLSFiles(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		dir      string
+		settings *v1alpha1.TLSConfig
+		valid    bool
+	}{
+		{name: "no files", settings: &v1alpha1.TLSConfig{ServerName: "cluster-a.internal"}, valid: true},
+		{name: "files without directory", settings: &v1alpha1.TLSConfig{CAFile: "/etc/backends/ca.crt"}},
+		{name: "files in directory", dir: "/etc/backends", valid: true,
+			settings: &v1alpha1.TLSConfig{CAFile: "/etc/backends/ca.crt", CertFile: "/etc/backends/a/tls.crt", KeyFile: "/etc/backends/a/tls.key"}},
+		{name: "file outside directory", dir: "/etc/backends", settings: &v1alpha1.TLSConfig{CAFile: "/etc/ssl/ca.crt"}},
+		{name: "file escaping directory", dir: "/etc/backends", settings: &v1alpha1.TLSConfig{CAFile: "/etc/backends/../sprayproxy/tls.key"}},
+		{name: "file with directory prefix", dir: "/etc/backends", settings: &v1alpha1.TLSConfig{CAFile: "/etc/backends-other/ca.crt"}},
+		{name: "relative file", dir: "/etc/backends", settings: &v1alpha1.TLSConfig{CAFile: "ca.crt"}},
+	} {
+		err := validateBackendTLSFiles(test.settings, test.dir)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	t.Setenv("SPRAYPROXY_BACKEND_TLS_FILES_DIR", "backends")
+	if _, err := NewSprayProxy(false, true, true, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error for a relative TLS files directory")
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	backend := newMTLSBackend(t, ca)
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeFile(t, caFile, ca.pem)
+	cert, key := ca.issue(t, 3, x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	otherPin := newTestCA(t).pin()
+
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, test := range []struct {
+		name  string
+		tls   *v1alpha1.TLSConfig
+		valid bool
+	}{
+		{name: "system roots"},
+		{name: "CA bundle without client certificate", tls: &v1alpha1.TLSConfig{CAFile: caFile}},
+		{name: "CA bundle and client certificate", valid: true, tls: &v1alpha1.TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}},
+		{name: "pinned CA", valid: true, tls: &v1alpha1.TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, PinnedPublicKeys: []string{otherPin, ca.pin()}}},
+		{name: "pinning mismatch", tls: &v1alpha1.TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, PinnedPublicKeys: []string{otherPin}}},
+		{name: "server name mismatch", tls: &v1alpha1.TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "cluster-a.internal"}},
+		// pins are checked against the presented chain when skipping verification
+		{name: "insecure pinning mismatch", tls: &v1alpha1.TLSConfig{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile, PinnedPublicKeys: []string{otherPin}}},
+	} {
+		serial, err := clientSerial(proxy, backend.URL, &v1alpha1.Backend{URL: backend.URL, TLS: test.tls})
+		if test.valid && (err != nil || serial != 3) {
+			t.Errorf("%s: expected client certificate 3, got %d, %v", test.name, serial, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	// proxy settings apply to all backends
+	t.Setenv(envBackendCAFile, caFile)
+	t.Setenv(envBackendCertFile, certFile)
+	t.Setenv(envBackendKeyFile, keyFile)
+	proxy, err = NewSprayProxy(false, true, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if serial, err := clientSerial(proxy, backend.URL, nil); err != nil || serial != 3 {
+		t.Errorf("expected client certificate 3 with the proxy settings, got %d, %v", serial, err)
+	}
+	b := &v1alpha1.Backend{URL: backend.URL, TLS: &v1alpha1.TLSConfig{PinnedPublicKeys: []string{otherPin}}}
+	if _, err := clientSerial(proxy, backend.URL, b); err == nil {
+		t.Errorf("expected backend pins to apply along with the proxy settings")
+	}
+}
+
+func TestBackendTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	backend := newMTLSBackend(t, ca)
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeFile(t, caFile, ca.pem)
+	cert, key := ca.issue(t, 3, x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	b := &v1alpha1.Backend{URL: backend.URL, TLS: &v1alpha1.TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}}
+	if serial, err := clientSerial(proxy, backend.URL, b); err != nil || serial != 3 {
+		t.Fatalf("expected client certificate 3, got %d, %v", serial, err)
+	}
+
+	// rotated certificates are presented on new connections
+	cert, key = ca.issue(t, 4, x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	if serial, err := clientSerial(proxy, backend.URL, b); err != nil || serial != 4 {
+		t.Errorf("expected rotated client certificate 4, got %d, %v", serial, err)
+	}
+
+	// invalid files keep the current certificate
+	writeFile(t, keyFile, []byte("invalid"))
+	if serial, err := clientSerial(proxy, backend.URL, b); err != nil || serial != 4 {
+		t.Errorf("expected client certificate 4 to be kept, got %d, %v", serial, err)
+	}
+
+	// a CA bundle which does not hold the backend CA fails the verification
+	writeFile(t, caFile, newTestCA(t).pem)
+	if _, err := clientSerial(proxy, backend.URL, b); err == nil {
+		t.Errorf("expected the rotated CA bundle to be used")
+	}
+}
@@ -0,0 +1,282 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// CircuitOpenActionSkip fails the deliveries to a backend whose circuit is open right away.
+	CircuitOpenActionSkip = "skip"
+	// CircuitOpenActionQueue keeps the deliveries to a backend whose circuit is open in the
+	// outbox, until the circuit closes again.
+	CircuitOpenActionQueue = "queue"
+)
+
+// errCircuitOpen is the error of the deliveries skipped because the backend circuit is open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitState is the state of a backend circuit breaker. The values are reported by the
+// circuit state metric.
+type circuitState int
+
+const (
+	// requests are forwarded, failures are counted
+	circuitClosed circuitState = iota
+	// a single probe request is forwarded, which closes the circuit if it succeeds
+	circuitHalfOpen
+	// requests are not forwarded until the open duration has elapsed
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreakerConfig holds the thresholds tripping the circuit breakers. A zero threshold is
+// disabled.
+type circuitBreakerConfig struct {
+	consecutiveFailures int
+	errorRate           float64
+	// window is the number of recent requests the error rate is computed over
+	window       int
+	openDuration time.Duration
+	openAction   string
+}
+
+// circuitBreaker tracks the failures of a single backend.
+type circuitBreaker struct {
+	state               circuitState
+	openedAt            time.Time
+	consecutiveFailures int
+	// results is a ring buffer of the recent request outcomes, true for failures
+	results []bool
+	next    int
+	// probing is set while the half-open probe request is in flight
+	probing bool
+}
+
+// circuitBreakers stop forwarding to the backends which keep failing, so that deliveries to the
+// other backends do not wait for their timeouts. Nil circuit breakers always allow forwarding.
+type circuitBreakers struct {
+	config   circuitBreakerConfig
+	logger   *zap.Logger
+	mu       sync.Mutex
+	backends map[string]*circuitBreaker
+}
+
+func newCircuitBreakers(config circuitBreakerConfig, logger *zap.Logger) *circuitBreakers {
+	return &circuitBreakers{config: config, logger: logger, backends: map[string]*circuitBreaker{}}
+}
+
+// circuitBreakersFromEnv returns the circuit breakers configured by SPRAYPROXY_CIRCUIT_BREAKER_*
+// env vars, or nil if neither threshold is set.
+func circuitBreakersFromEnv(logger *zap.Logger) (*circuitBreakers, error) {
+	config := circuitBreakerConfig{window: 20, openDuration: 30 * time.Second, openAction: CircuitOpenActionSkip}
+	if v := os.Getenv("SPRAYPROXY_CIRCUIT_BREAKER_CONSECUTIVE_FAILURES"); v != "" {
+		failures, err := strconv.Atoi(v)
+		if err != nil || failures < 0 {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_CIRCUIT_BREAKER_CONSECUTIVE_FAILURES %q", v)
+		}
+		config.consecutiveFailures = failures
+	}
+	if v := os.Getenv("SPRAYPROXY_CIRCUIT_BREAKER_ERROR_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_CIRCUIT_BREAKER_ERROR_RATE %q", v)
+		}
+		config.errorRate = rate
+	}
+	if v := os.Getenv("SPRAYPROXY_CIRCUIT_BREAKER_WINDOW"); v != "" {
+		window, err := strconv.Atoi(v)
+		if err != nil || window < 1 {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_CIRCUIT_BREAKER_WINDOW %q", v)
+		}
+		config.window = window
+	}
+	if v := os.Getenv("SPRAYPROXY_CIRCUIT_BREAKER_OPEN_DURATION"); v != "" {
+		duration, err := time.ParseDuration(v)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_CIRCUIT_BREAKER_OPEN_DURATION %q", v)
+		}
+		config.openDuration = duration
+	}
+	if v := os.Getenv("SPRAYPROXY_CIRCUIT_BREAKER_OPEN_ACTION"); v != "" {
+		switch v {
+		case CircuitOpenActionSkip, CircuitOpenActionQueue:
+			config.openAction = v
+		default:
+			return nil, fmt.Errorf("invalid SPRAYPROXY_CIRCUIT_BREAKER_OPEN_ACTION %q", v)
+		}
+	}
+	if config.consecutiveFailures == 0 && config.errorRate == 0 {
+		return nil, nil
+	}
+	return newCircuitBreakers(config, logger), nil
+}
+
+// get returns the circuit breaker of the backend, creating a closed one if needed. The lock
+// must be held.
+func (c *circuitBreakers) get(backend string) *circuitBreaker {
+	b, ok := c.backends[backend]
+	if !ok {
+		b = &circuitBreaker{results: make([]bool, 0, c.config.window)}
+		c.backends[backend] = b
+		metrics.SetCircuitState(backend, int(circuitClosed))
+	}
+	return b
+}
+
+// setState changes the state of the circuit breaker. The lock must be held.
+func (c *circuitBreakers) setState(backend string, b *circuitBreaker, state circuitState, now time.Time) {
+	if b.state == state {
+		return
+	}
+	c.logger.Info("circuit breaker state changed", zap.String("backend", backend),
+		zap.String("from", b.state.String()), zap.String("to", state.String()))
+	b.state = state
+	b.probing = false
+	if state == circuitOpen {
+		b.openedAt = now
+	}
+	if state == circuitClosed {
+		b.consecutiveFailures = 0
+		b.results = b.results[:0]
+		b.next = 0
+	}
+	metrics.SetCircuitState(backend, int(state))
+}
+
+// allow indicates if a request can be forwarded to the backend. Once the open duration has
+// elapsed, a single probe request is allowed until its result is recorded.
+func (c *circuitBreakers) allow(backend string, now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.get(backend)
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < c.config.openDuration {
+			return false
+		}
+		c.setState(backend, b, circuitHalfOpen, now)
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the circuit breaker of the backend with the outcome of a request allowed by
+// allow. Transport errors and 5xx responses are failures.
+func (c *circuitBreakers) record(backend string, result forwardResult, now time.Time) {
+	if c == nil {
+		return
+	}
+	failed := result.err != nil || result.status >= 500
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.get(backend)
+	switch b.state {
+	case circuitHalfOpen:
+		if failed {
+			c.setState(backend, b, circuitOpen, now)
+		} else {
+			c.setState(backend, b, circuitClosed, now)
+		}
+		return
+	case circuitOpen:
+		// a request allowed before the circuit opened
+		return
+	}
+	if failed {
+		b.consecutiveFailures++
+	} else {
+		b.consecutiveFailures = 0
+	}
+	if len(b.results) < c.config.window {
+		b.results = append(b.results, failed)
+	} else {
+		b.results[b.next] = failed
+		b.next = (b.next + 1) % c.config.window
+	}
+	if c.tripped(b) {
+		c.setState(backend, b, circuitOpen, now)
+	}
+}
+
+// tripped indicates if the failures of the backend reached a threshold.
+func (c *circuitBreakers) tripped(b *circuitBreaker) bool {
+	if c.config.consecutiveFailures > 0 && b.consecutiveFailures >= c.config.consecutiveFailures {
+		return true
+	}
+	if c.config.errorRate == 0 || len(b.results) < c.config.window {
+		return false
+	}
+	failures := 0
+	for _, failed := range b.results {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures)/float64(len(b.results)) >= c.config.errorRate
+}
+
+// state returns the circuit state of the backend, or an empty string if circuit breakers are
+// disabled.
+func (c *circuitBreakers) state(backend string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.backends[backend]; ok {
+		return b.state.String()
+	}
+	return circuitClosed.String()
+}
+
+// queue indicates if the deliveries to backends whose circuit is open are kept in the outbox.
+func (c *circuitBreakers) queue() bool {
+	return c != nil && c.config.openAction == CircuitOpenActionQueue
+}
+
+// prune drops the circuit breakers of the backends which are not registered anymore.
+func (c *circuitBreakers) prune(snapshot *backendSnapshot) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for backend := range c.backends {
+		if _, ok := snapshot.get(backend); !ok {
+			delete(c.backends, backend)
+			metrics.DeleteCircuitState(backend)
+		}
+	}
+}
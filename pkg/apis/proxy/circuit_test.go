@@ -0,0 +1,164 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+var (
+	failedResult  = forwardResult{status: http.StatusServiceUnavailable}
+	successResult = forwardResult{status: http.StatusOK}
+)
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	breakers := newCircuitBreakers(circuitBreakerConfig{consecutiveFailures: 3, window: 10, openDuration: time.Minute}, zap.NewNop())
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		breakers.allow("http://a", now)
+		breakers.record("http://a", failedResult, now)
+	}
+	// a success resets the consecutive failures, client errors are not failures
+	breakers.record("http://a", successResult, now)
+	breakers.record("http://a", forwardResult{status: http.StatusNotFound}, now)
+	for i := 0; i < 2; i++ {
+		breakers.record("http://a", failedResult, now)
+	}
+	if state := breakers.state("http://a"); state != "closed" {
+		t.Fatalf("expected closed circuit, got %s", state)
+	}
+	breakers.record("http://a", forwardResult{err: errors.New("connection refused")}, now)
+	if state := breakers.state("http://a"); state != "open" {
+		t.Fatalf("expected open circuit, got %s", state)
+	}
+	if breakers.allow("http://a", now.Add(time.Second)) {
+		t.Errorf("expected requests to be rejected while the circuit is open")
+	}
+	if !breakers.allow("http://b", now) {
+		t.Errorf("expected other backends not to be affected")
+	}
+
+	// a single probe is allowed once the open duration has elapsed
+	now = now.Add(time.Minute)
+	if !breakers.allow("http://a", now) || breakers.state("http://a") != "half-open" {
+		t.Fatalf("expected probe request in half-open state, got %s", breakers.state("http://a"))
+	}
+	if breakers.allow("http://a", now) {
+		t.Errorf("expected a single probe request")
+	}
+	breakers.record("http://a", failedResult, now)
+	if state := breakers.state("http://a"); state != "open" {
+		t.Fatalf("expected failed probe to open the circuit again, got %s", state)
+	}
+	now = now.Add(time.Minute)
+	breakers.allow("http://a", now)
+	breakers.record("http://a", successResult, now)
+	if state := breakers.state("http://a"); state != "closed" {
+		t.Fatalf("expected successful probe to close the circuit, got %s", state)
+	}
+
+	breakers.prune(newBackendSnapshot(1, map[string]*v1alpha1.Backend{"http://b": {URL: "http://b"}}))
+	if _, ok := breakers.backends["http://a"]; ok {
+		t.Errorf("expected circuit breaker of unregistered backend to be dropped")
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	breakers := newCircuitBreakers(circuitBreakerConfig{errorRate: 0.5, window: 4, openDuration: time.Minute}, zap.NewNop())
+	now := time.Now()
+	for _, result := range []forwardResult{failedResult, successResult, failedResult} {
+		breakers.record("http://a", result, now)
+	}
+	if state := breakers.state("http://a"); state != "closed" {
+		t.Fatalf("expected closed circuit until the window is full, got %s", state)
+	}
+	breakers.record("http://a", successResult, now)
+	if state := breakers.state("http://a"); state != "open" {
+		t.Fatalf("expected open circuit at 50%% error rate, got %s", state)
+	}
+}
+
+func TestCircuitBreakerForward(t *testing.T) {
+	calls := int32(0)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_CIRCUIT_BREAKER_CONSECUTIVE_FAILURES", "2")
+	t.Setenv("SPRAYPROXY_RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("SPRAYPROXY_RETRY_INITIAL_BACKOFF", "1ms")
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{backend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	// backend error responses are proxied, skipped deliveries are not
+	for _, expected := range []int{http.StatusOK, http.StatusBadGateway} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = newProxyRequest()
+		proxy.HandleProxy(ctx)
+		if w.Code != expected {
+			t.Errorf("expected status code %d, got %d", expected, w.Code)
+		}
+	}
+	// the circuit opened after the second attempt of the first request, so retries stopped
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 requests to the backend, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/backends", nil)
+	proxy.GetBackends(ctx)
+	list := v1alpha1.BackendList{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Items) != 1 {
+		t.Fatalf("expected a single backend, got %q", w.Body.String())
+	}
+	if list.Items[0].CircuitState != "open" {
+		t.Errorf("expected open circuit in the backends API, got %q", list.Items[0].CircuitState)
+	}
+	// skipped deliveries are not counted in the backend statistics
+	if failures := list.Items[0].Stats.ConsecutiveFailures; failures != 1 {
+		t.Errorf("expected 1 consecutive failure, got %d", failures)
+	}
+}
+
+func TestCircuitBreakersFromEnv(t *testing.T) {
+	if breakers, err := circuitBreakersFromEnv(zap.NewNop()); err != nil || breakers != nil {
+		t.Errorf("expected circuit breakers to be disabled by default, got %v, %v", breakers, err)
+	}
+	for env, value := range map[string]string{
+		"SPRAYPROXY_CIRCUIT_BREAKER_CONSECUTIVE_FAILURES": "-1",
+		"SPRAYPROXY_CIRCUIT_BREAKER_ERROR_RATE":           "1.5",
+		"SPRAYPROXY_CIRCUIT_BREAKER_WINDOW":               "0",
+		"SPRAYPROXY_CIRCUIT_BREAKER_OPEN_DURATION":        "0s",
+		"SPRAYPROXY_CIRCUIT_BREAKER_OPEN_ACTION":          "drop",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := circuitBreakersFromEnv(zap.NewNop()); err == nil {
+				t.Errorf("expected error for %s=%s", env, value)
+			}
+		})
+	}
+
+	t.Setenv("SPRAYPROXY_CIRCUIT_BREAKER_ERROR_RATE", "0.5")
+	t.Setenv("SPRAYPROXY_CIRCUIT_BREAKER_OPEN_ACTION", CircuitOpenActionQueue)
+	if _, err := NewSprayProxy(false, true, false, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error for queue action without outbox")
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DeadLetter is a request which could not be forwarded to a backend.
+type DeadLetter struct {
+	ID        string      `json:"id"`
+	RequestID string      `json:"requestId"`
+	Backend   string      `json:"backend"`
+	Event     string      `json:"event,omitempty"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header,omitempty"`
+	Body      []byte      `json:"body,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	Error     string      `json:"error"`
+	FailedAt  time.Time   `json:"failedAt"`
+	// Redeliveries counts the failed redelivery attempts
+	Redeliveries int `json:"redeliveries"`
+}
+
+// summary returns the dead letter without the request header and body.
+func (d *DeadLetter) summary() *DeadLetter {
+	s := *d
+	s.Header = nil
+	s.Body = nil
+	return &s
+}
+
+// deadLetterFilter selects dead letters. Empty fields match all dead letters.
+type deadLetterFilter struct {
+	Backend string
+	Event   string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f deadLetterFilter) matches(d *DeadLetter) bool {
+	if f.Backend != "" && f.Backend != d.Backend {
+		return false
+	}
+	if f.Event != "" && f.Event != d.Event {
+		return false
+	}
+	if !f.Since.IsZero() && d.FailedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && d.FailedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// deadLetterStore keeps the most recent dead letters in memory, up to maxEntries.
+// When full, the oldest dead letter is dropped.
+type deadLetterStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	// entries are ordered by insertion, oldest first
+	entries []*DeadLetter
+}
+
+func newDeadLetterStore(maxEntries int) *deadLetterStore {
+	return &deadLetterStore{maxEntries: maxEntries}
+}
+
+// add stores the dead letter, and returns the dead letter which was evicted to make room, if any.
+func (s *deadLetterStore) add(d *DeadLetter) *DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var evicted *DeadLetter
+	if len(s.entries) >= s.maxEntries {
+		evicted = s.entries[0]
+		s.entries = s.entries[1:]
+	}
+	s.entries = append(s.entries, d)
+	return evicted
+}
+
+// get returns a copy of the dead letter with the given ID, or nil if not found.
+func (s *deadLetterStore) get(id string) *DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.entries {
+		if d.ID == id {
+			found := *d
+			return &found
+		}
+	}
+	return nil
+}
+
+// list returns copies of the dead letters matching the filter.
+func (s *deadLetterStore) list(filter deadLetterFilter) []*DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []*DeadLetter{}
+	for _, d := range s.entries {
+		if filter.matches(d) {
+			matched := *d
+			list = append(list, &matched)
+		}
+	}
+	return list
+}
+
+// remove deletes the dead letters matching the filter and returns how many were deleted.
+func (s *deadLetterStore) remove(filter deadLetterFilter) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []*DeadLetter{}
+	for _, d := range s.entries {
+		if !filter.matches(d) {
+			kept = append(kept, d)
+		}
+	}
+	removed := len(s.entries) - len(kept)
+	s.entries = kept
+	return removed
+}
+
+func (s *deadLetterStore) removeID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, d := range s.entries {
+		if d.ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// updateFailure records a failed redelivery of the dead letter with the given ID.
+func (s *deadLetterStore) updateFailure(id string, result forwardResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.entries {
+		if d.ID == id {
+			d.Status = result.status
+			d.Error = result.errorMessage()
+			d.FailedAt = time.Now()
+			d.Redeliveries++
+			return
+		}
+	}
+}
+
+// DeadLetterEnabled indicates if failed deliveries are kept for redelivery.
+func (p *SprayProxy) DeadLetterEnabled() bool {
+	return p.deadLetters != nil
+}
+
+// deadLetter stores the failed forward of the request to a backend, if the dead letter store is enabled.
+func (p *SprayProxy) deadLetter(requestID string, req *http.Request, body []byte, result forwardResult) {
+	if p.deadLetters == nil {
+		return
+	}
+	// the tokens are the webhook secrets, they are set again when signing a redelivery
+	header := req.Header.Clone()
+	p.stripTokens(header)
+	d := &DeadLetter{
+		ID:        uuid.New().String(),
+		RequestID: requestID,
+		Backend:   result.backend,
+		Event:     req.Header.Get("X-GitHub-Event"),
+		Method:    req.Method,
+		URL:       req.URL.RequestURI(),
+		Header:    header,
+		Body:      body,
+		Status:    result.status,
+		Error:     result.errorMessage(),
+		FailedAt:  time.Now(),
+	}
+	zapFields := []zapcore.Field{
+		zap.String("request-id", requestID),
+		zap.String("backend", d.Backend),
+		zap.String("dead-letter-id", d.ID),
+	}
+	p.logger.Info("stored failed delivery as dead letter", zapFields...)
+	if evicted := p.deadLetters.add(d); evicted != nil {
+		p.logger.Warn("dead letter store full, dropped oldest dead letter", append(zapFields,
+			zap.String("evicted-dead-letter-id", evicted.ID),
+			zap.String("evicted-backend", evicted.Backend))...)
+	}
+}
+
+// redeliver forwards the dead letter to its backend again. On success, the dead letter is
+// removed from the store.
+func (p *SprayProxy) redeliver(client *http.Client, d *DeadLetter) forwardResult {
+	req, err := http.NewRequest(d.Method, d.URL, nil)
+	if err != nil {
+		return forwardResult{backend: d.Backend, err: err}
+	}
+	req.Header = d.Header
+	zapCommonFields := []zapcore.Field{
+		zap.String("method", d.Method),
+		zap.String("path", req.URL.Path),
+		zap.String("query", req.URL.RawQuery),
+		zap.String("request-id", d.RequestID),
+		zap.String("dead-letter-id", d.ID),
+	}
+	result := p.forward(client, req, d.Backend, d.Body, zapCommonFields)
+	if result.failed() {
+		p.deadLetters.updateFailure(d.ID, result)
+		return result
+	}
+	p.deadLetters.removeID(d.ID)
+	return result
+}
+
+// deadLetterFilterFromQuery reads the dead letter filter from the backend, event, since and
+// until query parameters. Times are in RFC3339 format.
+func deadLetterFilterFromQuery(c *gin.Context) (deadLetterFilter, error) {
+	filter := deadLetterFilter{
+		Backend: c.Query("backend"),
+		Event:   c.Query("event"),
+	}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s parameter %q", param, v)
+			}
+			*t = parsed
+		}
+	}
+	return filter, nil
+}
+
+// redeliveryResult is the outcome of a redelivery returned by the admin API.
+type redeliveryResult struct {
+	ID      string `json:"id"`
+	Backend string `json:"backend"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newRedeliveryResult(d *DeadLetter, result forwardResult) redeliveryResult {
+	r := redeliveryResult{ID: d.ID, Backend: d.Backend, Status: result.status}
+	if result.failed() {
+		r.Error = result.errorMessage()
+	}
+	return r
+}
+
+// ListDeadLetters lists the dead letters matching the query filter, without request headers and body.
+func (p *SprayProxy) ListDeadLetters(c *gin.Context) {
+	filter, err := deadLetterFilterFromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	list := []*DeadLetter{}
+	for _, d := range p.deadLetters.list(filter) {
+		list = append(list, d.summary())
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// GetDeadLetter gives a single dead letter, including the request headers and body.
+func (p *SprayProxy) GetDeadLetter(c *gin.Context) {
+	d := p.deadLetters.get(c.Param("id"))
+	if d == nil {
+		c.String(http.StatusNotFound, "dead letter not found")
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// RedeliverDeadLetter forwards a single dead letter to its backend again.
+func (p *SprayProxy) RedeliverDeadLetter(c *gin.Context) {
+	d := p.deadLetters.get(c.Param("id"))
+	if d == nil {
+		c.String(http.StatusNotFound, "dead letter not found")
+		return
+	}
+	result := p.redeliver(p.client, d)
+	p.logger.Info("redelivered dead letter", zap.String("dead-letter-id", d.ID), zap.String("backend", d.Backend),
+		zap.Bool("success", !result.failed()))
+	status := http.StatusOK
+	if result.failed() {
+		status = http.StatusBadGateway
+	}
+	c.JSON(status, newRedeliveryResult(d, result))
+}
+
+// RedeliverDeadLetters forwards all dead letters matching the query filter to their backends again.
+func (p *SprayProxy) RedeliverDeadLetters(c *gin.Context) {
+	filter, err := deadLetterFilterFromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	client := p.client
+	results := []redeliveryResult{}
+	failed := 0
+	for _, d := range p.deadLetters.list(filter) {
+		result := p.redeliver(client, d)
+		if result.failed() {
+			failed++
+		}
+		results = append(results, newRedeliveryResult(d, result))
+	}
+	p.logger.Info("redelivered dead letters", zap.Int("dead-letters", len(results)), zap.Int("failed", failed))
+	c.JSON(http.StatusOK, results)
+}
+
+// PurgeDeadLetters deletes all dead letters matching the query filter.
+func (p *SprayProxy) PurgeDeadLetters(c *gin.Context) {
+	filter, err := deadLetterFilterFromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	removed := p.deadLetters.remove(filter)
+	p.logger.Info("purged dead letters", zap.Int("dead-letters", removed))
+	c.String(http.StatusOK, fmt.Sprintf("purged %d dead letters", removed))
+}
@@ -0,0 +1,222 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestDeadLetterStoreBounded(t *testing.T) {
+	store := newDeadLetterStore(2)
+	for i := 0; i < 3; i++ {
+		evicted := store.add(&DeadLetter{ID: fmt.Sprintf("dl-%d", i)})
+		if i < 2 && evicted != nil {
+			t.Errorf("unexpected eviction of %q", evicted.ID)
+		}
+		if i == 2 && (evicted == nil || evicted.ID != "dl-0") {
+			t.Errorf("expected oldest dead letter to be evicted, got %v", evicted)
+		}
+	}
+	if store.get("dl-0") != nil {
+		t.Errorf("expected evicted dead letter to be gone")
+	}
+	if len(store.list(deadLetterFilter{})) != 2 {
+		t.Errorf("expected %d dead letters, got %d", 2, len(store.list(deadLetterFilter{})))
+	}
+}
+
+func TestDeadLetterFilter(t *testing.T) {
+	now := time.Now()
+	store := newDeadLetterStore(10)
+	store.add(&DeadLetter{ID: "a", Backend: "http://a", Event: "push", FailedAt: now.Add(-time.Hour)})
+	store.add(&DeadLetter{ID: "b", Backend: "http://b", Event: "push", FailedAt: now})
+	store.add(&DeadLetter{ID: "c", Backend: "http://a", Event: "pull_request", FailedAt: now})
+	for _, test := range []struct {
+		name     string
+		filter   deadLetterFilter
+		expected int
+	}{
+		{name: "all", filter: deadLetterFilter{}, expected: 3},
+		{name: "backend", filter: deadLetterFilter{Backend: "http://a"}, expected: 2},
+		{name: "event", filter: deadLetterFilter{Event: "push"}, expected: 2},
+		{name: "backend and event", filter: deadLetterFilter{Backend: "http://a", Event: "push"}, expected: 1},
+		{name: "since", filter: deadLetterFilter{Since: now.Add(-time.Minute)}, expected: 2},
+		{name: "until", filter: deadLetterFilter{Until: now.Add(-time.Minute)}, expected: 1},
+	} {
+		if got := len(store.list(test.filter)); got != test.expected {
+			t.Errorf("%s: expected %d dead letters, got %d", test.name, test.expected, got)
+		}
+	}
+	if removed := store.remove(deadLetterFilter{Backend: "http://a"}); removed != 2 {
+		t.Errorf("expected %d dead letters to be purged, got %d", 2, removed)
+	}
+	if store.get("b") == nil {
+		t.Errorf("expected dead letter %q to be kept", "b")
+	}
+}
+
+func TestDeadLetterRedelivery(t *testing.T) {
+	t.Setenv("SPRAYPROXY_DEAD_LETTER_MAX_ENTRIES", "10")
+	var available int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&available) == 0 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{backend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if !proxy.DeadLetterEnabled() {
+		t.Fatalf("expected dead letter store to be enabled")
+	}
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	ctx.Request.Header.Set("X-GitHub-Event", "push")
+	proxy.HandleProxy(ctx)
+
+	t.Run("list dead letters", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/deadletters?event=push", nil)
+		proxy.ListDeadLetters(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		list := []DeadLetter{}
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		if len(list) != 1 {
+			t.Fatalf("expected %d dead letter, got %d", 1, len(list))
+		}
+		if list[0].Backend != backend.URL || list[0].Status != http.StatusInternalServerError || list[0].Body != nil {
+			t.Errorf("unexpected dead letter summary %+v", list[0])
+		}
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/deadletters?since=yesterday", nil)
+		proxy.ListDeadLetters(ctx)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	id := proxy.deadLetters.list(deadLetterFilter{})[0].ID
+
+	t.Run("get dead letter", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Params = gin.Params{{Key: "id", Value: id}}
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/deadletters/"+id, nil)
+		proxy.GetDeadLetter(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		d := DeadLetter{}
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		if string(d.Body) != newProxyRequestBody() {
+			t.Errorf("expected body %q, got %q", newProxyRequestBody(), string(d.Body))
+		}
+	})
+
+	t.Run("failed redelivery", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Params = gin.Params{{Key: "id", Value: id}}
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/deadletters/"+id+"/redeliver", nil)
+		proxy.RedeliverDeadLetter(ctx)
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("expected status code %d, got %d", http.StatusBadGateway, w.Code)
+		}
+		if d := proxy.deadLetters.get(id); d == nil || d.Redeliveries != 1 {
+			t.Errorf("expected dead letter to be kept with 1 redelivery, got %+v", d)
+		}
+	})
+
+	t.Run("successful redelivery", func(t *testing.T) {
+		atomic.StoreInt32(&available, 1)
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/deadletters/redeliver?backend="+backend.URL, nil)
+		proxy.RedeliverDeadLetters(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		if proxy.deadLetters.get(id) != nil {
+			t.Errorf("expected redelivered dead letter to be removed")
+		}
+	})
+
+	t.Run("purge dead letters", func(t *testing.T) {
+		proxy.deadLetters.add(&DeadLetter{ID: "other"})
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodDelete, "/deadletters", nil)
+		proxy.PurgeDeadLetters(ctx)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		if w.Body.String() != "purged 1 dead letters" {
+			t.Errorf("expected response %q, got %q", "purged 1 dead letters", w.Body.String())
+		}
+	})
+}
+
+func TestDeadLetterWithoutToken(t *testing.T) {
+	t.Setenv("SPRAYPROXY_DEAD_LETTER_MAX_ENTRIES", "10")
+	t.Setenv("SPRAYPROXY_WEBHOOK_PROVIDERS", "gitlab")
+	t.Setenv(envWebhookSecrets, "[{name: gitlab, secret: gitlab-token, providers: [gitlab]}]")
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, false, false, zap.NewNop(), map[string]string{backend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newWebhookRequest(map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "gitlab-token"})
+	proxy.HandleProxy(ctx)
+	list := proxy.deadLetters.list(deadLetterFilter{})
+	if len(list) != 1 {
+		t.Fatalf("expected %d dead letter, got %d", 1, len(list))
+	}
+
+	w = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(w)
+	ctx.Params = gin.Params{{Key: "id", Value: list[0].ID}}
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/deadletters/"+list[0].ID, nil)
+	proxy.GetDeadLetter(ctx)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if strings.Contains(w.Body.String(), "gitlab-token") {
+		t.Errorf("expected dead letter without the webhook token, got %s", w.Body.String())
+	}
+}
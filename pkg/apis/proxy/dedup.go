@@ -0,0 +1,200 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DedupPolicyDrop does not forward duplicate deliveries
+	DedupPolicyDrop = "drop"
+	// DedupPolicyForward forwards duplicate deliveries to all backends, only counting them
+	DedupPolicyForward = "forward"
+	// DedupPolicyFailedOnly forwards duplicate deliveries to the backends which failed the previous time
+	DedupPolicyFailedOnly = "failed-only"
+
+	// GitHub header uniquely identifying a webhook delivery, kept on redeliveries
+	deliveryHeader = "X-GitHub-Delivery"
+)
+
+type dedupEntry struct {
+	id      string
+	expires time.Time
+	// failed holds the backends which did not accept the last forward of the delivery
+	failed map[string]bool
+	// pending holds the backends the delivery is being forwarded to, whose outcome is not known yet
+	pending map[string]bool
+	// recorded indicates the delivery was accepted by the proxy at least once
+	recorded bool
+}
+
+// dedupCache remembers recently seen delivery IDs, up to maxEntries and for the ttl duration.
+// When full, the least recently seen delivery is forgotten.
+type dedupCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	policy     string
+	// entries are ordered by last use, most recent first
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+func newDedupCache(ttl time.Duration, maxEntries int, policy string) *dedupCache {
+	return &dedupCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		policy:     policy,
+		entries:    list.New(),
+		index:      map[string]*list.Element{},
+	}
+}
+
+// dedupCacheFromEnv creates the dedup cache configured by the SPRAYPROXY_DEDUP_* env vars.
+// Returns nil if deduplication is disabled.
+func dedupCacheFromEnv() (*dedupCache, error) {
+	v := os.Getenv("SPRAYPROXY_DEDUP_WINDOW")
+	if v == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("invalid SPRAYPROXY_DEDUP_WINDOW %q", v)
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+	maxEntries := 10000
+	if v := os.Getenv("SPRAYPROXY_DEDUP_MAX_ENTRIES"); v != "" {
+		maxEntries, err = strconv.Atoi(v)
+		if err != nil || maxEntries < 1 {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_DEDUP_MAX_ENTRIES %q", v)
+		}
+	}
+	policy := DedupPolicyDrop
+	if v := os.Getenv("SPRAYPROXY_DEDUP_POLICY"); v != "" {
+		switch v {
+		case DedupPolicyDrop, DedupPolicyForward, DedupPolicyFailedOnly:
+			policy = v
+		default:
+			return nil, fmt.Errorf("invalid SPRAYPROXY_DEDUP_POLICY %q", v)
+		}
+	}
+	return newDedupCache(ttl, maxEntries, policy), nil
+}
+
+// check records the delivery ID, along with the backends it is forwarded to. If the delivery
+// was already seen within the ttl, it returns true along with the backends the duplicate should
+// be forwarded to according to the policy. Unless the policy forwards all duplicates, a duplicate
+// of a delivery still in flight is reported as such, since its outcome is not known yet. The
+// backends stay in flight until record, accept or release is called.
+func (d *dedupCache) check(id string, backends []string, now time.Time) (duplicate bool, forward []string, inFlight bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if elem, ok := d.index[id]; ok {
+		entry := elem.Value.(*dedupEntry)
+		if now.Before(entry.expires) {
+			d.entries.MoveToFront(elem)
+			switch {
+			case d.policy == DedupPolicyForward:
+				forward = backends
+			case len(entry.pending) > 0:
+				return true, nil, true
+			case d.policy == DedupPolicyFailedOnly:
+				forward = []string{}
+				for backend := range entry.failed {
+					forward = append(forward, backend)
+				}
+			default:
+				forward = []string{}
+			}
+			for _, backend := range forward {
+				entry.pending[backend] = true
+			}
+			return true, forward, false
+		}
+		d.entries.Remove(elem)
+		delete(d.index, id)
+	}
+	if d.entries.Len() >= d.maxEntries {
+		oldest := d.entries.Back()
+		d.entries.Remove(oldest)
+		delete(d.index, oldest.Value.(*dedupEntry).id)
+	}
+	entry := &dedupEntry{
+		id:      id,
+		expires: now.Add(d.ttl),
+		failed:  map[string]bool{},
+		pending: map[string]bool{},
+	}
+	for _, backend := range backends {
+		entry.pending[backend] = true
+	}
+	d.index[id] = d.entries.PushFront(entry)
+	return false, backends, false
+}
+
+// record updates the backends which failed to accept the delivery.
+func (d *dedupCache) record(id string, results []forwardResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, ok := d.index[id]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*dedupEntry)
+	entry.recorded = true
+	for _, result := range results {
+		delete(entry.pending, result.backend)
+		if result.failed() {
+			entry.failed[result.backend] = true
+		} else {
+			delete(entry.failed, result.backend)
+		}
+	}
+}
+
+// accept records that the delivery was queued for the backends, which take care of the delivery
+// from then on. Final failures are recorded once known.
+func (d *dedupCache) accept(id string, backends []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, ok := d.index[id]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*dedupEntry)
+	entry.recorded = true
+	for _, backend := range backends {
+		delete(entry.pending, backend)
+		delete(entry.failed, backend)
+	}
+}
+
+// release records that the delivery could not be accepted for the backends, so it is not
+// considered a duplicate when sent again. The delivery is forgotten if it was never accepted.
+func (d *dedupCache) release(id string, backends []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, ok := d.index[id]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*dedupEntry)
+	for _, backend := range backends {
+		delete(entry.pending, backend)
+	}
+	if !entry.recorded && len(entry.pending) == 0 {
+		d.entries.Remove(elem)
+		delete(d.index, id)
+	}
+}
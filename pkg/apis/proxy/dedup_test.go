@@ -0,0 +1,184 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestDedupCacheTTL(t *testing.T) {
+	cache := newDedupCache(time.Minute, 10, DedupPolicyDrop)
+	now := time.Now()
+	if seen, _, _ := cache.check("foo", nil, now); seen {
+		t.Errorf("expected first delivery not to be a duplicate")
+	}
+	if seen, _, _ := cache.check("foo", nil, now.Add(30*time.Second)); !seen {
+		t.Errorf("expected delivery within the window to be a duplicate")
+	}
+	if seen, _, _ := cache.check("foo", nil, now.Add(2*time.Minute)); seen {
+		t.Errorf("expected delivery after the window not to be a duplicate")
+	}
+}
+
+func TestDedupCacheEviction(t *testing.T) {
+	cache := newDedupCache(time.Minute, 2, DedupPolicyDrop)
+	now := time.Now()
+	cache.check("a", nil, now)
+	cache.check("b", nil, now)
+	// "a" becomes the most recently seen, so "b" is evicted by "c"
+	cache.check("a", nil, now)
+	cache.check("c", nil, now)
+	if seen, _, _ := cache.check("a", nil, now); !seen {
+		t.Errorf("expected %q to be kept", "a")
+	}
+	if seen, _, _ := cache.check("b", nil, now); seen {
+		t.Errorf("expected %q to be evicted", "b")
+	}
+}
+
+func TestDedupCacheRecord(t *testing.T) {
+	cache := newDedupCache(time.Minute, 10, DedupPolicyFailedOnly)
+	now := time.Now()
+	backends := []string{"http://a", "http://b"}
+	cache.check("foo", backends, now)
+	if seen, _, inFlight := cache.check("foo", backends, now); !seen || !inFlight {
+		t.Errorf("expected a duplicate in flight, got %t, %t", seen, inFlight)
+	}
+	cache.record("foo", []forwardResult{
+		{backend: "http://a", status: http.StatusOK},
+		{backend: "http://b", err: errors.New("connection refused")},
+	})
+	_, failed, _ := cache.check("foo", backends, now)
+	if len(failed) != 1 || failed[0] != "http://b" {
+		t.Errorf("expected failed backends %v, got %v", []string{"http://b"}, failed)
+	}
+	cache.record("foo", []forwardResult{{backend: "http://b", status: http.StatusOK}})
+	if _, failed, _ := cache.check("foo", backends, now); len(failed) != 0 {
+		t.Errorf("expected no failed backends, got %v", failed)
+	}
+}
+
+func TestDedupCacheRelease(t *testing.T) {
+	cache := newDedupCache(time.Minute, 10, DedupPolicyFailedOnly)
+	now := time.Now()
+	backends := []string{"http://a", "http://b"}
+
+	// a delivery which was never accepted is forgotten
+	cache.check("foo", backends, now)
+	cache.release("foo", backends)
+	if seen, forward, _ := cache.check("foo", backends, now); seen || len(forward) != 2 {
+		t.Errorf("expected the released delivery not to be a duplicate, got %t, %v", seen, forward)
+	}
+
+	// a duplicate which could not be accepted keeps the failed backends
+	cache.record("foo", []forwardResult{
+		{backend: "http://a", status: http.StatusOK},
+		{backend: "http://b", status: http.StatusBadGateway},
+	})
+	_, forward, _ := cache.check("foo", backends, now)
+	cache.release("foo", forward)
+	if seen, forward, inFlight := cache.check("foo", backends, now); !seen || inFlight || len(forward) != 1 || forward[0] != "http://b" {
+		t.Errorf("expected the duplicate to be forwarded to %v, got %t, %v, %t", []string{"http://b"}, seen, forward, inFlight)
+	}
+
+	// queued deliveries are no longer in flight, nor failed
+	cache.accept("foo", []string{"http://b"})
+	if seen, forward, inFlight := cache.check("foo", backends, now); !seen || inFlight || len(forward) != 0 {
+		t.Errorf("expected the accepted delivery not to be forwarded again, got %t, %v, %t", seen, forward, inFlight)
+	}
+}
+
+func TestDedupCacheForwardPolicy(t *testing.T) {
+	cache := newDedupCache(time.Minute, 10, DedupPolicyForward)
+	now := time.Now()
+	backends := []string{"http://a"}
+	cache.check("foo", backends, now)
+	if seen, forward, inFlight := cache.check("foo", backends, now); !seen || inFlight || len(forward) != 1 {
+		t.Errorf("expected the duplicate in flight to be forwarded, got %t, %v, %t", seen, forward, inFlight)
+	}
+}
+
+func TestDedupCacheFromEnv(t *testing.T) {
+	if cache, err := dedupCacheFromEnv(); cache != nil || err != nil {
+		t.Errorf("expected deduplication to be disabled by default, got %v, %v", cache, err)
+	}
+	t.Setenv("SPRAYPROXY_DEDUP_WINDOW", "1h")
+	cache, err := dedupCacheFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cache.ttl != time.Hour || cache.maxEntries != 10000 || cache.policy != DedupPolicyDrop {
+		t.Errorf("unexpected dedup settings: %s window, %d max entries, %s policy", cache.ttl, cache.maxEntries, cache.policy)
+	}
+	t.Setenv("SPRAYPROXY_DEDUP_POLICY", "foo")
+	if _, err := dedupCacheFromEnv(); err == nil {
+		t.Errorf("expected error for invalid policy")
+	}
+}
+
+func TestHandleProxyDedup(t *testing.T) {
+	var okCalls, flakyCalls int32
+	okBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&okCalls, 1)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer okBackend.Close()
+	// fail the first delivery only
+	flakyBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&flakyCalls, 1) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer flakyBackend.Close()
+	testBackend := map[string]string{okBackend.URL: "", flakyBackend.URL: ""}
+
+	for _, test := range []struct {
+		policy        string
+		expectedOK    int32
+		expectedFlaky int32
+	}{
+		{policy: DedupPolicyDrop, expectedOK: 1, expectedFlaky: 1},
+		{policy: DedupPolicyForward, expectedOK: 2, expectedFlaky: 2},
+		{policy: DedupPolicyFailedOnly, expectedOK: 1, expectedFlaky: 2},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			atomic.StoreInt32(&okCalls, 0)
+			atomic.StoreInt32(&flakyCalls, 0)
+			t.Setenv("SPRAYPROXY_DEDUP_WINDOW", "1m")
+			t.Setenv("SPRAYPROXY_DEDUP_POLICY", test.policy)
+			proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), testBackend)
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				ctx, _ := gin.CreateTestContext(w)
+				ctx.Request = newProxyRequest()
+				ctx.Request.Header.Set(deliveryHeader, "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+				proxy.HandleProxy(ctx)
+				if w.Code != http.StatusOK {
+					t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+				}
+			}
+			if okCalls != test.expectedOK {
+				t.Errorf("expected %d deliveries to the healthy backend, got %d", test.expectedOK, okCalls)
+			}
+			if flakyCalls != test.expectedFlaky {
+				t.Errorf("expected %d deliveries to the flaky backend, got %d", test.expectedFlaky, flakyCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	healthUnknown   = "unknown"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// errBackendUnhealthy is the error of the deliveries held back because the backend is unhealthy.
+var errBackendUnhealthy = errors.New("backend unhealthy")
+
+// healthCheckConfig holds the settings of the backend health checks.
+type healthCheckConfig struct {
+	interval time.Duration
+	timeout  time.Duration
+	// path of the health check request, the backend URL is used if empty
+	path string
+	// statusCodes of a healthy backend, any code below 400 if empty, as well as 405 when probing
+	// the backend URL
+	statusCodes []int
+	// rise and fall are the numbers of consecutive checks needed to become healthy and unhealthy
+	rise int
+	fall int
+	// hold prevents forwarding to unhealthy backends
+	hold bool
+}
+
+// backendHealth tracks the health checks of a single backend.
+type backendHealth struct {
+	state     string
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+// healthChecker probes the backends periodically and marks them healthy or unhealthy.
+// Nil health checkers consider all backends healthy.
+type healthChecker struct {
+	config   healthCheckConfig
+	logger   *zap.Logger
+	mu       sync.Mutex
+	backends map[string]*backendHealth
+}
+
+func newHealthChecker(config healthCheckConfig, logger *zap.Logger) *healthChecker {
+	return &healthChecker{config: config, logger: logger, backends: map[string]*backendHealth{}}
+}
+
+// healthCheckerFromEnv returns the health checker configured by SPRAYPROXY_HEALTH_CHECK_* env
+// vars, or nil if no interval is set.
+func healthCheckerFromEnv(logger *zap.Logger) (*healthChecker, error) {
+	v := os.Getenv("SPRAYPROXY_HEALTH_CHECK_INTERVAL")
+	if v == "" {
+		return nil, nil
+	}
+	config := healthCheckConfig{timeout: 5 * time.Second, rise: 2, fall: 3}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid SPRAYPROXY_HEALTH_CHECK_INTERVAL %q", v)
+	}
+	config.interval = interval
+	if v := os.Getenv("SPRAYPROXY_HEALTH_CHECK_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_HEALTH_CHECK_TIMEOUT %q", v)
+		}
+		config.timeout = timeout
+	}
+	if v := os.Getenv("SPRAYPROXY_HEALTH_CHECK_PATH"); v != "" {
+		if !strings.HasPrefix(v, "/") {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_HEALTH_CHECK_PATH %q, expected an absolute path", v)
+		}
+		config.path = v
+	}
+	if v := os.Getenv("SPRAYPROXY_HEALTH_CHECK_STATUS_CODES"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid SPRAYPROXY_HEALTH_CHECK_STATUS_CODES %q", v)
+			}
+			config.statusCodes = append(config.statusCodes, code)
+		}
+	}
+	for env, count := range map[string]*int{"SPRAYPROXY_HEALTH_CHECK_RISE": &config.rise, "SPRAYPROXY_HEALTH_CHECK_FALL": &config.fall} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid %s %q", env, v)
+			}
+			*count = n
+		}
+	}
+	if v := os.Getenv("SPRAYPROXY_HEALTH_CHECK_HOLD"); v != "" {
+		hold, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_HEALTH_CHECK_HOLD %q", v)
+		}
+		config.hold = hold
+	}
+	return newHealthChecker(config, logger), nil
+}
+
+// record updates the health of the backend with the outcome of a check, nil if it succeeded.
+func (h *healthChecker) record(backend string, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.backends[backend]
+	if !ok {
+		b = &backendHealth{state: healthUnknown}
+		h.backends[backend] = b
+	}
+	b.lastCheck = now
+	state := b.state
+	if err == nil {
+		metrics.IncHealthCheckCount(backend, "success")
+		b.lastError = ""
+		b.successes++
+		b.failures = 0
+		if b.successes >= h.config.rise {
+			state = healthHealthy
+		}
+	} else {
+		metrics.IncHealthCheckCount(backend, "failure")
+		b.lastError = err.Error()
+		b.failures++
+		b.successes = 0
+		if b.failures >= h.config.fall {
+			state = healthUnhealthy
+		}
+	}
+	if state == b.state {
+		return
+	}
+	h.logger.Info("backend health changed", zap.String("backend", backend), zap.String("from", b.state),
+		zap.String("to", state), zap.String("error", b.lastError))
+	b.state = state
+	metrics.SetBackendHealthy(backend, state == healthHealthy)
+}
+
+// status returns the health of the backend, or nil if health checks are disabled.
+func (h *healthChecker) status(backend string) *v1alpha1.HealthStatus {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.backends[backend]
+	if !ok {
+		return &v1alpha1.HealthStatus{State: healthUnknown}
+	}
+	lastCheck := b.lastCheck.UTC()
+	return &v1alpha1.HealthStatus{State: b.state, LastCheck: &lastCheck, LastError: b.lastError}
+}
+
+// held indicates if forwarding to the backend is held back because it is unhealthy.
+func (h *healthChecker) held(backend string) bool {
+	if h == nil || !h.config.hold {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.backends[backend]
+	return ok && b.state == healthUnhealthy
+}
+
+// prune drops the health of the backends which are not registered, or not checked, anymore.
+func (h *healthChecker) prune(checked map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for backend := range h.backends {
+		if !checked[backend] {
+			delete(h.backends, backend)
+			metrics.DeleteBackendHealth(backend)
+		}
+	}
+}
+
+// healthCheckPath returns the path probed to check the health of the backend, empty for the
+// backend URL.
+func (h *healthChecker) healthCheckPath(b *v1alpha1.Backend) string {
+	if b.HealthCheck != nil && b.HealthCheck.Path != "" {
+		return b.HealthCheck.Path
+	}
+	return h.config.path
+}
+
+// healthCheckURL returns the URL probed to check the health of the backend.
+func (h *healthChecker) healthCheckURL(b *v1alpha1.Backend) (string, error) {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return "", err
+	}
+	path := h.healthCheckPath(b)
+	if path == "" {
+		return u.String(), nil
+	}
+	probe, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	u.Path, u.RawPath, u.RawQuery = probe.Path, probe.RawPath, probe.RawQuery
+	return u.String(), nil
+}
+
+// expected indicates if the response code of a health check is the one of a healthy backend.
+func (h *healthChecker) expected(b *v1alpha1.Backend, status int) bool {
+	codes := h.config.statusCodes
+	if b.HealthCheck != nil && len(b.HealthCheck.StatusCodes) > 0 {
+		codes = b.HealthCheck.StatusCodes
+	}
+	if len(codes) == 0 {
+		// webhook endpoints usually only accept POST, rejecting the probe shows they are up
+		return status < 400 || (status == http.StatusMethodNotAllowed && h.healthCheckPath(b) == "")
+	}
+	for _, code := range codes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBackend probes the backend, and returns why it is not healthy.
+func (p *SprayProxy) checkBackend(client *http.Client, b *v1alpha1.Backend) error {
+	probeURL, err := p.health.healthCheckURL(b)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, probeURL, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range b.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if !p.health.expected(b, resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkBackends probes the registered backends concurrently, with at most maxConcurrentFwd
+// checks in flight. Paused backends and the ones with disabled health checks are skipped.
+func (p *SprayProxy) checkBackends() {
+	snapshot := p.backends.snapshot()
+	checked := map[string]bool{}
+	sem := make(chan struct{}, p.maxConcurrentFwd)
+	wg := sync.WaitGroup{}
+	for _, url := range snapshot.urls {
+		b, _ := snapshot.get(url)
+		if b.Paused || (b.HealthCheck != nil && b.HealthCheck.Disabled) {
+			continue
+		}
+		checked[url] = true
+		client := *p.backendClient(p.client, url, b)
+		client.Timeout = p.health.config.timeout
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(b *v1alpha1.Backend) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := p.checkBackend(&client, b)
+			p.health.record(b.URL, err, time.Now())
+		}(b)
+	}
+	wg.Wait()
+	p.health.prune(checked)
+}
+
+// runHealthChecks probes the backends periodically until stopCh is closed.
+func (p *SprayProxy) runHealthChecks(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(p.health.config.interval)
+	defer ticker.Stop()
+	for {
+		p.checkBackends()
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+func TestHealthChecker(t *testing.T) {
+	health := newHealthChecker(healthCheckConfig{rise: 2, fall: 3, hold: true}, zap.NewNop())
+	now := time.Now()
+	if status := health.status("http://a"); status.State != healthUnknown {
+		t.Errorf("expected unknown health before the first check, got %s", status.State)
+	}
+	for i, test := range []struct {
+		err      error
+		expected string
+	}{
+		{err: nil, expected: healthUnknown},
+		{err: nil, expected: healthHealthy},
+		{err: errors.New("connection refused"), expected: healthHealthy},
+		{err: errors.New("connection refused"), expected: healthHealthy},
+		{err: errors.New("unexpected status 503"), expected: healthUnhealthy},
+		{err: nil, expected: healthUnhealthy},
+		{err: errors.New("unexpected status 503"), expected: healthUnhealthy},
+		{err: nil, expected: healthUnhealthy},
+		{err: nil, expected: healthHealthy},
+	} {
+		health.record("http://a", test.err, now)
+		status := health.status("http://a")
+		if status.State != test.expected {
+			t.Errorf("check %d: expected %s, got %s", i+1, test.expected, status.State)
+		}
+		if test.err != nil && status.LastError != test.err.Error() {
+			t.Errorf("check %d: expected last error %q, got %q", i+1, test.err, status.LastError)
+		}
+		if held := health.held("http://a"); held != (test.expected == healthUnhealthy) {
+			t.Errorf("check %d: expected held to be %t", i+1, !held)
+		}
+	}
+
+	health.prune(map[string]bool{})
+	if status := health.status("http://a"); status.State != healthUnknown || status.LastCheck != nil {
+		t.Errorf("expected health of unchecked backend to be dropped, got %+v", status)
+	}
+	var disabled *healthChecker
+	if disabled.held("http://a") || disabled.status("http://a") != nil {
+		t.Errorf("expected disabled health checks to consider backends healthy")
+	}
+}
+
+func TestCheckBackends(t *testing.T) {
+	healthy := int32(1)
+	forwarded := int32(0)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodPost:
+			atomic.AddInt32(&forwarded, 1)
+		case req.URL.Path == "/healthz" && atomic.LoadInt32(&healthy) == 1:
+		case req.URL.Path == "/ready":
+			rw.WriteHeader(http.StatusAccepted)
+		case req.URL.Path == "/webhook":
+			// the webhook endpoint only accepts POST
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_HEALTH_CHECK_INTERVAL", "1m")
+	t.Setenv("SPRAYPROXY_HEALTH_CHECK_PATH", "/healthz")
+	t.Setenv("SPRAYPROXY_HEALTH_CHECK_RISE", "1")
+	t.Setenv("SPRAYPROXY_HEALTH_CHECK_FALL", "1")
+	t.Setenv("SPRAYPROXY_HEALTH_CHECK_HOLD", "true")
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.backends = newBackendRegistry(map[string]*v1alpha1.Backend{
+		backend.URL + "/hook": {URL: backend.URL + "/hook"},
+		backend.URL + "/ready": {URL: backend.URL + "/ready",
+			HealthCheck: &v1alpha1.HealthCheck{Path: "/ready", StatusCodes: []int{http.StatusAccepted}}},
+		backend.URL + "/disabled": {URL: backend.URL + "/disabled", HealthCheck: &v1alpha1.HealthCheck{Disabled: true}},
+	})
+	// without health check path, a webhook endpoint rejecting GET is up
+	proxy.health.config.path = ""
+	webhook := &v1alpha1.Backend{URL: backend.URL + "/webhook"}
+	if err := proxy.checkBackend(proxy.client, webhook); err != nil {
+		t.Errorf("expected the webhook endpoint to be healthy, got %v", err)
+	}
+	webhook.HealthCheck = &v1alpha1.HealthCheck{StatusCodes: []int{http.StatusOK}}
+	if err := proxy.checkBackend(proxy.client, webhook); err == nil {
+		t.Errorf("expected the explicit status codes to apply to the webhook endpoint")
+	}
+	proxy.health.config.path = "/healthz"
+	spray := func() {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = newProxyRequest()
+		proxy.HandleProxy(ctx)
+	}
+
+	proxy.checkBackends()
+	for url, expected := range map[string]string{
+		backend.URL + "/hook":     healthHealthy,
+		backend.URL + "/ready":    healthHealthy,
+		backend.URL + "/disabled": healthUnknown,
+	} {
+		if status := proxy.health.status(url); status.State != expected {
+			t.Errorf("%s: expected %s, got %+v", url, expected, status)
+		}
+	}
+	spray()
+	if n := atomic.SwapInt32(&forwarded, 0); n != 3 {
+		t.Errorf("expected request forwarded to 3 backends, got %d", n)
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	proxy.checkBackends()
+	if status := proxy.health.status(backend.URL + "/hook"); status.State != healthUnhealthy || status.LastError != "unexpected status 503" {
+		t.Errorf("expected unhealthy backend, got %+v", status)
+	}
+	spray()
+	if n := atomic.SwapInt32(&forwarded, 0); n != 2 {
+		t.Errorf("expected request held back from the unhealthy backend, got %d forwards", n)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	proxy.checkBackends()
+	spray()
+	if n := atomic.SwapInt32(&forwarded, 0); n != 3 {
+		t.Errorf("expected request forwarded to the recovered backend, got %d forwards", n)
+	}
+}
+
+func TestHealthCheckerFromEnv(t *testing.T) {
+	if health, err := healthCheckerFromEnv(zap.NewNop()); err != nil || health != nil {
+		t.Errorf("expected health checks to be disabled by default, got %v, %v", health, err)
+	}
+	for env, value := range map[string]string{
+		"SPRAYPROXY_HEALTH_CHECK_INTERVAL":     "0s",
+		"SPRAYPROXY_HEALTH_CHECK_TIMEOUT":      "soon",
+		"SPRAYPROXY_HEALTH_CHECK_PATH":         "healthz",
+		"SPRAYPROXY_HEALTH_CHECK_STATUS_CODES": "200,ok",
+		"SPRAYPROXY_HEALTH_CHECK_RISE":         "0",
+		"SPRAYPROXY_HEALTH_CHECK_FALL":         "-1",
+		"SPRAYPROXY_HEALTH_CHECK_HOLD":         "maybe",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_HEALTH_CHECK_INTERVAL", "10s")
+			t.Setenv(env, value)
+			if _, err := healthCheckerFromEnv(zap.NewNop()); err == nil {
+				t.Errorf("expected error for %s=%s", env, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// leaseExpiry returns the expiry time of a lease of the backend TTL starting now, or nil if the
+// backend has no TTL. The TTL must have been validated.
+func leaseExpiry(b *v1alpha1.Backend, now time.Time) *time.Time {
+	if b.TTL == "" {
+		return nil
+	}
+	ttl, _ := time.ParseDuration(b.TTL)
+	expiresAt := now.Add(ttl).UTC()
+	return &expiresAt
+}
+
+// leaseExpired indicates if the registration lease of the backend has expired.
+func leaseExpired(b *v1alpha1.Backend, now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt)
+}
+
+// RenewBackend extends the registration lease of the backend by its TTL. The TTL can be
+// changed by setting it in the request.
+func (p *SprayProxy) RenewBackend(c *gin.Context) {
+	zapCommonFields := []zapcore.Field{
+		zap.String("method", c.Request.Method),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("query", c.Request.URL.RawQuery),
+		zap.Bool("dynamic-backends", p.enableDynamicBackends),
+		zap.String("request-id", c.GetString("requestId")),
+	}
+	zapCommonFields = append(zapCommonFields, callerFields(c)...)
+	var renewUrl v1alpha1.Backend
+	if err := c.ShouldBindJSON(&renewUrl); err != nil {
+		c.String(http.StatusBadRequest, "please provide a valid json body")
+		p.logger.Info("renew request is rejected, invalid json body", zapCommonFields...)
+		return
+	}
+	zapCommonFields = append(zapCommonFields, zap.String("backend", renewUrl.URL))
+	if err := validateBackend(&v1alpha1.Backend{URL: renewUrl.URL, TTL: renewUrl.TTL}); err != nil {
+		c.String(http.StatusBadRequest, "invalid backend: "+err.Error())
+		p.logger.Info("renew request is rejected, invalid backend: "+err.Error(), zapCommonFields...)
+		return
+	}
+	found := false
+	var renewed *v1alpha1.Backend
+	_, err := p.updateBackend(renewUrl.URL, func(existing *v1alpha1.Backend, _ map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool) {
+		found, renewed = existing != nil, nil
+		if existing == nil || (existing.TTL == "" && renewUrl.TTL == "") {
+			return nil, false
+		}
+		copied := *existing
+		renewed = &copied
+		if renewUrl.TTL != "" {
+			renewed.TTL = renewUrl.TTL
+		}
+		renewed.ExpiresAt = leaseExpiry(renewed, time.Now())
+		return renewed, true
+	})
+	switch {
+	case err != nil:
+		c.String(http.StatusInternalServerError, "failed to persist backend")
+		p.logger.Error("failed to persist backend: "+err.Error(), zapCommonFields...)
+	case !found:
+		c.String(http.StatusNotFound, "backend server not found in the list")
+		p.logger.Info("renew request is rejected, server not registered", zapCommonFields...)
+	case renewed == nil:
+		c.String(http.StatusBadRequest, "backend server registered without ttl")
+		p.logger.Info("renew request is rejected, server registered without ttl", zapCommonFields...)
+	default:
+		c.String(http.StatusOK, "backend server lease renewed")
+		p.logger.Info("server lease renewed", append(zapCommonFields, zap.Time("expires-at", *renewed.ExpiresAt))...)
+	}
+}
+
+// evictExpiredBackends unregisters the backends whose lease expired, and returns their number.
+func (p *SprayProxy) evictExpiredBackends(now time.Time) int {
+	evicted := 0
+	for _, url := range p.Backends() {
+		var expiresAt time.Time
+		// the lease is checked again with the change applied, in case it was renewed meanwhile
+		removed, err := p.updateBackend(url, func(existing *v1alpha1.Backend, _ map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool) {
+			if existing == nil || !leaseExpired(existing, now) {
+				return nil, false
+			}
+			expiresAt = *existing.ExpiresAt
+			return nil, true
+		})
+		if err != nil {
+			p.logger.Error("failed to evict expired backend: "+err.Error(), zap.String("backend", url))
+			continue
+		}
+		if removed {
+			evicted++
+			metrics.IncEvictedCount()
+			p.logger.Info("backend lease expired, server unregistered", zap.String("backend", url), zap.Time("expires-at", expiresAt),
+				zap.String("caller", "janitor"))
+		}
+	}
+	return evicted
+}
+
+// runJanitor evicts the backends whose lease expired periodically, until stopCh is closed.
+func (p *SprayProxy) runJanitor(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(p.janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-ticker.C:
+			p.evictExpiredBackends(now)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func sendBackendRequest(handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/backends", bytes.NewBufferString(body))
+	handler(ctx)
+	return w
+}
+
+func TestBackendLeases(t *testing.T) {
+	t.Setenv("SPRAYPROXY_BACKENDS_STORE_FILE", filepath.Join(t.TempDir(), "backends.json"))
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{"http://static": ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		handler  gin.HandlerFunc
+		body     string
+		expected int
+	}{
+		{name: "register with invalid ttl", handler: proxy.RegisterBackend, body: `{"url":"http://leased","ttl":"-1m"}`, expected: http.StatusBadRequest},
+		{name: "register with ttl", handler: proxy.RegisterBackend, body: `{"url":"http://leased","ttl":"1m","expiresAt":"2000-01-01T00:00:00Z"}`, expected: http.StatusOK},
+		{name: "renew with ttl", handler: proxy.RenewBackend, body: `{"url":"http://leased","ttl":"1h"}`, expected: http.StatusOK},
+		{name: "renew without ttl", handler: proxy.RenewBackend, body: `{"url":"http://static"}`, expected: http.StatusBadRequest},
+		{name: "renew unknown backend", handler: proxy.RenewBackend, body: `{"url":"http://unknown","ttl":"1m"}`, expected: http.StatusNotFound},
+		{name: "renew with invalid json", handler: proxy.RenewBackend, body: `{"url"}`, expected: http.StatusBadRequest},
+	} {
+		if w := sendBackendRequest(test.handler, test.body); w.Code != test.expected {
+			t.Errorf("%s: expected status code %d, got %d: %s", test.name, test.expected, w.Code, w.Body.String())
+		}
+	}
+
+	b, ok := proxy.backends.get("http://leased")
+	if !ok || b.TTL != "1h" || b.ExpiresAt == nil {
+		t.Fatalf("expected leased backend with 1h ttl, got %+v", b)
+	}
+	if remaining := time.Until(*b.ExpiresAt); remaining < 59*time.Minute || remaining > time.Hour {
+		t.Errorf("expected lease to expire in 1h, got %s", remaining)
+	}
+
+	if evicted := proxy.evictExpiredBackends(time.Now()); evicted != 0 {
+		t.Errorf("expected no backend to be evicted, got %d", evicted)
+	}
+	if evicted := proxy.evictExpiredBackends(b.ExpiresAt.Add(time.Second)); evicted != 1 {
+		t.Errorf("expected %d backend to be evicted, got %d", 1, evicted)
+	}
+	if backends := proxy.Backends(); len(backends) != 1 || backends[0] != "http://static" {
+		t.Errorf("expected backends [http://static], got %v", backends)
+	}
+	// the eviction is persisted
+	if err := proxy.reloadBackends(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if backends := proxy.Backends(); len(backends) != 1 {
+		t.Errorf("expected evicted backend not to be reloaded, got %v", backends)
+	}
+}
+
+func TestBackendJanitor(t *testing.T) {
+	t.Setenv("SPRAYPROXY_BACKENDS_JANITOR_INTERVAL", "10ms")
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go proxy.runJanitor(stopCh)
+	if w := sendBackendRequest(proxy.RegisterBackend, `{"url":"http://leased","ttl":"50ms"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(proxy.Backends()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected expired backend to be evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Setenv("SPRAYPROXY_BACKENDS_JANITOR_INTERVAL", "0s")
+	if _, err := NewSprayProxy(false, true, true, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error for invalid janitor interval")
+	}
+}
@@ -0,0 +1,655 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	outboxSegmentsDir    = "segments"
+	outboxCheckpointsDir = "checkpoints"
+	outboxSegmentExt     = ".seg"
+	outboxCheckpointExt  = ".json"
+	// every record is prefixed with its length and CRC32 checksum
+	outboxFrameHeaderSize = 8
+	// how often the outbox workers are reconciled with the registered backends
+	outboxSyncInterval = time.Second
+)
+
+var errOutboxEmpty = errors.New("no pending deliveries")
+
+// delivery is an inbound request persisted in the outbox, pending forwarding to the backends.
+type delivery struct {
+	ID         string `json:"id"`
+	DeliveryID string `json:"deliveryId,omitempty"`
+	// Backends restricts the backends the delivery is forwarded to, for duplicate deliveries
+	Backends   []string    `json:"backends,omitempty"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	ReceivedAt time.Time   `json:"receivedAt"`
+}
+
+// outboxPosition points to a record in the outbox log.
+type outboxPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// outboxCheckpoint is the position of the next record to deliver to a backend.
+type outboxCheckpoint struct {
+	Backend string `json:"backend"`
+	outboxPosition
+}
+
+// outbox is an append-only log of deliveries, split into numbered segment files. Every backend
+// consumes the log independently and checkpoints its position, so deliveries are forwarded at
+// least once, even across restarts. Segments are removed once all backends have consumed them.
+type outbox struct {
+	dir         string
+	segmentSize int64
+	logger      *zap.Logger
+
+	mu sync.Mutex
+	// segment is the number of the last segment, which is open for appending
+	segment uint64
+	file    *os.File
+	// size is the number of bytes of the last segment which are committed to disk
+	size int64
+	// changed is closed and replaced on every append, to wake up waiting readers
+	changed chan struct{}
+	// checkpoints holds the backends whose checkpoint exists on disk
+	checkpoints map[string]bool
+}
+
+// openOutbox opens the outbox in the given directory, creating it if needed. An incomplete
+// record at the end of the log, left over by a crash, is discarded.
+func openOutbox(dir string, segmentSize int64, logger *zap.Logger) (*outbox, error) {
+	for _, d := range []string{outboxSegmentsDir, outboxCheckpointsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create outbox directory: %v", err)
+		}
+	}
+	o := &outbox{
+		dir:         dir,
+		segmentSize: segmentSize,
+		logger:      logger,
+		changed:     make(chan struct{}),
+		checkpoints: map[string]bool{},
+	}
+	segments, err := o.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		o.segment = segments[len(segments)-1]
+	}
+	file, err := os.OpenFile(o.segmentPath(o.segment), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox segment: %v", err)
+	}
+	size, err := recoverSegment(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to recover outbox segment %d: %v", o.segment, err)
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	o.file = file
+	o.size = size
+	return o, nil
+}
+
+// recoverSegment scans the segment for valid records and truncates anything after the last one.
+// It returns the resulting size of the segment.
+func recoverSegment(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	var size int64
+	for {
+		_, n, err := readFrame(reader)
+		if err != nil {
+			break
+		}
+		size += n
+	}
+	if size < info.Size() {
+		if err := file.Truncate(size); err != nil {
+			return 0, err
+		}
+		if err := file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// append persists the delivery for the given backends. Backends without a checkpoint get one
+// before the delivery, so they receive it even if their worker is not started yet. The delivery
+// is on disk when append returns without error.
+func (o *outbox) append(d *delivery, backends []string) error {
+	payload, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, outboxFrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[outboxFrameHeaderSize:], payload)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, backend := range backends {
+		if err := o.initCheckpoint(backend); err != nil {
+			return err
+		}
+	}
+	if o.size > 0 && o.size+int64(len(frame)) > o.segmentSize {
+		if err := o.roll(); err != nil {
+			return err
+		}
+	}
+	if _, err := o.file.Write(frame); err != nil {
+		// drop the partial record, so subsequent appends remain readable
+		o.file.Truncate(o.size)
+		o.file.Seek(o.size, io.SeekStart)
+		return err
+	}
+	if err := o.file.Sync(); err != nil {
+		return err
+	}
+	o.size += int64(len(frame))
+	close(o.changed)
+	o.changed = make(chan struct{})
+	return nil
+}
+
+// roll closes the current segment and starts a new one. Must be called with the lock held.
+func (o *outbox) roll() error {
+	file, err := os.OpenFile(o.segmentPath(o.segment+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create outbox segment: %v", err)
+	}
+	if err := syncDir(filepath.Join(o.dir, outboxSegmentsDir)); err != nil {
+		file.Close()
+		return err
+	}
+	o.file.Close()
+	o.file = file
+	o.segment++
+	o.size = 0
+	return nil
+}
+
+// tail returns the position after the last record in the log.
+func (o *outbox) tail() outboxPosition {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return outboxPosition{Segment: o.segment, Offset: o.size}
+}
+
+// wait returns a channel which is closed on the next append.
+func (o *outbox) wait() <-chan struct{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.changed
+}
+
+// read returns the delivery at the given position, and the position of the next record.
+// If there is no record at the position yet, errOutboxEmpty is returned.
+func (o *outbox) read(pos outboxPosition) (*delivery, outboxPosition, error) {
+	o.mu.Lock()
+	lastSegment, lastSize := o.segment, o.size
+	o.mu.Unlock()
+	for {
+		if pos.Segment == lastSegment && pos.Offset >= lastSize {
+			return nil, pos, errOutboxEmpty
+		}
+		file, err := os.Open(o.segmentPath(pos.Segment))
+		if err != nil {
+			if os.IsNotExist(err) && pos.Segment < lastSegment {
+				// segment was already removed, or never written in case of a crash while rolling
+				pos = outboxPosition{Segment: pos.Segment + 1}
+				continue
+			}
+			return nil, pos, err
+		}
+		d, n, err := readFrameAt(file, pos.Offset)
+		file.Close()
+		if err == io.EOF && pos.Segment < lastSegment {
+			pos = outboxPosition{Segment: pos.Segment + 1}
+			continue
+		}
+		if err != nil {
+			return nil, pos, err
+		}
+		return d, outboxPosition{Segment: pos.Segment, Offset: pos.Offset + n}, nil
+	}
+}
+
+func readFrameAt(file *os.File, offset int64) (*delivery, int64, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return readFrame(bufio.NewReader(file))
+}
+
+// readFrame reads a single record, returning the delivery and the size of the record on disk.
+func readFrame(reader io.Reader) (*delivery, int64, error) {
+	header := make([]byte, outboxFrameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.New("truncated outbox record")
+		}
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, errors.New("truncated outbox record")
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, errors.New("corrupted outbox record")
+	}
+	d := &delivery{}
+	if err := json.Unmarshal(payload, d); err != nil {
+		return nil, 0, fmt.Errorf("invalid outbox record: %v", err)
+	}
+	return d, int64(outboxFrameHeaderSize + length), nil
+}
+
+// segments returns the numbers of the segments on disk, in ascending order.
+func (o *outbox) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(filepath.Join(o.dir, outboxSegmentsDir))
+	if err != nil {
+		return nil, err
+	}
+	segments := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, outboxSegmentExt) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, outboxSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (o *outbox) segmentPath(segment uint64) string {
+	return filepath.Join(o.dir, outboxSegmentsDir, fmt.Sprintf("%020d%s", segment, outboxSegmentExt))
+}
+
+func (o *outbox) checkpointPath(backend string) string {
+	sum := sha256.Sum256([]byte(backend))
+	return filepath.Join(o.dir, outboxCheckpointsDir, hex.EncodeToString(sum[:16])+outboxCheckpointExt)
+}
+
+// loadCheckpoint returns the checkpointed position of the backend, if any.
+func (o *outbox) loadCheckpoint(backend string) (outboxPosition, bool, error) {
+	data, err := os.ReadFile(o.checkpointPath(backend))
+	if os.IsNotExist(err) {
+		return outboxPosition{}, false, nil
+	}
+	if err != nil {
+		return outboxPosition{}, false, err
+	}
+	checkpoint := outboxCheckpoint{}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return outboxPosition{}, false, fmt.Errorf("invalid outbox checkpoint: %v", err)
+	}
+	return checkpoint.outboxPosition, true, nil
+}
+
+// saveCheckpoint atomically persists the position of the backend.
+func (o *outbox) saveCheckpoint(backend string, pos outboxPosition) error {
+	data, err := json.Marshal(outboxCheckpoint{Backend: backend, outboxPosition: pos})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.checkpointPath(backend), data)
+}
+
+// initCheckpoint creates the checkpoint of a backend at the end of the log, unless it exists.
+// Must be called with the lock held.
+func (o *outbox) initCheckpoint(backend string) error {
+	if o.checkpoints[backend] {
+		return nil
+	}
+	if _, ok, err := o.loadCheckpoint(backend); err != nil {
+		return err
+	} else if !ok {
+		if err := o.saveCheckpoint(backend, outboxPosition{Segment: o.segment, Offset: o.size}); err != nil {
+			return err
+		}
+	}
+	o.checkpoints[backend] = true
+	return nil
+}
+
+// checkpoint returns the checkpointed position of the backend, creating the checkpoint at the
+// end of the log if needed.
+func (o *outbox) checkpoint(backend string) (outboxPosition, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.initCheckpoint(backend); err != nil {
+		return outboxPosition{}, err
+	}
+	pos, _, err := o.loadCheckpoint(backend)
+	return pos, err
+}
+
+// checkpointed returns the backends whose checkpoint was created or loaded.
+func (o *outbox) checkpointed() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	backends := make([]string, 0, len(o.checkpoints))
+	for backend := range o.checkpoints {
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// removeCheckpoint removes the checkpoint of an unregistered backend. The worker of the backend
+// must be stopped, so it does not save the checkpoint again.
+func (o *outbox) removeCheckpoint(backend string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.checkpoints, backend)
+	if err := os.Remove(o.checkpointPath(backend)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// gc removes the segments which have been consumed by all backends.
+func (o *outbox) gc() error {
+	entries, err := os.ReadDir(filepath.Join(o.dir, outboxCheckpointsDir))
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	minSegment := o.segment
+	o.mu.Unlock()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), outboxCheckpointExt) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(o.dir, outboxCheckpointsDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		checkpoint := outboxCheckpoint{}
+		if err := json.Unmarshal(data, &checkpoint); err != nil {
+			return fmt.Errorf("invalid outbox checkpoint %s: %v", entry.Name(), err)
+		}
+		if checkpoint.Segment < minSegment {
+			minSegment = checkpoint.Segment
+		}
+	}
+	segments, err := o.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment >= minSegment {
+			break
+		}
+		if err := os.Remove(o.segmentPath(segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		o.logger.Info("removed consumed outbox segment", zap.Uint64("segment", segment))
+	}
+	return nil
+}
+
+func (o *outbox) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
+
+// writeFileAtomic writes the data to a temporary file and renames it, so readers either see
+// the previous or the new content, even in case of a crash.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes directory entries, making file creations and renames durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// outboxWorkerHandle stops a delivery worker, and tells when it exited.
+type outboxWorkerHandle struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// runOutbox starts a delivery worker for every backend, and keeps the workers in sync with
+// the registered backends until stopCh is closed.
+func (p *SprayProxy) runOutbox(stopCh <-chan struct{}) {
+	workers := map[string]*outboxWorkerHandle{}
+	ticker := time.NewTicker(outboxSyncInterval)
+	defer ticker.Stop()
+	for {
+		backends := map[string]bool{}
+		for _, backend := range p.Backends() {
+			backends[backend] = true
+			if _, ok := workers[backend]; !ok {
+				worker := &outboxWorkerHandle{stop: make(chan struct{}), done: make(chan struct{})}
+				workers[backend] = worker
+				go func(backend string) {
+					defer close(worker.done)
+					p.outboxWorker(backend, worker.stop)
+				}(backend)
+			}
+		}
+		for backend, worker := range workers {
+			if !backends[backend] {
+				// the worker saves its checkpoint after every delivery, so it must exit first
+				close(worker.stop)
+				<-worker.done
+				delete(workers, backend)
+			}
+		}
+		// checkpoints are also created on append, for backends which may be gone before they got a worker
+		for _, backend := range p.outbox.checkpointed() {
+			if _, ok := workers[backend]; ok || backends[backend] {
+				continue
+			}
+			if err := p.outbox.removeCheckpoint(backend); err != nil {
+				p.logger.Error("failed to remove outbox checkpoint: "+err.Error(), zap.String("backend", backend))
+			}
+		}
+		if err := p.outbox.gc(); err != nil {
+			p.logger.Error("failed to remove consumed outbox segments: " + err.Error())
+		}
+		select {
+		case <-stopCh:
+			for _, worker := range workers {
+				close(worker.stop)
+			}
+			for _, worker := range workers {
+				<-worker.done
+			}
+			if err := p.outbox.close(); err != nil {
+				p.logger.Error("failed to close outbox: " + err.Error())
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// outboxWorker forwards the deliveries in the outbox to a single backend, in order. A delivery
+// is retried until the backend accepts it, and only then the backend checkpoint moves forward.
+// A backend without a checkpoint starts with the deliveries received after it was registered.
+func (p *SprayProxy) outboxWorker(backend string, stop <-chan struct{}) {
+	zapBackendFields := []zap.Field{zap.String("backend", backend)}
+	pos, err := p.outbox.checkpoint(backend)
+	if err != nil {
+		p.logger.Error("failed to load outbox checkpoint, starting from the end of the outbox: "+err.Error(), zapBackendFields...)
+		pos = p.outbox.tail()
+	}
+	client := p.client
+	for {
+		changed := p.outbox.wait()
+		d, next, err := p.outbox.read(pos)
+		if err == errOutboxEmpty {
+			select {
+			case <-stop:
+				return
+			case <-changed:
+				continue
+			}
+		}
+		if err != nil {
+			p.logger.Error("failed to read outbox: "+err.Error(), append(zapBackendFields,
+				zap.Uint64("segment", pos.Segment), zap.Int64("offset", pos.Offset))...)
+			if pos.Segment < p.outbox.tail().Segment {
+				// the rest of a completed segment is unreadable, skip it instead of stalling the backend
+				pos = outboxPosition{Segment: pos.Segment + 1}
+				continue
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(p.retryPolicy.MaxBackoff):
+				continue
+			}
+		}
+		if !p.deliver(client, backend, d, stop) {
+			return
+		}
+		pos = next
+		if err := p.outbox.saveCheckpoint(backend, pos); err != nil {
+			p.logger.Error("failed to save outbox checkpoint: "+err.Error(), zapBackendFields...)
+		}
+	}
+}
+
+// deliver forwards the delivery to the backend until it is accepted. A response code which is
+// not retryable is considered final. Returns false if stopped before the delivery succeeded.
+func (p *SprayProxy) deliver(client *http.Client, backend string, d *delivery, stop <-chan struct{}) bool {
+	// the request is canceled once stopped, interrupting the attempts and backoffs of forward
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, d.Method, d.URL, nil)
+	if err != nil {
+		p.logger.Error("dropping invalid outbox delivery: "+err.Error(), zap.String("request-id", d.ID), zap.String("backend", backend))
+		return true
+	}
+	req.Header = d.Header
+	zapCommonFields := []zap.Field{
+		zap.String("method", d.Method),
+		zap.String("path", req.URL.Path),
+		zap.String("query", req.URL.RawQuery),
+		zap.String("request-id", d.ID),
+		zap.Bool("outbox", true),
+	}
+	if d.Backends != nil && !containsString(d.Backends, backend) {
+		return true
+	}
+	b, _ := p.backends.get(backend)
+	if b != nil && b.Paused {
+		p.logger.Info("skipping paused backend", append(zapCommonFields, zap.String("backend", backend))...)
+		return true
+	}
+	if hasRoutingRules(p.backends.snapshot()) {
+		info, _ := parseEventInfo(d.Header.Get("X-GitHub-Event"), d.Header.Get("Content-Type"), d.Body)
+		if matched, reason := p.routeMatches(backend, info); !matched {
+			p.logger.Info("routing decision", append(zapCommonFields,
+				zap.String("backend", backend),
+				zap.Bool("matched", matched),
+				zap.String("reason", reason))...)
+			return true
+		}
+	}
+	retryPolicy := p.backendRetryPolicy(b)
+	for round := 1; ; round++ {
+		result := p.forward(client, req, backend, d.Body, zapCommonFields)
+		// with the queue action, the delivery waits in the outbox until the circuit closes
+		skipped := errors.Is(result.err, errCircuitOpen) && !p.breakers.queue()
+		if skipped || (result.err == nil && !retryPolicy.retryable(result.status, nil)) {
+			if p.dedup != nil && d.DeliveryID != "" {
+				p.dedup.record(d.DeliveryID, []forwardResult{result})
+			}
+			if result.failed() {
+				p.deadLetter(d.ID, req, d.Body, result)
+			}
+			return true
+		}
+		backoff, _ := retryPolicy.backoff(round+1, 0)
+		select {
+		case <-stop:
+			return false
+		case <-time.After(backoff):
+		}
+	}
+}
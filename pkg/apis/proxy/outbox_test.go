@@ -0,0 +1,427 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func newTestDelivery(i int) *delivery {
+	return &delivery{
+		ID:     fmt.Sprintf("delivery-%d", i),
+		Method: http.MethodPost,
+		URL:    "/",
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body:   []byte(fmt.Sprintf(`{"delivery":%d}`, i)),
+	}
+}
+
+func TestOutboxAppendRead(t *testing.T) {
+	// small segments, so the deliveries span multiple segments
+	o, err := openOutbox(t.TempDir(), 256, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer o.close()
+	start := o.tail()
+	for i := 0; i < 10; i++ {
+		if err := o.append(newTestDelivery(i), nil); err != nil {
+			t.Fatalf("failed to append delivery: %v", err)
+		}
+	}
+	if o.tail().Segment == start.Segment {
+		t.Errorf("expected outbox to roll over to a new segment")
+	}
+	pos := start
+	for i := 0; i < 10; i++ {
+		d, next, err := o.read(pos)
+		if err != nil {
+			t.Fatalf("failed to read delivery %d: %v", i, err)
+		}
+		if d.ID != fmt.Sprintf("delivery-%d", i) {
+			t.Errorf("expected delivery %q, got %q", fmt.Sprintf("delivery-%d", i), d.ID)
+		}
+		pos = next
+	}
+	if _, _, err := o.read(pos); err != errOutboxEmpty {
+		t.Errorf("expected error %q, got %v", errOutboxEmpty, err)
+	}
+}
+
+func TestOutboxRecoverTruncatedRecord(t *testing.T) {
+	dir := t.TempDir()
+	o, err := openOutbox(dir, 1024*1024, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	if err := o.append(newTestDelivery(0), nil); err != nil {
+		t.Fatalf("failed to append delivery: %v", err)
+	}
+	size := o.tail().Offset
+	// simulate a crash in the middle of writing a record
+	if _, err := o.file.Write([]byte{0, 0, 1, 0, 42}); err != nil {
+		t.Fatalf("failed to write partial record: %v", err)
+	}
+	o.close()
+
+	o, err = openOutbox(dir, 1024*1024, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to reopen outbox: %v", err)
+	}
+	defer o.close()
+	if o.tail().Offset != size {
+		t.Errorf("expected partial record to be truncated to size %d, got %d", size, o.tail().Offset)
+	}
+	if err := o.append(newTestDelivery(1), nil); err != nil {
+		t.Fatalf("failed to append delivery: %v", err)
+	}
+	pos := outboxPosition{}
+	for i := 0; i < 2; i++ {
+		d, next, err := o.read(pos)
+		if err != nil {
+			t.Fatalf("failed to read delivery %d: %v", i, err)
+		}
+		if d.ID != fmt.Sprintf("delivery-%d", i) {
+			t.Errorf("expected delivery %q, got %q", fmt.Sprintf("delivery-%d", i), d.ID)
+		}
+		pos = next
+	}
+}
+
+func TestOutboxCheckpointAndGC(t *testing.T) {
+	o, err := openOutbox(t.TempDir(), 128, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer o.close()
+	backend := "http://localhost:8081"
+	if _, ok, err := o.loadCheckpoint(backend); ok || err != nil {
+		t.Errorf("expected no checkpoint, got %v, %v", ok, err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := o.append(newTestDelivery(i), nil); err != nil {
+			t.Fatalf("failed to append delivery: %v", err)
+		}
+	}
+	if err := o.saveCheckpoint(backend, outboxPosition{}); err != nil {
+		t.Fatalf("failed to save checkpoint: %v", err)
+	}
+	if err := o.gc(); err != nil {
+		t.Fatalf("failed to gc: %v", err)
+	}
+	segments, _ := o.segments()
+	if len(segments) != 5 {
+		t.Errorf("expected unconsumed segments to be kept, got %v", segments)
+	}
+
+	tail := o.tail()
+	if err := o.saveCheckpoint(backend, tail); err != nil {
+		t.Fatalf("failed to save checkpoint: %v", err)
+	}
+	pos, ok, err := o.loadCheckpoint(backend)
+	if !ok || err != nil || pos != tail {
+		t.Errorf("expected checkpoint %v, got %v, %v, %v", tail, pos, ok, err)
+	}
+	if err := o.gc(); err != nil {
+		t.Fatalf("failed to gc: %v", err)
+	}
+	segments, _ = o.segments()
+	if len(segments) != 1 || segments[0] != tail.Segment {
+		t.Errorf("expected only segment %d to be kept, got %v", tail.Segment, segments)
+	}
+
+	if err := o.removeCheckpoint(backend); err != nil {
+		t.Fatalf("failed to remove checkpoint: %v", err)
+	}
+	if _, ok, _ := o.loadCheckpoint(backend); ok {
+		t.Errorf("expected checkpoint to be removed")
+	}
+}
+
+func TestOutboxAppendCreatesCheckpoints(t *testing.T) {
+	o, err := openOutbox(t.TempDir(), 256, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer o.close()
+	if err := o.append(newTestDelivery(0), nil); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	tail := o.tail()
+	backend := "https://cluster-a"
+	if err := o.append(newTestDelivery(1), []string{backend}); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	pos, err := o.checkpoint(backend)
+	if err != nil || pos != tail {
+		t.Fatalf("expected checkpoint %+v before the appended delivery, got %+v, %v", tail, pos, err)
+	}
+	d, _, err := o.read(pos)
+	if err != nil || d.ID != "delivery-1" {
+		t.Errorf("expected the backend to start with delivery-1, got %+v, %v", d, err)
+	}
+	// existing checkpoints are kept
+	if err := o.append(newTestDelivery(2), []string{backend}); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if pos, err := o.checkpoint(backend); err != nil || pos != tail {
+		t.Errorf("expected checkpoint %+v to be kept, got %+v, %v", tail, pos, err)
+	}
+	if backends := o.checkpointed(); len(backends) != 1 || backends[0] != backend {
+		t.Errorf("expected checkpointed backends [%s], got %v", backend, backends)
+	}
+	if err := o.removeCheckpoint(backend); err != nil {
+		t.Fatalf("failed to remove checkpoint: %v", err)
+	}
+	if backends := o.checkpointed(); len(backends) != 0 {
+		t.Errorf("expected no checkpointed backends, got %v", backends)
+	}
+}
+
+func TestOutboxUnregisterBackend(t *testing.T) {
+	t.Setenv("SPRAYPROXY_OUTBOX_DIR", t.TempDir())
+	t.Setenv("SPRAYPROXY_RETRY_MAX_BACKOFF", "50ms")
+	attempts := make(chan struct{}, 100)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts <- struct{}{}
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{backend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	proxy.Start(stopCh)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status code %d, got %d", http.StatusAccepted, w.Code)
+	}
+	select {
+	case <-attempts:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the delivery was not attempted")
+	}
+
+	// the worker is retrying the delivery when the backend is unregistered
+	if _, err := proxy.removeBackend(backend.URL); err != nil {
+		t.Fatalf("failed to unregister backend: %v", err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, err := os.Stat(proxy.outbox.checkpointPath(backend.URL))
+		return os.IsNotExist(err), nil
+	})
+	if err != nil {
+		t.Fatalf("checkpoint of the unregistered backend was not removed: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(proxy.outbox.checkpointPath(backend.URL)); !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint of the unregistered backend to stay removed, got %v", err)
+	}
+}
+
+func TestHandleProxyOutbox(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SPRAYPROXY_OUTBOX_DIR", dir)
+	t.Setenv("SPRAYPROXY_RETRY_MAX_BACKOFF", "50ms")
+	var available int32
+	received := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&available) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		received <- string(body)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	testBackend := map[string]string{backend.URL: ""}
+
+	// backend is down, the request is accepted nonetheless
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), testBackend)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stopCh := make(chan struct{})
+	proxy.Start(stopCh)
+	// the request is persisted for the backend, whether its worker started or not
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected status code %d, got %d", http.StatusAccepted, w.Code)
+	}
+	close(stopCh)
+	// wait for the workers to stop
+	time.Sleep(200 * time.Millisecond)
+
+	// a restarted proxy delivers the pending request once the backend is up
+	atomic.StoreInt32(&available, 1)
+	proxy, err = NewSprayProxy(false, true, false, zap.NewNop(), testBackend)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stopCh = make(chan struct{})
+	defer close(stopCh)
+	proxy.Start(stopCh)
+	select {
+	case body := <-received:
+		if body != newProxyRequestBody() {
+			t.Errorf("expected body %q, got %q", newProxyRequestBody(), body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pending request was not delivered after restart")
+	}
+	select {
+	case body := <-received:
+		t.Errorf("expected a single delivery, got another one with body %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestHandleProxyOutboxDedup(t *testing.T) {
+	t.Setenv("SPRAYPROXY_OUTBOX_DIR", t.TempDir())
+	t.Setenv("SPRAYPROXY_DEDUP_WINDOW", "1m")
+	t.Setenv("SPRAYPROXY_DEDUP_POLICY", DedupPolicyFailedOnly)
+	var okCalls, rejectingCalls int32
+	okBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&okCalls, 1)
+	}))
+	defer okBackend.Close()
+	// reject the first delivery, which is final as the status code is not retryable
+	rejectingBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&rejectingCalls, 1) == 1 {
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer rejectingBackend.Close()
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{okBackend.URL: "", rejectingBackend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	proxy.Start(stopCh)
+	send := func() int {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = newProxyRequest()
+		ctx.Request.Header.Set(deliveryHeader, "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		proxy.HandleProxy(ctx)
+		return w.Code
+	}
+	waitForCalls := func(calls *int32, expected int32) {
+		err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			return atomic.LoadInt32(calls) == expected, nil
+		})
+		if err != nil {
+			t.Fatalf("expected %d deliveries, got %d", expected, atomic.LoadInt32(calls))
+		}
+	}
+
+	if code := send(); code != http.StatusAccepted {
+		t.Fatalf("expected status code %d, got %d", http.StatusAccepted, code)
+	}
+	waitForCalls(&okCalls, 1)
+	waitForCalls(&rejectingCalls, 1)
+	// the rejection is recorded by the worker
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		proxy.dedup.mu.Lock()
+		defer proxy.dedup.mu.Unlock()
+		entry := proxy.dedup.index["72d3162e-cc78-11e3-81ab-4c9367dc0958"].Value.(*dedupEntry)
+		return entry.failed[rejectingBackend.URL], nil
+	})
+	if err != nil {
+		t.Fatalf("expected the rejecting backend to be recorded as failed")
+	}
+
+	// the redelivery only goes to the backend which rejected it
+	if code := send(); code != http.StatusAccepted {
+		t.Fatalf("expected status code %d, got %d", http.StatusAccepted, code)
+	}
+	waitForCalls(&rejectingCalls, 2)
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&okCalls); got != 1 {
+		t.Errorf("expected a single delivery to the healthy backend, got %d", got)
+	}
+}
+
+func TestHandleProxyOutboxFailure(t *testing.T) {
+	t.Setenv("SPRAYPROXY_OUTBOX_DIR", t.TempDir())
+	t.Setenv("SPRAYPROXY_DEDUP_WINDOW", "1m")
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{"https://cluster-a": ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	// appending to a closed outbox fails
+	proxy.outbox.close()
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	ctx.Request.Header.Set(deliveryHeader, "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	// the retry of the sender is not a duplicate
+	if duplicate, _, _ := proxy.dedup.check("72d3162e-cc78-11e3-81ab-4c9367dc0958", nil, time.Now()); duplicate {
+		t.Errorf("expected the delivery which failed to queue to be forgotten")
+	}
+}
+
+func TestOutboxDeliverStop(t *testing.T) {
+	t.Setenv("SPRAYPROXY_RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("SPRAYPROXY_RETRY_INITIAL_BACKOFF", "1m")
+	t.Setenv("SPRAYPROXY_RETRY_MAX_BACKOFF", "1m")
+	attempts := make(chan struct{}, 100)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts <- struct{}{}
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{backend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stop := make(chan struct{})
+	delivered := make(chan bool)
+	go func() {
+		delivered <- proxy.deliver(proxy.client, backend.URL, newTestDelivery(0), stop)
+	}()
+	select {
+	case <-attempts:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the delivery was not attempted")
+	}
+
+	// the worker is waiting for the retry backoff when stopped
+	close(stop)
+	select {
+	case ok := <-delivered:
+		if ok {
+			t.Errorf("expected the stopped delivery to be kept in the outbox")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the delivery did not stop")
+	}
+}
@@ -7,7 +7,7 @@ package proxy
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -17,9 +17,11 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
 	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -31,27 +33,107 @@ const (
 )
 
 type SprayProxy struct {
-	backends              map[string]string
+	backends              *backendRegistry
 	insecureTLS           bool
 	insecureWebhook       bool
 	enableDynamicBackends bool
-	webhookSecret         string
+	webhookSecrets        *webhookSecrets
+	backendSecrets        *backendSecrets
+	sourceAllowlist       *sourceAllowlist
+	backendTLS            *v1alpha1.TLSConfig
+	tlsFiles              *tlsFiles
+	transports            *transports
+	client                *http.Client
+	verifiers             []Verifier
 	logger                *zap.Logger
 	fwdReqTmout           time.Duration
 	maxReqSize            int
+	maxConcurrentFwd      int
+	retryPolicy           RetryPolicy
+	limits                backendLimits
+	outbox                *outbox
+	deadLetters           *deadLetterStore
+	dedup                 *dedupCache
+	store                 backendStore
+	// storeMu serializes the changes to the store with the registry updates
+	storeMu           sync.Mutex
+	storeSyncInterval time.Duration
+	janitorInterval   time.Duration
+	stats             *statsTracker
+	breakers          *circuitBreakers
+	health            *healthChecker
+	responsePolicy    responsePolicy
+	async             *asyncForwarder
 }
 
 func NewSprayProxy(insecureTLS, insecureWebhook, enableDynamicBackends bool, logger *zap.Logger, backends map[string]string) (*SprayProxy, error) {
 
-	var webhookSecret string
+	verifiers, err := verifiersFromEnv()
+	if err != nil {
+		logger.Error("invalid webhook verifiers", zap.Error(err))
+		return nil, err
+	}
+	verifierNames := []string{}
+	for _, v := range verifiers {
+		verifierNames = append(verifierNames, v.Name())
+	}
+	logger.Info(fmt.Sprintf("proxy webhook verifiers set to %s", strings.Join(verifierNames, ", ")))
+
+	var webhookSecrets *webhookSecrets
 	if !insecureWebhook {
-		if secret := os.Getenv(envWebhookSecret); secret == "" {
-			// if validation is enabled, but no secret found
-			logger.Error("webhook validation enabled, but no secret found")
-			return nil, errors.New("no webhook secret")
-		} else {
-			webhookSecret = secret
+		secrets, err := webhookSecretsFromEnv(logger, verifierNames)
+		if err != nil {
+			// validation is enabled, but no valid secret found
+			logger.Error("invalid webhook secrets", zap.Error(err))
+			return nil, err
 		}
+		if files := secrets.files(); len(files) > 0 {
+			logger.Info(fmt.Sprintf("proxy webhook secrets reloaded on changes to %s", strings.Join(files, ", ")))
+		}
+		webhookSecrets = secrets
+	}
+
+	backendSecrets, err := backendSecretsFromEnv(logger)
+	if err != nil {
+		logger.Error("invalid backend secrets", zap.Error(err))
+		return nil, err
+	}
+	if backendSecrets != nil {
+		if insecureWebhook {
+			// backends would trust requests the proxy did not verify
+			err := errors.New("backend secrets cannot be used when skipping webhook verification")
+			logger.Error("invalid backend secrets", zap.Error(err))
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("proxy signing forwarded requests with %d backend secrets", len(*backendSecrets.current.Load())))
+		if backendSecrets.file != "" {
+			logger.Info(fmt.Sprintf("proxy backend secrets reloaded on changes to %s", backendSecrets.file))
+		}
+	}
+
+	sourceAllowlist, err := sourceAllowlistFromEnv(logger)
+	if err != nil {
+		logger.Error("invalid allowed source ranges", zap.Error(err))
+		return nil, err
+	}
+	if sourceAllowlist != nil {
+		logger.Info(fmt.Sprintf("proxy accepting requests from %d source ranges, reloaded on changes to %s",
+			len(*sourceAllowlist.current.Load()), sourceAllowlist.file))
+	}
+
+	tlsFiles := newTLSFiles(logger)
+	backendTLS, err := backendTLSFromEnv()
+	if err == nil && backendTLS != nil {
+		// fail early on invalid files rather than on every request
+		err = tlsFiles.load(backendTLS)
+	}
+	if err != nil {
+		logger.Error("invalid backend TLS settings", zap.Error(err))
+		return nil, err
+	}
+	if backendTLS != nil {
+		logger.Info("proxy connecting to backends with TLS settings",
+			zap.String("ca-file", backendTLS.CAFile), zap.String("client-cert-file", backendTLS.CertFile))
 	}
 
 	// forwarding request timeout of 15s, can be overriden by SPRAYPROXY_FORWARDING_REQUEST_TIMEOUT env var
@@ -61,6 +143,15 @@ func NewSprayProxy(insecureTLS, insecureWebhook, enableDynamicBackends bool, log
 	}
 	logger.Info(fmt.Sprintf("proxy forwarding request timeout set to %s", fwdReqTmout.String()))
 
+	transportConfig, err := transportConfigFromEnv()
+	if err != nil {
+		logger.Error("invalid transport settings", zap.Error(err))
+		return nil, err
+	}
+	logger.Info(fmt.Sprintf("proxy backend connections keep-alive set to %t, %d max idle connections per backend, %s idle timeout, HTTP/2 set to %t, %s dial timeout and %s TLS handshake timeout",
+		transportConfig.keepAlive, transportConfig.maxIdleConns, transportConfig.idleConnTimeout, transportConfig.http2,
+		transportConfig.dialTimeout, transportConfig.tlsHandshakeTimeout))
+
 	// GitHub limits webhook request size to 25MB. Use that as default.
 	maxReqSize := 1024 * 1024 * 25
 	if maxReqSizeFromEnv, err := strconv.Atoi(os.Getenv("SPRAYPROXY_MAX_REQUEST_SIZE")); err == nil {
@@ -68,35 +159,254 @@ func NewSprayProxy(insecureTLS, insecureWebhook, enableDynamicBackends bool, log
 	}
 	logger.Info(fmt.Sprintf("proxy max request size set to %d bytes (%.2fMB)", maxReqSize, float64(maxReqSize)/(1<<20)))
 
-	return &SprayProxy{
-		backends:              backends,
+	// limit the number of requests forwarded in parallel, can be overriden by SPRAYPROXY_MAX_CONCURRENT_FORWARDS env var
+	maxConcurrentFwd := 16
+	if maxConcurrentFwdFromEnv, err := strconv.Atoi(os.Getenv("SPRAYPROXY_MAX_CONCURRENT_FORWARDS")); err == nil && maxConcurrentFwdFromEnv > 0 {
+		maxConcurrentFwd = maxConcurrentFwdFromEnv
+	}
+	logger.Info(fmt.Sprintf("proxy max concurrent forwards set to %d", maxConcurrentFwd))
+
+	retryPolicy, err := retryPolicyFromEnv()
+	if err != nil {
+		logger.Error("invalid retry policy", zap.Error(err))
+		return nil, err
+	}
+	logger.Info(fmt.Sprintf("proxy retry policy set to %d max attempts, %s initial backoff, %s max backoff",
+		retryPolicy.MaxAttempts, retryPolicy.InitialBackoff, retryPolicy.MaxBackoff))
+
+	limits, err := backendLimitsFromEnv()
+	if err != nil {
+		logger.Error("invalid backend limits", zap.Error(err))
+		return nil, err
+	}
+	logger.Info(fmt.Sprintf("proxy backend limits set to %s max timeout, %d max retry attempts and %s max retry backoff, insecure TLS allowed set to %t",
+		limits.maxTimeout, limits.maxRetryAttempts, limits.maxRetryBackoff, limits.allowInsecureTLS))
+
+	responsePolicy, err := responsePolicyFromEnv()
+	if err != nil {
+		logger.Error("invalid response policy", zap.Error(err))
+		return nil, err
+	}
+	if responsePolicy.policy != "" {
+		logger.Info(fmt.Sprintf("proxy response policy set to %s, quorum %d, json body set to %t",
+			responsePolicy.policy, responsePolicy.quorum, responsePolicy.jsonBody))
+	}
+
+	// persist inbound requests before forwarding, when an outbox directory is set
+	var box *outbox
+	if outboxDir := os.Getenv("SPRAYPROXY_OUTBOX_DIR"); outboxDir != "" {
+		segmentSize := int64(1024 * 1024 * 64)
+		if segmentSizeFromEnv, err := strconv.ParseInt(os.Getenv("SPRAYPROXY_OUTBOX_SEGMENT_SIZE"), 10, 64); err == nil && segmentSizeFromEnv > 0 {
+			segmentSize = segmentSizeFromEnv
+		}
+		box, err = openOutbox(outboxDir, segmentSize, logger)
+		if err != nil {
+			logger.Error("failed to open outbox", zap.Error(err))
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("proxy outbox enabled in %s, segment size set to %d bytes", outboxDir, segmentSize))
+	}
+
+	// accept inbound requests before forwarding them in the background, when asynchronous mode is enabled
+	async, err := asyncForwarderFromEnv()
+	if err != nil {
+		logger.Error("invalid asynchronous mode settings", zap.Error(err))
+		return nil, err
+	}
+	if async != nil {
+		if box != nil {
+			logger.Error("asynchronous mode cannot be combined with the outbox")
+			return nil, errors.New("SPRAYPROXY_ASYNC cannot be combined with SPRAYPROXY_OUTBOX_DIR")
+		}
+		logger.Info(fmt.Sprintf("proxy asynchronous mode enabled with %d workers, queue size set to %d, max results set to %d",
+			async.workers, cap(async.queue), async.maxResults))
+	}
+
+	// keep failed deliveries for redelivery, when a dead letter store size is set
+	var deadLetters *deadLetterStore
+	if maxDeadLetters, err := strconv.Atoi(os.Getenv("SPRAYPROXY_DEAD_LETTER_MAX_ENTRIES")); err == nil && maxDeadLetters > 0 {
+		deadLetters = newDeadLetterStore(maxDeadLetters)
+		logger.Info(fmt.Sprintf("proxy dead letter store enabled, max entries set to %d", maxDeadLetters))
+	}
+
+	dedup, err := dedupCacheFromEnv()
+	if err != nil {
+		logger.Error("invalid deduplication settings", zap.Error(err))
+		return nil, err
+	}
+	if dedup != nil {
+		logger.Info(fmt.Sprintf("proxy deduplication enabled with %s window, %d max entries and %s policy", dedup.ttl, dedup.maxEntries, dedup.policy))
+	}
+
+	breakers, err := circuitBreakersFromEnv(logger)
+	if err != nil {
+		logger.Error("invalid circuit breaker settings", zap.Error(err))
+		return nil, err
+	}
+	if breakers != nil {
+		if breakers.queue() && box == nil {
+			logger.Error("circuit breaker queue action requires the outbox")
+			return nil, errors.New("SPRAYPROXY_CIRCUIT_BREAKER_OPEN_ACTION queue requires SPRAYPROXY_OUTBOX_DIR")
+		}
+		logger.Info(fmt.Sprintf("proxy circuit breakers enabled with %d consecutive failures, %.2f error rate over %d requests, %s open duration and %s action",
+			breakers.config.consecutiveFailures, breakers.config.errorRate, breakers.config.window, breakers.config.openDuration, breakers.config.openAction))
+	}
+
+	health, err := healthCheckerFromEnv(logger)
+	if err != nil {
+		logger.Error("invalid health check settings", zap.Error(err))
+		return nil, err
+	}
+	if health != nil {
+		logger.Info(fmt.Sprintf("proxy health checks enabled every %s with %s timeout, %d rise and %d fall, hold set to %t",
+			health.config.interval, health.config.timeout, health.config.rise, health.config.fall, health.config.hold))
+	}
+
+	registeredBackends := map[string]*v1alpha1.Backend{}
+	for url := range backends {
+		registeredBackends[url] = &v1alpha1.Backend{URL: url, Static: true}
+	}
+	// backends with additional settings, such as routing rules
+	if backendsFile := os.Getenv("SPRAYPROXY_BACKENDS_FILE"); backendsFile != "" {
+		fileBackends, err := loadBackendsFile(backendsFile)
+		if err != nil {
+			logger.Error("failed to load backends file", zap.Error(err))
+			return nil, err
+		}
+		for i := range fileBackends {
+			fileBackends[i].Static = true
+			registeredBackends[fileBackends[i].URL] = &fileBackends[i]
+		}
+		logger.Info(fmt.Sprintf("proxy loaded %d backends from %s", len(fileBackends), backendsFile))
+	}
+
+	// persist the registered backends, when a store is set
+	store, err := backendStoreFromEnv()
+	if err != nil {
+		logger.Error("invalid backends store", zap.Error(err))
+		return nil, err
+	}
+	storeSyncInterval := 30 * time.Second
+	if interval := os.Getenv("SPRAYPROXY_BACKENDS_STORE_SYNC_INTERVAL"); interval != "" {
+		storeSyncInterval, err = time.ParseDuration(interval)
+		if err == nil && storeSyncInterval <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			logger.Error("invalid backends store sync interval", zap.Error(err))
+			return nil, fmt.Errorf("invalid SPRAYPROXY_BACKENDS_STORE_SYNC_INTERVAL %q: %v", interval, err)
+		}
+	}
+
+	// evict the backends whose registration lease expired, can be overriden by SPRAYPROXY_BACKENDS_JANITOR_INTERVAL env var
+	janitorInterval := 10 * time.Second
+	if interval := os.Getenv("SPRAYPROXY_BACKENDS_JANITOR_INTERVAL"); interval != "" {
+		janitorInterval, err = time.ParseDuration(interval)
+		if err == nil && janitorInterval <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			logger.Error("invalid backends janitor interval", zap.Error(err))
+			return nil, fmt.Errorf("invalid SPRAYPROXY_BACKENDS_JANITOR_INTERVAL %q: %v", interval, err)
+		}
+	}
+	logger.Info(fmt.Sprintf("proxy backends janitor interval set to %s", janitorInterval))
+
+	proxy := &SprayProxy{
+		backends:              newBackendRegistry(registeredBackends),
 		insecureTLS:           insecureTLS,
 		insecureWebhook:       insecureWebhook,
 		enableDynamicBackends: enableDynamicBackends,
-		webhookSecret:         webhookSecret,
+		webhookSecrets:        webhookSecrets,
+		backendSecrets:        backendSecrets,
+		sourceAllowlist:       sourceAllowlist,
+		backendTLS:            backendTLS,
+		tlsFiles:              tlsFiles,
+		transports:            newTransports(transportConfig),
+		client:                &http.Client{Timeout: fwdReqTmout},
+		verifiers:             verifiers,
 		logger:                logger,
 		fwdReqTmout:           fwdReqTmout,
 		maxReqSize:            maxReqSize,
-	}, nil
+		maxConcurrentFwd:      maxConcurrentFwd,
+		retryPolicy:           retryPolicy,
+		limits:                limits,
+		outbox:                box,
+		deadLetters:           deadLetters,
+		dedup:                 dedup,
+		store:                 store,
+		storeSyncInterval:     storeSyncInterval,
+		janitorInterval:       janitorInterval,
+		stats:                 newStatsTracker(),
+		breakers:              breakers,
+		health:                health,
+		responsePolicy:        responsePolicy,
+		async:                 async,
+	}
+	if store != nil {
+		if err := proxy.initBackendStore(registeredBackends); err != nil {
+			logger.Error("failed to load stored backends", zap.Error(err), zap.String("store", store.String()))
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("proxy backends stored in %s, reloaded every %s", store, storeSyncInterval))
+	}
+	return proxy, nil
 }
 
 func (p *SprayProxy) HandleProxy(c *gin.Context) {
-	handleProxyCommon(p, c)
+	handleProxyCommon(p, c, nil)
 }
 
 func (p *SprayProxy) HandleProxyEndpoint(c *gin.Context) {
 	// if server post on non root endpoint e.g /proxy
 	// remove /proxy from the copied backend URL
 	c.Request.URL.Path = strings.TrimPrefix(c.Request.URL.Path, "/proxy")
-	handleProxyCommon(p, c)
+	handleProxyCommon(p, c, nil)
+}
+
+// HandleProviderEndpoint proxies the requests posted on /proxy/{provider}, which are verified by
+// the verifier of the provider instead of the detected one.
+func (p *SprayProxy) HandleProviderEndpoint(c *gin.Context) {
+	verifier := p.verifier(c.Param("provider"))
+	if verifier == nil {
+		c.String(http.StatusNotFound, "unknown webhook provider")
+		return
+	}
+	// remove /proxy/{provider} from the copied backend URL
+	c.Request.URL.Path = strings.TrimPrefix(c.Request.URL.Path, "/proxy/"+c.Param("provider"))
+	handleProxyCommon(p, c, verifier)
 }
 
+// Backends returns the URLs of the registered backends.
 func (p *SprayProxy) Backends() []string {
-	backends := []string{}
-	for b, _ := range p.backends {
-		backends = append(backends, b)
+	return p.backends.urls()
+}
+
+// Start launches the background processing of the proxy, which runs until stopCh is closed.
+func (p *SprayProxy) Start(stopCh <-chan struct{}) {
+	go p.watchBackends(stopCh)
+	go p.runJanitor(stopCh)
+	if p.store != nil {
+		go p.runBackendStore(stopCh)
+	}
+	if p.health != nil {
+		go p.runHealthChecks(stopCh)
+	}
+	if p.outbox != nil {
+		go p.runOutbox(stopCh)
+	}
+	if p.async != nil {
+		go p.runAsync(stopCh)
+	}
+	if p.webhookSecrets != nil && len(p.webhookSecrets.files()) > 0 {
+		go p.webhookSecrets.watch(stopCh)
+	}
+	if p.backendSecrets != nil && p.backendSecrets.file != "" {
+		go p.backendSecrets.watch(stopCh)
+	}
+	if p.sourceAllowlist != nil {
+		go p.sourceAllowlist.watch(stopCh)
 	}
-	return backends
 }
 
 // InsecureSkipTLSVerify indicates if the proxy is skipping TLS verification.
@@ -105,11 +415,11 @@ func (p *SprayProxy) InsecureSkipTLSVerify() bool {
 	return p.insecureTLS
 }
 
-// handleProxyCommon handles the core proxying functionality
-func handleProxyCommon(p *SprayProxy, c *gin.Context) {
+// handleProxyCommon handles the core proxying functionality. The request is verified by the given
+// verifier, or by the one detected from the request headers if nil.
+func handleProxyCommon(p *SprayProxy, c *gin.Context, verifier Verifier) {
 	// currently not distinguishing between requests we can parse and those we cannot parse
 	metrics.IncInboundCount()
-	errors := []error{}
 	zapCommonFields := []zapcore.Field{
 		zap.String("method", c.Request.Method),
 		zap.String("path", c.Request.URL.Path),
@@ -119,6 +429,17 @@ func handleProxyCommon(p *SprayProxy, c *gin.Context) {
 		zap.String("request-id", c.GetString("requestId")),
 	}
 
+	// reject requests from outside the allowed ranges before reading them
+	if allowed, err := p.sourceAllowlist.allowed(c.ClientIP()); !allowed {
+		metrics.IncInboundRejectedCount("source_ip")
+		c.String(http.StatusForbidden, "forbidden")
+		if err == nil {
+			err = errors.New("client IP not in the allowed source ranges")
+		}
+		p.logger.Error(fmt.Sprintf("forbidden: %v", err), append(zapCommonFields, zap.String("client-ip", c.ClientIP()))...)
+		return
+	}
+
 	// Body from incoming request can only be read once, store it in a buf for re-use
 	buf := &bytes.Buffer{}
 	// Verify request size. If larger than limit, subsequent read will fail.
@@ -134,104 +455,373 @@ func handleProxyCommon(p *SprayProxy, c *gin.Context) {
 
 	// validate incoming request
 	if !p.insecureWebhook {
-		// restore request body
-		c.Request.Body = io.NopCloser(bytes.NewReader(body))
-		if err := validateWebhookSignature(c.Request, p.webhookSecret); err != nil {
+		if verifier == nil {
+			verifier = p.detectVerifier(c.Request)
+		}
+		zapCommonFields = append(zapCommonFields, zap.String("webhook-provider", verifier.Name()))
+		secret, err := validateWebhookSignatures(c.Request, body, verifier, p.webhookSecrets.get(), time.Now())
+		if err != nil {
 			// we do not want to expose internal information, so returning generic failure message
 			c.String(http.StatusBadRequest, "bad request")
 			p.logger.Error(fmt.Sprintf("bad request: %v", err), zapCommonFields...)
 			return
 		}
+		metrics.IncWebhookSecretMatchCount(verifier.Name(), secret)
+		zapCommonFields = append(zapCommonFields, zap.String("webhook-secret", secret))
 	}
 
-	client := &http.Client{
-		// set forwarding request timeout
-		Timeout: p.fwdReqTmout,
+	deliveryID := c.Request.Header.Get(deliveryHeader)
+	backends, routed := p.route(c.Request, body, zapCommonFields)
+	if !routed {
+		c.String(http.StatusOK, "no matching backends")
+		return
 	}
-	if p.insecureTLS {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+	duplicate := false
+	if p.dedup != nil && deliveryID != "" {
+		var inFlight bool
+		duplicate, inFlight, backends = p.dedupBackends(deliveryID, backends, zapCommonFields)
+		if inFlight {
+			// the first delivery may still fail, the sender should retry once it completed
+			c.String(http.StatusServiceUnavailable, "delivery in progress")
+			return
+		}
+		if duplicate && len(backends) == 0 {
+			c.String(http.StatusOK, "duplicate")
+			return
 		}
 	}
 
-	for backend, _ := range p.backends {
-		fwdErr := ""
-		backendURL, err := url.Parse(backend)
-		if err != nil {
-			p.logger.Error("failed to parse backend "+err.Error(), zapCommonFields...)
-			continue
+	if p.outbox != nil {
+		// the request is accepted once persisted, the outbox workers take care of forwarding it,
+		// without the tokens which are the webhook secrets
+		header := c.Request.Header.Clone()
+		p.stripTokens(header)
+		d := &delivery{
+			ID:         c.GetString("requestId"),
+			DeliveryID: deliveryID,
+			Method:     c.Request.Method,
+			URL:        c.Request.URL.RequestURI(),
+			Header:     header,
+			Body:       body,
+			ReceivedAt: time.Now(),
+		}
+		if duplicate {
+			d.Backends = backends
+		}
+		if err := p.outbox.append(d, p.Backends()); err != nil {
+			if p.dedup != nil && deliveryID != "" {
+				p.dedup.release(deliveryID, backends)
+			}
+			c.String(http.StatusServiceUnavailable, "failed to queue")
+			p.logger.Error("failed to queue request: "+err.Error(), zapCommonFields...)
+			return
+		}
+		if p.dedup != nil && deliveryID != "" {
+			p.dedup.accept(deliveryID, backends)
+		}
+		c.String(http.StatusAccepted, "queued")
+		return
+	}
+	if p.async != nil {
+		p.queueAsync(c, deliveryID, body, backends, zapCommonFields)
+		return
+	}
+
+	client := p.client
+	start := time.Now()
+	results := p.spray(client, c.Request, body, backends, zapCommonFields)
+	p.recordSpray(c.GetString("requestId"), deliveryID, c.Request, body, results, start, zapCommonFields)
+	p.respond(c, results)
+}
+
+// recordSpray records the outcome of the spray for deduplication and in the dead letter store,
+// and logs a summary.
+func (p *SprayProxy) recordSpray(requestID, deliveryID string, req *http.Request, body []byte, results []forwardResult, start time.Time, zapCommonFields []zapcore.Field) {
+	if p.dedup != nil && deliveryID != "" {
+		p.dedup.record(deliveryID, results)
+	}
+	failed := []string{}
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, result.backend)
+		}
+		if result.failed() {
+			p.deadLetter(requestID, req, body, result)
 		}
-		copy := c.Copy()
-		newURL := copy.Request.URL
-		newURL.Host = backendURL.Host
-		newURL.Scheme = backendURL.Scheme
+	}
+	p.logger.Info("spray summary", append(zapCommonFields,
+		zap.Int("backends", len(results)),
+		zap.Int("failed", len(failed)),
+		zap.Strings("failed-backends", failed),
+		zap.Duration("latency", time.Since(start)))...)
+}
 
-		// zap always append and does not override field entries, so we create
-		// per backend list of fields
-		zapBackendFields := append(zapCommonFields, zap.String("backend", newURL.Host))
-		newRequest, err := http.NewRequest(copy.Request.Method, newURL.String(), bytes.NewReader(body))
-		if err != nil {
-			p.logger.Error("failed to create request: "+err.Error(), zapBackendFields...)
-			errors = append(errors, err)
+// route selects the backends the request should be forwarded to, according to their routing
+// rules. Paused backends are skipped. Returns false if the request does not match any backend.
+func (p *SprayProxy) route(req *http.Request, body []byte, zapCommonFields []zapcore.Field) ([]string, bool) {
+	// use a single snapshot, so the routing decision is consistent with concurrent registrations
+	snapshot := p.backends.snapshot()
+	all := make([]string, 0, len(snapshot.urls))
+	for _, backend := range snapshot.urls {
+		if b, _ := snapshot.get(backend); b.Paused {
+			p.logger.Info("skipping paused backend", append(zapCommonFields, zap.String("backend", backend))...)
 			continue
 		}
-		newRequest.Header = copy.Request.Header
+		all = append(all, backend)
+	}
+	if !hasRoutingRules(snapshot) {
+		return append([]string{}, all...), true
+	}
+	event := req.Header.Get("X-GitHub-Event")
+	info, err := parseEventInfo(event, req.Header.Get("Content-Type"), body)
+	if err != nil {
+		// route on the event type only, filters on payload attributes will not match
+		p.logger.Info("routing on event type only: "+err.Error(), zapCommonFields...)
+	}
+	backends := []string{}
+	for _, backend := range all {
+		b, _ := snapshot.get(backend)
+		matched, reason := routeMatches(b.Routing, snapshot.regexes[backend], info)
+		p.logger.Info("routing decision", append(zapCommonFields,
+			zap.String("backend", backend),
+			zap.String("event", event),
+			zap.String("repository", info.Repository),
+			zap.Bool("matched", matched),
+			zap.String("reason", reason))...)
+		if matched {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == 0 && len(all) > 0 {
+		metrics.IncUnroutedCount(event)
+		return backends, false
+	}
+	return backends, true
+}
 
-		// for response time, we are making it "simpler" and including everything in the client.Do call
-		start := time.Now()
-		resp, err := client.Do(newRequest)
-		responseTime := time.Now().Sub(start)
-		// standartize on what ginzap logs
-		zapBackendFields = append(zapBackendFields, zap.Duration("latency", responseTime))
-		if err != nil {
-			fwdErr = "non-http-error"
-			metrics.IncForwardedCount(backendURL.Host, fwdErr)
-			p.logger.Error("proxy error: "+err.Error(), zapBackendFields...)
-			errors = append(errors, err)
-			continue
+// routeMatches checks the event against the routing rules of the backend.
+func (p *SprayProxy) routeMatches(backend string, info *eventInfo) (bool, string) {
+	snapshot := p.backends.snapshot()
+	b, ok := snapshot.get(backend)
+	if !ok {
+		return false, "backend not registered"
+	}
+	return routeMatches(b.Routing, snapshot.regexes[backend], info)
+}
+
+// hasRoutingRules indicates if any backend of the snapshot has routing rules.
+func hasRoutingRules(snapshot *backendSnapshot) bool {
+	for _, b := range snapshot.backends {
+		if b.Routing != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupBackends checks if the delivery was already received, in which case it returns true along
+// with the backends the delivery should be forwarded to again, according to the dedup policy. It
+// also returns true if the duplicate cannot be handled yet, as the delivery is still in flight.
+// The outcome of the forwarded backends must be recorded, or released if the delivery is not
+// accepted.
+func (p *SprayProxy) dedupBackends(deliveryID string, backends []string, zapCommonFields []zapcore.Field) (bool, bool, []string) {
+	duplicate, backends, inFlight := p.dedup.check(deliveryID, backends, time.Now())
+	if !duplicate {
+		return false, false, backends
+	}
+	metrics.IncDuplicateCount(p.dedup.policy)
+	p.logger.Info("duplicate delivery", append(zapCommonFields,
+		zap.String("delivery-id", deliveryID),
+		zap.String("dedup-policy", p.dedup.policy),
+		zap.Bool("in-flight", inFlight),
+		zap.Strings("backends", backends))...)
+	return true, inFlight, backends
+}
+
+// forwardResult holds the outcome of forwarding a request to a single backend.
+type forwardResult struct {
+	backend string
+	status  int
+	latency time.Duration
+	err     error
+}
+
+// failed indicates if the backend did not accept the request.
+func (r forwardResult) failed() bool {
+	return r.err != nil || r.status >= 400
+}
+
+// errorMessage describes why the backend did not accept the request.
+func (r forwardResult) errorMessage() string {
+	if r.err != nil {
+		return r.err.Error()
+	}
+	if r.status >= 400 {
+		return fmt.Sprintf("backend responded with status %d", r.status)
+	}
+	return ""
+}
+
+// spray forwards the request to the backends concurrently, with at most maxConcurrentFwd
+// requests in flight. It blocks until every backend has answered or failed, so the
+// overall latency is bound by the slowest backend. Results are returned in backend order.
+func (p *SprayProxy) spray(client *http.Client, req *http.Request, body []byte, backends []string, zapCommonFields []zapcore.Field) []forwardResult {
+	results := make([]forwardResult, len(backends))
+	sem := make(chan struct{}, p.maxConcurrentFwd)
+	wg := sync.WaitGroup{}
+	for i, backend := range backends {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, backend string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = p.forward(client, req, backend, body, zapCommonFields)
+		}(i, backend)
+	}
+	wg.Wait()
+	return results
+}
+
+// forward sends a copy of the inbound request to a single backend, and records the outcome in
+// the backend statistics.
+func (p *SprayProxy) forward(client *http.Client, req *http.Request, backend string, body []byte, zapCommonFields []zapcore.Field) (result forwardResult) {
+	result = forwardResult{backend: backend}
+	defer func() {
+		// skipped deliveries did not reach the backend
+		if !errors.Is(result.err, errCircuitOpen) && !errors.Is(result.err, errBackendUnhealthy) {
+			p.stats.record(result, time.Now())
+		}
+	}()
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		p.logger.Error("failed to parse backend "+err.Error(), zapCommonFields...)
+		result.err = err
+		return result
+	}
+	// the inbound request is shared by all forwarding goroutines, so build a new URL
+	// instead of modifying it in place
+	var rewrite *v1alpha1.PathRewrite
+	snapshot := p.backends.snapshot()
+	b, ok := snapshot.get(backend)
+	if ok {
+		rewrite = b.PathRewrite
+	}
+	newURL, err := backendRequestURL(backendURL, rewrite, snapshot.regexes[backend], req)
+	if err != nil {
+		p.logger.Error("failed to rewrite path "+err.Error(), append(zapCommonFields, zap.String("backend", backendURL.Host))...)
+		result.err = err
+		return result
+	}
+
+	// zap always append and does not override field entries, so we create
+	// per backend list of fields. Capping the capacity forces append to copy, as the
+	// common fields are shared between goroutines.
+	zapBackendFields := append(zapCommonFields[:len(zapCommonFields):len(zapCommonFields)], zap.String("backend", newURL.Host))
+	header := req.Header.Clone()
+	if b != nil {
+		for name, value := range b.Headers {
+			header.Set(name, value)
 		}
-		defer resp.Body.Close()
-		zapBackendFields = append(zapBackendFields, zap.Int("status", resp.StatusCode))
-		p.logger.Info("proxied request", zapBackendFields...)
-		if resp.StatusCode >= 400 {
-			fwdErr = "http-error"
-			respBody, err := io.ReadAll(resp.Body)
-			if err != nil {
-				p.logger.Info("failed to read response: "+err.Error(), zapBackendFields...)
+	}
+	// backends with their own secret do not get the signature of the webhook secret, and the
+	// others do not get the webhook secret itself, sent as a token by some providers
+	if secret, ok := p.backendSecrets.get(backend, b); ok {
+		p.signRequest(header, body, secret)
+	} else if !p.insecureWebhook {
+		p.stripTokens(header)
+	}
+	client = p.backendClient(client, backend, b)
+	retryPolicy := p.backendRetryPolicy(b)
+
+	if p.health.held(backend) {
+		p.logger.Info("backend unhealthy, holding back request", zapBackendFields...)
+		result.err = errBackendUnhealthy
+		return result
+	}
+	for attempt := 1; ; attempt++ {
+		if !p.breakers.allow(backend, time.Now()) {
+			if attempt == 1 {
+				p.logger.Info("circuit breaker open, skipping backend", zapBackendFields...)
+				result.err = errCircuitOpen
 			} else {
-				p.logger.Info("response body: "+string(respBody), zapBackendFields...)
+				p.logger.Info("circuit breaker open, giving up", append(zapBackendFields, zap.Int("attempt", attempt-1))...)
 			}
+			return result
+		}
+		var retryAfter time.Duration
+		result, retryAfter = p.forwardAttempt(req.Context(), client, req.Method, newURL.String(), header, body, attempt, zapBackendFields)
+		result.backend = backend
+		p.breakers.record(backend, result, time.Now())
+		if attempt >= retryPolicy.MaxAttempts || !retryPolicy.retryable(result.status, result.err) {
+			return result
+		}
+		backoff, ok := retryPolicy.backoff(attempt+1, retryAfter)
+		if !ok {
+			p.logger.Info("backend requested a retry after the max backoff, giving up", append(zapBackendFields,
+				zap.Int("attempt", attempt), zap.Duration("retry-after", retryAfter))...)
+			return result
+		}
+		p.logger.Info("retrying request", append(zapBackendFields,
+			zap.Int("attempt", attempt), zap.Duration("backoff", backoff))...)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			p.logger.Info("inbound request canceled, giving up", append(zapBackendFields, zap.Int("attempt", attempt))...)
+			return result
+		case <-timer.C:
+		}
+	}
+}
+
+// forwardAttempt makes a single attempt to forward the request to a backend. Besides the
+// result, it returns the wait time requested by the backend through the Retry-After header.
+// The attempt is abandoned once ctx is canceled, the asynchronous and outbox deliveries pass a
+// context detached from the inbound request.
+func (p *SprayProxy) forwardAttempt(ctx context.Context, client *http.Client, method, url string, header http.Header, body []byte, attempt int, zapBackendFields []zapcore.Field) (forwardResult, time.Duration) {
+	result := forwardResult{}
+	fwdErr := ""
+	zapBackendFields = append(zapBackendFields[:len(zapBackendFields):len(zapBackendFields)], zap.Int("attempt", attempt))
+	newRequest, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		p.logger.Error("failed to create request: "+err.Error(), zapBackendFields...)
+		result.err = err
+		return result, 0
+	}
+	newRequest.Header = header.Clone()
+	host := newRequest.URL.Host
+
+	// for response time, we are making it "simpler" and including everything in the client.Do call
+	start := time.Now()
+	resp, err := client.Do(traceConnections(newRequest))
+	result.latency = time.Since(start)
+	// standartize on what ginzap logs
+	zapBackendFields = append(zapBackendFields, zap.Duration("latency", result.latency))
+	if err != nil {
+		fwdErr = "non-http-error"
+		metrics.IncForwardedCount(host, fwdErr, attempt)
+		p.logger.Error("proxy error: "+err.Error(), zapBackendFields...)
+		result.err = err
+		return result, 0
+	}
+	defer resp.Body.Close()
+	result.status = resp.StatusCode
+	zapBackendFields = append(zapBackendFields, zap.Int("status", resp.StatusCode))
+	p.logger.Info("proxied request", zapBackendFields...)
+	if resp.StatusCode >= 400 {
+		fwdErr = "http-error"
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			p.logger.Info("failed to read response: "+err.Error(), zapBackendFields...)
+		} else {
+			p.logger.Info("response body: "+string(respBody), zapBackendFields...)
 		}
-		metrics.IncForwardedCount(backendURL.Host, fwdErr)
-		metrics.AddForwardedResponseTime(responseTime.Seconds())
-
-		// // Create a new request with a disconnected context
-		// newRequest := copy.Request.Clone(context.Background())
-		// // Deep copy the request body since this needs to be read multiple times
-		// newRequest.Body = io.NopCloser(bytes.NewReader(body))
-
-		// proxy := httputil.NewSingleHostReverseProxy(backendURL)
-		// proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
-		// 	errors = append(errors, err)
-		// 	rw.WriteHeader(http.StatusBadGateway)
-		// }
-		// if p.insecureTLS {
-		// 	proxy.Transport = &http.Transport{
-		// 		TLSClientConfig: &tls.Config{
-		// 			InsecureSkipVerify: true,
-		// 		},
-		// 	}
-		// }
-		// doProxy(backend, proxy, newRequest)
-	}
-	if len(errors) > 0 {
-		// we have a bad gateway/connection somewhere
-		c.String(http.StatusBadGateway, "failed to proxy")
-		return
 	}
-	c.String(http.StatusOK, "proxied")
+	// drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	metrics.IncForwardedCount(host, fwdErr, attempt)
+	metrics.AddForwardedResponseTime(result.latency.Seconds())
+	return result, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
 }
 
 // doProxy proxies the provided request to a backend, with response data to an "empty" response instance.
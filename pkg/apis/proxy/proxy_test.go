@@ -7,12 +7,14 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redhat-appstudio/sprayproxy/test"
@@ -76,8 +78,8 @@ func TestProxyWebhookSecret(t *testing.T) {
 	if err != nil {
 		t.Errorf("Unexpected error %q", err)
 	}
-	if p.webhookSecret != secret {
-		t.Errorf("Expected secret %q, got %q", secret, p.webhookSecret)
+	if secrets := p.webhookSecrets.get(); len(secrets) != 1 || secrets[0].Secret != secret {
+		t.Errorf("Expected secret %q, got %+v", secret, secrets)
 	}
 }
 
@@ -150,6 +152,72 @@ func TestHandleProxyMultiBackend(t *testing.T) {
 	}
 }
 
+func TestHandleProxyConcurrentBackends(t *testing.T) {
+	delay := 500 * time.Millisecond
+	testBackend := map[string]string{}
+	for i := 0; i < 4; i++ {
+		backend := test.NewSlowTestServer(delay)
+		defer backend.GetServer().Close()
+		testBackend[backend.GetServer().URL] = ""
+	}
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), testBackend)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	start := time.Now()
+	proxy.HandleProxy(ctx)
+	elapsed := time.Since(start)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	// sequential forwarding would take at least 4 times the delay
+	if elapsed >= 2*delay {
+		t.Errorf("expected backends to be sprayed concurrently in less than %s, took %s", 2*delay, elapsed)
+	}
+}
+
+func TestHandleProxyCanceled(t *testing.T) {
+	delay := 2 * time.Second
+	backend := test.NewSlowTestServer(delay)
+	defer backend.GetServer().Close()
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{backend.GetServer().URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	reqCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest().WithContext(reqCtx)
+	start := time.Now()
+	proxy.HandleProxy(ctx)
+	// the attempt is abandoned with the inbound request
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("expected the forward to stop with the canceled request, took %s", elapsed)
+	}
+}
+
+func TestProxyMaxConcurrentForwards(t *testing.T) {
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if proxy.maxConcurrentFwd != 16 {
+		t.Errorf("expected default max concurrent forwards %d, got %d", 16, proxy.maxConcurrentFwd)
+	}
+	t.Setenv("SPRAYPROXY_MAX_CONCURRENT_FORWARDS", "2")
+	proxy, err = NewSprayProxy(false, true, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if proxy.maxConcurrentFwd != 2 {
+		t.Errorf("expected max concurrent forwards %d, got %d", 2, proxy.maxConcurrentFwd)
+	}
+}
+
 func TestLargePayloadOnLimit(t *testing.T) {
 	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), nil)
 	if err != nil {
@@ -1,23 +1,108 @@
 package proxy
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"github.com/redhat-appstudio/sprayproxy/pkg/auth"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
 )
 
-// GetBackends gives the list of backend servers available to be proxied
+// backendsGenerationHeader holds the generation of the backend registry in the GetBackends response
+const backendsGenerationHeader = "X-Backends-Generation"
+
+// GetBackends gives the list of backend servers available to be proxied, along with their
+// forwarding statistics. The plain text list of URLs is returned with the format=text query.
 func (p *SprayProxy) GetBackends(c *gin.Context) {
-	backendUrls := ""
-	for backend := range p.backends {
-		backendUrls += backend + ", "
+	snapshot := p.backends.snapshot()
+	c.Header(backendsGenerationHeader, strconv.FormatUint(snapshot.generation, 10))
+	switch c.Query("format") {
+	case "", "json":
+	case "text":
+		c.String(http.StatusOK, "Backend urls: "+strings.Join(snapshot.urls, ", "))
+		return
+	default:
+		c.String(http.StatusBadRequest, "unsupported format, expected json or text")
+		return
+	}
+	list := v1alpha1.BackendList{Generation: snapshot.generation, Items: []v1alpha1.BackendStatus{}}
+	for _, url := range snapshot.urls {
+		b, _ := snapshot.get(url)
+		list.Items = append(list.Items, p.backendStatus(b))
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// GetBackend gives a single backend server by ID, along with its forwarding statistics.
+func (p *SprayProxy) GetBackend(c *gin.Context) {
+	snapshot := p.backends.snapshot()
+	c.Header(backendsGenerationHeader, strconv.FormatUint(snapshot.generation, 10))
+	b, ok := findBackend(snapshot, c.Param("id"))
+	if !ok {
+		c.String(http.StatusNotFound, "backend server not found in the list")
+		return
+	}
+	c.JSON(http.StatusOK, p.backendStatus(b))
+}
+
+// redactedHeaderValue replaces the values of the backend headers in the API responses, as they
+// may hold credentials.
+const redactedHeaderValue = "<redacted>"
+
+func (p *SprayProxy) backendStatus(b *v1alpha1.Backend) v1alpha1.BackendStatus {
+	status := v1alpha1.BackendStatus{Backend: *b, ID: backendID(b), CircuitState: p.breakers.state(b.URL),
+		Health: p.health.status(b.URL), Stats: p.stats.get(b.URL)}
+	if len(b.Headers) > 0 {
+		status.Headers = map[string]string{}
+		for name := range b.Headers {
+			status.Headers[name] = redactedHeaderValue
+		}
 	}
-	backendUrls = strings.TrimSuffix(backendUrls, ", ")
-	c.String(http.StatusOK, "Backend urls: "+backendUrls)
+	return status
+}
+
+// callerFields identify the caller of the registration API in the audit logs.
+func callerFields(c *gin.Context) []zapcore.Field {
+	identity := auth.IdentityFromContext(c)
+	if identity == nil {
+		return []zapcore.Field{zap.String("caller", "anonymous")}
+	}
+	return []zapcore.Field{zap.String("caller", identity.Name), zap.String("auth-method", identity.Method)}
+}
+
+// loadBackendsFile reads a list of backends from a YAML or JSON file.
+func loadBackendsFile(path string) ([]v1alpha1.Backend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	backends, err := decodeBackends(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse backends file %s: %v", path, err)
+	}
+	return backends, nil
+}
+
+// unmarshalYAMLOrJSON decodes YAML or JSON data into v, honoring its json struct tags.
+func unmarshalYAMLOrJSON(data []byte, v any) error {
+	var generic any
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonData, v)
 }
 
 // RegisterBackend registers the backend server to be proxied
@@ -27,7 +112,9 @@ func (p *SprayProxy) RegisterBackend(c *gin.Context) {
 		zap.String("path", c.Request.URL.Path),
 		zap.String("query", c.Request.URL.RawQuery),
 		zap.Bool("dynamic-backends", p.enableDynamicBackends),
+		zap.String("request-id", c.GetString("requestId")),
 	}
+	zapCommonFields = append(zapCommonFields, callerFields(c)...)
 	var newUrl v1alpha1.Backend
 	if err := c.ShouldBindJSON(&newUrl); err != nil {
 		c.String(http.StatusBadRequest, "please provide a valid json body")
@@ -35,11 +122,36 @@ func (p *SprayProxy) RegisterBackend(c *gin.Context) {
 		return
 	}
 	zapCommonFields = append(zapCommonFields, zap.String("backend", newUrl.URL))
-	if _, ok := p.backends[newUrl.URL]; !ok {
-		if p.backends == nil {
-			p.backends = map[string]string{}
-		}
-		p.backends[newUrl.URL] = ""
+	if err := validateBackend(&newUrl); err != nil {
+		c.String(http.StatusBadRequest, "invalid backend: "+err.Error())
+		p.logger.Info("backend server register request to proxy is rejected, invalid backend: "+err.Error(), zapCommonFields...)
+		return
+	}
+	if err := p.limits.validate(&newUrl); err != nil {
+		c.String(http.StatusBadRequest, "invalid backend: "+err.Error())
+		p.logger.Info("backend server register request to proxy is rejected, invalid backend: "+err.Error(), zapCommonFields...)
+		return
+	}
+	// the timestamps, lease and static marker are set by the proxy, whatever the client sent
+	now := time.Now().UTC()
+	newUrl.CreatedAt, newUrl.UpdatedAt = &now, &now
+	newUrl.Static = false
+	newUrl.ExpiresAt = leaseExpiry(&newUrl, now)
+	if newUrl.ExpiresAt != nil {
+		zapCommonFields = append(zapCommonFields, zap.Time("expires-at", *newUrl.ExpiresAt))
+	}
+	added, conflict, err := p.addBackend(&newUrl)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to persist backend")
+		p.logger.Error("failed to persist backend: "+err.Error(), zapCommonFields...)
+		return
+	}
+	if conflict != "" {
+		c.String(http.StatusConflict, "backend name already used by "+conflict)
+		p.logger.Info("backend server register request to proxy is rejected, name already used", append(zapCommonFields, zap.String("name", newUrl.Name))...)
+		return
+	}
+	if added {
 		c.String(http.StatusOK, "registered the backend server")
 		p.logger.Info("server registered", zapCommonFields...)
 		return
@@ -48,6 +160,82 @@ func (p *SprayProxy) RegisterBackend(c *gin.Context) {
 	p.logger.Info("server already registered", zapCommonFields...)
 }
 
+// UpdateBackend replaces the settings of a registered backend server. The lease is restarted if
+// the TTL is changed.
+func (p *SprayProxy) UpdateBackend(c *gin.Context) {
+	zapCommonFields := []zapcore.Field{
+		zap.String("method", c.Request.Method),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("query", c.Request.URL.RawQuery),
+		zap.Bool("dynamic-backends", p.enableDynamicBackends),
+		zap.String("request-id", c.GetString("requestId")),
+	}
+	zapCommonFields = append(zapCommonFields, callerFields(c)...)
+	var updated v1alpha1.Backend
+	if err := c.ShouldBindJSON(&updated); err != nil {
+		c.String(http.StatusBadRequest, "please provide a valid json body")
+		p.logger.Info("update request is rejected, invalid json body", zapCommonFields...)
+		return
+	}
+	zapCommonFields = append(zapCommonFields, zap.String("backend", updated.URL))
+	if err := validateBackend(&updated); err != nil {
+		c.String(http.StatusBadRequest, "invalid backend: "+err.Error())
+		p.logger.Info("update request is rejected, invalid backend: "+err.Error(), zapCommonFields...)
+		return
+	}
+	if err := p.limits.validate(&updated); err != nil {
+		c.String(http.StatusBadRequest, "invalid backend: "+err.Error())
+		p.logger.Info("update request is rejected, invalid backend: "+err.Error(), zapCommonFields...)
+		return
+	}
+	found, static, conflict := false, false, ""
+	_, err := p.updateBackend(updated.URL, func(existing *v1alpha1.Backend, backends map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool) {
+		if found = existing != nil; !found {
+			return nil, false
+		}
+		// the changes of static backends would be reverted on restart
+		if static = existing.Static; static {
+			return nil, false
+		}
+		if url, ok := backendNameConflict(backends, &updated); ok {
+			conflict = url
+			return nil, false
+		}
+		next := updated
+		// redacted header values, as returned by GetBackends, keep their current value
+		for name, value := range next.Headers {
+			if existingValue, ok := existing.Headers[name]; ok && value == redactedHeaderValue {
+				next.Headers[name] = existingValue
+			}
+		}
+		now := time.Now().UTC()
+		next.CreatedAt, next.UpdatedAt = existing.CreatedAt, &now
+		next.Static = false
+		next.ExpiresAt = existing.ExpiresAt
+		if next.TTL != existing.TTL {
+			next.ExpiresAt = leaseExpiry(&next, now)
+		}
+		return &next, true
+	})
+	switch {
+	case err != nil:
+		c.String(http.StatusInternalServerError, "failed to persist backend")
+		p.logger.Error("failed to persist backend: "+err.Error(), zapCommonFields...)
+	case !found:
+		c.String(http.StatusNotFound, "backend server not found in the list")
+		p.logger.Info("update request is rejected, server not registered", zapCommonFields...)
+	case static:
+		c.String(http.StatusConflict, "static backend cannot be changed, update the proxy configuration instead")
+		p.logger.Info("update request is rejected, static backend", zapCommonFields...)
+	case conflict != "":
+		c.String(http.StatusConflict, "backend name already used by "+conflict)
+		p.logger.Info("update request is rejected, name already used", append(zapCommonFields, zap.String("name", updated.Name))...)
+	default:
+		c.String(http.StatusOK, "backend server updated")
+		p.logger.Info("server updated", zapCommonFields...)
+	}
+}
+
 // UnregisterBackend removes the backend server from the list of backend
 // so that it should not be proxied anymore
 func (p *SprayProxy) UnregisterBackend(c *gin.Context) {
@@ -56,7 +244,9 @@ func (p *SprayProxy) UnregisterBackend(c *gin.Context) {
 		zap.String("path", c.Request.URL.Path),
 		zap.String("query", c.Request.URL.RawQuery),
 		zap.Bool("dynamic-backends", p.enableDynamicBackends),
+		zap.String("request-id", c.GetString("requestId")),
 	}
+	zapCommonFields = append(zapCommonFields, callerFields(c)...)
 	var unregisterUrl v1alpha1.Backend
 	if err := c.ShouldBindJSON(&unregisterUrl); err != nil {
 		c.String(http.StatusBadRequest, "please provide a valid json body")
@@ -64,12 +254,29 @@ func (p *SprayProxy) UnregisterBackend(c *gin.Context) {
 		return
 	}
 	zapCommonFields = append(zapCommonFields, zap.String("backend", unregisterUrl.URL))
-	if _, ok := p.backends[unregisterUrl.URL]; !ok {
+	static := false
+	removed, err := p.updateBackend(unregisterUrl.URL, func(existing *v1alpha1.Backend, _ map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool) {
+		// the static backends would be registered again on restart
+		if static = existing != nil && existing.Static; static {
+			return nil, false
+		}
+		return nil, existing != nil
+	})
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to persist backend")
+		p.logger.Error("failed to persist backend: "+err.Error(), zapCommonFields...)
+		return
+	}
+	if static {
+		c.String(http.StatusConflict, "static backend cannot be changed, update the proxy configuration instead")
+		p.logger.Info("unregister request is rejected, static backend", zapCommonFields...)
+		return
+	}
+	if !removed {
 		c.String(http.StatusNotFound, "backend server not found in the list")
-		p.logger.Info("server not registered")
+		p.logger.Info("server not registered", zapCommonFields...)
 		return
 	}
-	delete(p.backends, unregisterUrl.URL)
 	c.String(http.StatusOK, "backend server unregistered")
 	p.logger.Info("server unregistered", zapCommonFields...)
 }
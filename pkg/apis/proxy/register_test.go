@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"bytes"
-	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -41,13 +40,43 @@ func TestGetBackend(t *testing.T) {
 	}
 }
 
+func TestGetBackendsRedactsHeaders(t *testing.T) {
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	body := `{"url":"http://cluster-a","headers":{"Authorization":"Bearer secret-token"}}`
+	if w := sendBackendRequest(proxy.RegisterBackend, body); w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/backends", nil)
+	proxy.GetBackends(ctx)
+	responseBody := w.Body.String()
+	if strings.Contains(responseBody, "secret-token") {
+		t.Errorf("expected header value to be redacted in %q", responseBody)
+	}
+	if !strings.Contains(responseBody, `"Authorization":"\u003credacted\u003e"`) {
+		t.Errorf("expected redacted header in %q", responseBody)
+	}
+	// updates sending back the redacted value keep the current one
+	body = `{"url":"http://cluster-a","owner":"build-team","headers":{"Authorization":"<redacted>"}}`
+	if w := sendBackendRequest(proxy.UpdateBackend, body); w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if b, _ := proxy.backends.get("http://cluster-a"); b.Headers["Authorization"] != "Bearer secret-token" {
+		t.Errorf("expected header value to be kept by the proxy, got %q", b.Headers["Authorization"])
+	}
+}
+
 func TestRegisterBackend(t *testing.T) {
 	backend1 := test.NewTestServer()
 	defer backend1.GetServer().Close()
 	testBackend := map[string]string{
 		backend1.GetServer().URL: "",
 	}
-	body, _ := json.Marshal(testBackend)
+	body := []byte(`{"url":"https://test.com"}`)
 	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), testBackend)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -110,7 +139,7 @@ func TestUnRegisterBackend(t *testing.T) {
 	testBackend := map[string]string{
 		backend1.GetServer().URL: "",
 	}
-	body, _ := json.Marshal(testBackend)
+	body := []byte(`{"url":"https://test.com"}`)
 	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), testBackend)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -0,0 +1,268 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// backendEventType is the kind of change made to the backend registry.
+type backendEventType string
+
+const (
+	backendAdded   backendEventType = "added"
+	backendRemoved backendEventType = "removed"
+	backendUpdated backendEventType = "updated"
+)
+
+// backendEvent describes a change made to the backend registry. The generation is the one of
+// the registry after the change, so subscribers can detect missed events.
+type backendEvent struct {
+	Type       backendEventType
+	Backend    *v1alpha1.Backend
+	Generation uint64
+}
+
+// backendSnapshot is an immutable view of the registered backends. It must not be modified.
+type backendSnapshot struct {
+	generation uint64
+	backends   map[string]*v1alpha1.Backend
+	// urls holds the backend URLs in sorted order
+	urls []string
+	// regexes holds the compiled regular expressions of every backend, keyed by URL
+	regexes map[string]backendRegexes
+}
+
+func newBackendSnapshot(generation uint64, backends map[string]*v1alpha1.Backend) *backendSnapshot {
+	return (*backendSnapshot)(nil).next(generation, backends)
+}
+
+// next returns the snapshot of the backends following this one. The regular expressions of the
+// backends which did not change are not compiled again.
+func (s *backendSnapshot) next(generation uint64, backends map[string]*v1alpha1.Backend) *backendSnapshot {
+	urls := make([]string, 0, len(backends))
+	regexes := make(map[string]backendRegexes, len(backends))
+	for url, b := range backends {
+		urls = append(urls, url)
+		if s != nil && s.backends[url] == b {
+			regexes[url] = s.regexes[url]
+		} else {
+			regexes[url] = compileBackendRegexes(b)
+		}
+	}
+	sort.Strings(urls)
+	return &backendSnapshot{generation: generation, backends: backends, urls: urls, regexes: regexes}
+}
+
+// get returns the backend registered with the URL.
+func (s *backendSnapshot) get(url string) (*v1alpha1.Backend, bool) {
+	b, ok := s.backends[url]
+	return b, ok
+}
+
+// backendRegistry holds the backends requests are forwarded to. Readers get a consistent
+// snapshot without locking, writers copy the snapshot and replace it. Every change increments
+// the generation number and is sent to the subscribers.
+type backendRegistry struct {
+	// mu serializes the writers and protects the subscribers
+	mu          sync.Mutex
+	current     atomic.Pointer[backendSnapshot]
+	subscribers map[chan backendEvent]struct{}
+}
+
+func newBackendRegistry(backends map[string]*v1alpha1.Backend) *backendRegistry {
+	r := &backendRegistry{subscribers: map[chan backendEvent]struct{}{}}
+	initial := make(map[string]*v1alpha1.Backend, len(backends))
+	for url, b := range backends {
+		initial[url] = b
+	}
+	r.current.Store(newBackendSnapshot(0, initial))
+	return r
+}
+
+// snapshot returns the current view of the registered backends.
+func (r *backendRegistry) snapshot() *backendSnapshot {
+	return r.current.Load()
+}
+
+// get returns the backend registered with the URL.
+func (r *backendRegistry) get(url string) (*v1alpha1.Backend, bool) {
+	return r.snapshot().get(url)
+}
+
+// urls returns the registered backend URLs in sorted order.
+func (r *backendRegistry) urls() []string {
+	return append([]string{}, r.snapshot().urls...)
+}
+
+// generation returns the number of changes made to the registry.
+func (r *backendRegistry) generation() uint64 {
+	return r.snapshot().generation
+}
+
+// backendChange changes a single backend. It gets the registered backend, nil if none, along with
+// all the registered backends by URL, and returns the new backend, nil to remove it, along with
+// false if there is nothing to change. Backends must not be modified in place, the change returns
+// a new backend instead.
+type backendChange func(existing *v1alpha1.Backend, backends map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool)
+
+// update applies the change to the backend registered with the URL. It returns false if there
+// was nothing to change.
+func (r *backendRegistry) update(url string, change backendChange) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot := r.snapshot()
+	existing, _ := snapshot.get(url)
+	next, ok := change(existing, snapshot.backends)
+	switch {
+	case !ok || (existing == nil && next == nil):
+		return false
+	case existing == nil:
+		r.set(url, next, backendAdded)
+	case next == nil:
+		r.set(url, nil, backendRemoved)
+	default:
+		r.set(url, next, backendUpdated)
+	}
+	return true
+}
+
+// add registers the backend, unless a backend with the same URL is already registered.
+// The backend must not be modified once added.
+func (r *backendRegistry) add(b *v1alpha1.Backend) bool {
+	return r.update(b.URL, func(existing *v1alpha1.Backend, _ map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool) {
+		return b, existing == nil
+	})
+}
+
+// remove unregisters the backend with the URL, if registered.
+func (r *backendRegistry) remove(url string) bool {
+	return r.update(url, func(existing *v1alpha1.Backend, _ map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool) {
+		return nil, existing != nil
+	})
+}
+
+// replace sets the registered backends, for example when reloaded from a store. Every added,
+// removed or updated backend is a separate change.
+func (r *backendRegistry) replace(backends map[string]*v1alpha1.Backend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	urls := make([]string, 0, len(backends))
+	for url := range backends {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range r.snapshot().urls {
+		if _, ok := backends[url]; !ok {
+			r.set(url, nil, backendRemoved)
+		}
+	}
+	for _, url := range urls {
+		existing, ok := r.snapshot().get(url)
+		switch {
+		case !ok:
+			r.set(url, backends[url], backendAdded)
+		case !backendsEqual(existing, backends[url]):
+			r.set(url, backends[url], backendUpdated)
+		}
+	}
+}
+
+// set adds, updates or removes (when b is nil) a single backend. It must be called with the
+// lock held.
+func (r *backendRegistry) set(url string, b *v1alpha1.Backend, eventType backendEventType) {
+	current := r.snapshot()
+	backends := make(map[string]*v1alpha1.Backend, len(current.backends)+1)
+	for u, existing := range current.backends {
+		backends[u] = existing
+	}
+	event := b
+	if b == nil {
+		event = backends[url]
+		delete(backends, url)
+	} else {
+		backends[url] = b
+	}
+	r.commit(current.next(current.generation+1, backends), eventType, event)
+}
+
+// backendsEqual indicates if the backends have the same settings.
+func backendsEqual(a, b *v1alpha1.Backend) bool {
+	aData, _ := json.Marshal(a)
+	bData, _ := json.Marshal(b)
+	return string(aData) == string(bData)
+}
+
+// commit replaces the current snapshot and notifies the subscribers. It must be called with
+// the lock held.
+func (r *backendRegistry) commit(next *backendSnapshot, eventType backendEventType, b *v1alpha1.Backend) {
+	r.current.Store(next)
+	event := backendEvent{Type: eventType, Backend: b, Generation: next.generation}
+	for ch := range r.subscribers {
+		// never block the writers on a slow subscriber, which can detect the missed event
+		// from the generation number and resynchronize from a snapshot
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// watch subscribes to the registry changes. Events are buffered up to the given size, and
+// dropped when the buffer is full. The returned function cancels the subscription.
+func (r *backendRegistry) watch(buffer int) (<-chan backendEvent, func()) {
+	ch := make(chan backendEvent, buffer)
+	r.mu.Lock()
+	r.subscribers[ch] = struct{}{}
+	r.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.subscribers, ch)
+			r.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// watchBackends logs the changes made to the backend registry and reports them in the metrics,
+// until stopCh is closed.
+func (p *SprayProxy) watchBackends(stopCh <-chan struct{}) {
+	events, cancel := p.backends.watch(16)
+	defer cancel()
+	snapshot := p.backends.snapshot()
+	metrics.SetBackends(len(snapshot.urls), snapshot.generation)
+	last := snapshot.generation
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event := <-events:
+			if event.Generation > last+1 {
+				p.logger.Info("missed backend registry changes", zap.Uint64("generation", last),
+					zap.Uint64("event-generation", event.Generation))
+			}
+			if event.Generation > last {
+				last = event.Generation
+			}
+			p.logger.Info("backend registry changed", zap.String("change", string(event.Type)),
+				zap.String("backend", event.Backend.URL), zap.Uint64("generation", event.Generation))
+			snapshot = p.backends.snapshot()
+			metrics.SetBackends(len(snapshot.urls), snapshot.generation)
+			p.stats.prune(snapshot)
+			p.breakers.prune(snapshot)
+			p.transports.prune(snapshot)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+func TestBackendRegistry(t *testing.T) {
+	registry := newBackendRegistry(map[string]*v1alpha1.Backend{"http://b": {URL: "http://b"}})
+	events, cancel := registry.watch(10)
+	before := registry.snapshot()
+
+	if !registry.add(&v1alpha1.Backend{URL: "http://a"}) {
+		t.Errorf("expected backend to be added")
+	}
+	if registry.add(&v1alpha1.Backend{URL: "http://a"}) {
+		t.Errorf("expected duplicate backend not to be added")
+	}
+	if !registry.remove("http://b") {
+		t.Errorf("expected backend to be removed")
+	}
+	if registry.remove("http://b") {
+		t.Errorf("expected unknown backend not to be removed")
+	}
+
+	if urls := registry.urls(); len(urls) != 1 || urls[0] != "http://a" {
+		t.Errorf("expected backends [http://a], got %v", urls)
+	}
+	if registry.generation() != 2 {
+		t.Errorf("expected generation %d, got %d", 2, registry.generation())
+	}
+	if len(before.urls) != 1 || before.urls[0] != "http://b" || before.generation != 0 {
+		t.Errorf("expected snapshot to be unchanged, got %v at generation %d", before.urls, before.generation)
+	}
+
+	for _, expected := range []backendEvent{
+		{Type: backendAdded, Generation: 1},
+		{Type: backendRemoved, Generation: 2},
+	} {
+		event := <-events
+		if event.Type != expected.Type || event.Generation != expected.Generation {
+			t.Errorf("expected %s event at generation %d, got %s at %d", expected.Type, expected.Generation, event.Type, event.Generation)
+		}
+	}
+	cancel()
+	cancel()
+	registry.add(&v1alpha1.Backend{URL: "http://c"})
+	if _, ok := <-events; ok {
+		t.Errorf("expected no events after the subscription is cancelled")
+	}
+}
+
+func TestBackendRegistrySlowSubscriber(t *testing.T) {
+	registry := newBackendRegistry(nil)
+	events, cancel := registry.watch(1)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		registry.add(&v1alpha1.Backend{URL: fmt.Sprintf("http://%d", i)})
+	}
+	if event := <-events; event.Generation != 1 {
+		t.Errorf("expected buffered event at generation %d, got %d", 1, event.Generation)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("expected events to be dropped once the buffer is full, got %+v", event)
+	default:
+	}
+}
+
+// TestBackendRegistryConcurrency registers and unregisters backends while requests are
+// forwarded to them. It is meant to be run with the race detector.
+func TestBackendRegistryConcurrency(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{backend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go proxy.watchBackends(stopCh)
+
+	const workers, iterations = 4, 50
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				body := fmt.Sprintf(`{"url":"%s/%d/%d"}`, backend.URL, w, i)
+				for _, handler := range []gin.HandlerFunc{proxy.RegisterBackend, proxy.UnregisterBackend} {
+					ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+					ctx.Request = httptest.NewRequest(http.MethodPost, "/backends", bytes.NewBufferString(body))
+					handler(ctx)
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				w := httptest.NewRecorder()
+				ctx, _ := gin.CreateTestContext(w)
+				ctx.Request = newProxyRequest()
+				proxy.HandleProxyEndpoint(ctx)
+				if w.Code != http.StatusOK {
+					t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+				ctx.Request = httptest.NewRequest(http.MethodGet, "/backends", nil)
+				proxy.GetBackends(ctx)
+				proxy.Backends()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if urls := proxy.Backends(); len(urls) != 1 || urls[0] != backend.URL {
+		t.Errorf("expected backends [%s], got %v", backend.URL, urls)
+	}
+	if generation := proxy.backends.generation(); generation != 2*workers*iterations {
+		t.Errorf("expected generation %d, got %d", 2*workers*iterations, generation)
+	}
+}
+
+func TestBackendRegistryReplace(t *testing.T) {
+	registry := newBackendRegistry(map[string]*v1alpha1.Backend{
+		"http://a": {URL: "http://a"},
+		"http://b": {URL: "http://b"},
+	})
+	events, cancel := registry.watch(10)
+	defer cancel()
+	registry.replace(map[string]*v1alpha1.Backend{
+		"http://a": {URL: "http://a"},
+		"http://b": {URL: "http://b", PathRewrite: &v1alpha1.PathRewrite{StripPrefix: "/github"}},
+		"http://c": {URL: "http://c"},
+	})
+	registry.replace(map[string]*v1alpha1.Backend{"http://c": {URL: "http://c"}})
+	for i, expected := range []backendEvent{
+		{Type: backendUpdated, Backend: &v1alpha1.Backend{URL: "http://b"}},
+		{Type: backendAdded, Backend: &v1alpha1.Backend{URL: "http://c"}},
+		{Type: backendRemoved, Backend: &v1alpha1.Backend{URL: "http://a"}},
+		{Type: backendRemoved, Backend: &v1alpha1.Backend{URL: "http://b"}},
+	} {
+		event := <-events
+		if event.Type != expected.Type || event.Backend.URL != expected.Backend.URL || event.Generation != uint64(i+1) {
+			t.Errorf("expected %s event for %s at generation %d, got %s for %s at %d", expected.Type, expected.Backend.URL, i+1,
+				event.Type, event.Backend.URL, event.Generation)
+		}
+	}
+}
+
+func TestBackendSnapshotRegexes(t *testing.T) {
+	routed := &v1alpha1.Backend{URL: "http://a", Routing: &v1alpha1.RoutingRules{
+		Include: []v1alpha1.EventFilter{{RepositoryRegexes: []string{"^my-org/.*$"}}},
+	}}
+	rewritten := &v1alpha1.Backend{URL: "http://b", PathRewrite: &v1alpha1.PathRewrite{
+		Replace: &v1alpha1.PathReplace{Pattern: "^/v1/", Replacement: "/v2/"},
+	}}
+	registry := newBackendRegistry(map[string]*v1alpha1.Backend{routed.URL: routed, rewritten.URL: rewritten})
+	before := registry.snapshot()
+	if before.regexes[routed.URL]["^my-org/.*$"] == nil || before.regexes[rewritten.URL]["^/v1/"] == nil {
+		t.Fatalf("expected the regular expressions to be compiled, got %v", before.regexes)
+	}
+
+	// unchanged backends keep their compiled regular expressions
+	registry.add(&v1alpha1.Backend{URL: "http://c"})
+	after := registry.snapshot()
+	if after.regexes[routed.URL]["^my-org/.*$"] != before.regexes[routed.URL]["^my-org/.*$"] {
+		t.Errorf("expected the regular expressions of unchanged backends to be reused")
+	}
+	if len(after.regexes["http://c"]) != 0 {
+		t.Errorf("expected no regular expressions for a backend without rules, got %v", after.regexes["http://c"])
+	}
+
+	// removed backends drop them
+	registry.remove(routed.URL)
+	if _, ok := registry.snapshot().regexes[routed.URL]; ok {
+		t.Errorf("expected the regular expressions of removed backends to be dropped")
+	}
+}
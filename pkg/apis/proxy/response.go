@@ -0,0 +1,173 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+)
+
+const (
+	// ResponsePolicyAll accepts the request if every backend accepted it.
+	ResponsePolicyAll = "all"
+	// ResponsePolicyAny accepts the request if at least one backend accepted it.
+	ResponsePolicyAny = "any"
+	// ResponsePolicyQuorum accepts the request if a number of backends accepted it.
+	ResponsePolicyQuorum = "quorum"
+	// ResponsePolicyAlways accepts the request whatever the backends responded.
+	ResponsePolicyAlways = "always"
+)
+
+// responsePolicy decides the response to the inbound caller from the outcome of the forwards.
+// Without policy, the request fails only if a backend could not be reached, so that a backend
+// responding with an error status counts as a success.
+type responsePolicy struct {
+	policy string
+	// quorum is the number of backends which must accept the request for the quorum policy
+	quorum int
+	// jsonBody lists the outcome of every forward in the response body
+	jsonBody bool
+}
+
+// responsePolicyFromEnv returns the response policy set by SPRAYPROXY_RESPONSE_* env vars.
+func responsePolicyFromEnv() (responsePolicy, error) {
+	r := responsePolicy{}
+	switch v := os.Getenv("SPRAYPROXY_RESPONSE_POLICY"); v {
+	case "", ResponsePolicyAll, ResponsePolicyAny, ResponsePolicyAlways:
+		r.policy = v
+	case ResponsePolicyQuorum:
+		r.policy = v
+		quorum, err := strconv.Atoi(os.Getenv("SPRAYPROXY_RESPONSE_QUORUM"))
+		if err != nil || quorum < 1 {
+			return r, fmt.Errorf("invalid SPRAYPROXY_RESPONSE_QUORUM %q, expected a positive number for the quorum policy",
+				os.Getenv("SPRAYPROXY_RESPONSE_QUORUM"))
+		}
+		r.quorum = quorum
+	default:
+		return r, fmt.Errorf("invalid SPRAYPROXY_RESPONSE_POLICY %q", v)
+	}
+	switch v := os.Getenv("SPRAYPROXY_RESPONSE_BODY"); v {
+	case "", "text":
+	case "json":
+		r.jsonBody = true
+	default:
+		return r, fmt.Errorf("invalid SPRAYPROXY_RESPONSE_BODY %q", v)
+	}
+	return r, nil
+}
+
+// accepted indicates if the request is accepted, given the outcome of the forwards. With the
+// quorum policy, every backend must accept the request if there are fewer than the quorum.
+func (r responsePolicy) accepted(results []forwardResult) bool {
+	succeeded := 0
+	for _, result := range results {
+		if r.policy == "" && result.err != nil {
+			return false
+		}
+		if !result.failed() {
+			succeeded++
+		}
+	}
+	switch r.policy {
+	case ResponsePolicyAll:
+		return succeeded == len(results)
+	case ResponsePolicyAny:
+		return succeeded > 0 || len(results) == 0
+	case ResponsePolicyQuorum:
+		quorum := r.quorum
+		if quorum > len(results) {
+			quorum = len(results)
+		}
+		return succeeded >= quorum
+	default:
+		return true
+	}
+}
+
+// errorClass classifies why the backend did not accept the request, or returns an empty string
+// if it did.
+func errorClass(result forwardResult) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(result.err, errCircuitOpen):
+		return "circuit-open"
+	case errors.Is(result.err, errBackendUnhealthy):
+		return "unhealthy"
+	case errors.As(result.err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case result.err != nil:
+		return "connection"
+	case result.status >= 500:
+		return "http-5xx"
+	case result.status >= 400:
+		return "http-4xx"
+	default:
+		return ""
+	}
+}
+
+// backendOutcome is the outcome of the forward to a backend. The backend URL and the error message
+// are only given by the admin endpoints, as they may reveal details of the internal network.
+type backendOutcome struct {
+	Backend    string  `json:"backend"`
+	Status     int     `json:"status,omitempty"`
+	LatencyMs  float64 `json:"latencyMs"`
+	ErrorClass string  `json:"errorClass,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func newBackendOutcome(result forwardResult) backendOutcome {
+	return backendOutcome{
+		Backend:    result.backend,
+		Status:     result.status,
+		LatencyMs:  float64(result.latency) / float64(time.Millisecond),
+		ErrorClass: errorClass(result),
+	}
+}
+
+// sprayResponse is the JSON response body listing the outcome of every forward.
+type sprayResponse struct {
+	Result   string           `json:"result"`
+	Policy   string           `json:"policy,omitempty"`
+	Backends []backendOutcome `json:"backends"`
+}
+
+// respond answers the inbound caller according to the response policy.
+func (p *SprayProxy) respond(c *gin.Context, results []forwardResult) {
+	status, message := http.StatusOK, "proxied"
+	if !p.responsePolicy.accepted(results) {
+		// we have a bad gateway/connection somewhere
+		status, message = http.StatusBadGateway, "failed to proxy"
+	}
+	if !p.responsePolicy.jsonBody {
+		c.String(status, message)
+		return
+	}
+	response := sprayResponse{Result: message, Policy: p.responsePolicy.policy, Backends: []backendOutcome{}}
+	if p.responsePolicy.policy == ResponsePolicyQuorum {
+		response.Policy = fmt.Sprintf("%s/%d", ResponsePolicyQuorum, p.responsePolicy.quorum)
+	}
+	snapshot := p.backends.snapshot()
+	for _, result := range results {
+		outcome := newBackendOutcome(result)
+		b, ok := snapshot.get(result.backend)
+		if !ok {
+			// unregistered in the meantime
+			b = &v1alpha1.Backend{URL: result.backend}
+		}
+		outcome.Backend = backendID(b)
+		response.Backends = append(response.Backends, outcome)
+	}
+	c.JSON(status, response)
+}
@@ -0,0 +1,145 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestResponsePolicyAccepted(t *testing.T) {
+	unreachable := forwardResult{err: errors.New("connection refused")}
+	for _, test := range []struct {
+		name     string
+		policy   responsePolicy
+		results  []forwardResult
+		expected bool
+	}{
+		{name: "default with error status", results: []forwardResult{successResult, failedResult}, expected: true},
+		{name: "default with unreachable backend", results: []forwardResult{successResult, unreachable}, expected: false},
+		{name: "all", policy: responsePolicy{policy: ResponsePolicyAll}, results: []forwardResult{successResult, successResult}, expected: true},
+		{name: "all with error status", policy: responsePolicy{policy: ResponsePolicyAll}, results: []forwardResult{successResult, failedResult}, expected: false},
+		{name: "any", policy: responsePolicy{policy: ResponsePolicyAny}, results: []forwardResult{unreachable, successResult}, expected: true},
+		{name: "any without success", policy: responsePolicy{policy: ResponsePolicyAny}, results: []forwardResult{unreachable, failedResult}, expected: false},
+		{name: "any without backends", policy: responsePolicy{policy: ResponsePolicyAny}, expected: true},
+		{name: "quorum", policy: responsePolicy{policy: ResponsePolicyQuorum, quorum: 2}, results: []forwardResult{successResult, failedResult, successResult}, expected: true},
+		{name: "quorum not reached", policy: responsePolicy{policy: ResponsePolicyQuorum, quorum: 2}, results: []forwardResult{successResult, failedResult, unreachable}, expected: false},
+		{name: "quorum above backends", policy: responsePolicy{policy: ResponsePolicyQuorum, quorum: 3}, results: []forwardResult{successResult, successResult}, expected: true},
+		{name: "always", policy: responsePolicy{policy: ResponsePolicyAlways}, results: []forwardResult{unreachable, failedResult}, expected: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if accepted := test.policy.accepted(test.results); accepted != test.expected {
+				t.Errorf("expected accepted to be %t", test.expected)
+			}
+		})
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for expected, result := range map[string]forwardResult{
+		"":             successResult,
+		"http-4xx":     {status: http.StatusNotFound},
+		"http-5xx":     failedResult,
+		"connection":   {err: errors.New("connection refused")},
+		"timeout":      {err: timeoutError{}},
+		"circuit-open": {err: errCircuitOpen},
+		"unhealthy":    {err: errBackendUnhealthy},
+	} {
+		if class := errorClass(result); class != expected {
+			t.Errorf("expected error class %q for %+v, got %q", expected, result, class)
+		}
+	}
+}
+
+func TestRespondJSON(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	t.Setenv("SPRAYPROXY_RESPONSE_BODY", "json")
+
+	for policy, expected := range map[string]int{
+		ResponsePolicyAll: http.StatusBadGateway,
+		ResponsePolicyAny: http.StatusOK,
+	} {
+		t.Run(policy, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_RESPONSE_POLICY", policy)
+			proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{ok.URL: "", failing.URL: ""})
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = newProxyRequest()
+			proxy.HandleProxy(ctx)
+			if w.Code != expected {
+				t.Errorf("expected status code %d, got %d", expected, w.Code)
+			}
+			response := sprayResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("expected JSON response, got %q", w.Body.String())
+			}
+			if response.Policy != policy || len(response.Backends) != 2 {
+				t.Fatalf("unexpected response %+v", response)
+			}
+			for _, outcome := range response.Backends {
+				switch outcome.Backend {
+				case backendID(&v1alpha1.Backend{URL: ok.URL}):
+					if outcome.Status != http.StatusOK || outcome.ErrorClass != "" {
+						t.Errorf("unexpected outcome %+v", outcome)
+					}
+				case backendID(&v1alpha1.Backend{URL: failing.URL}):
+					if outcome.Status != http.StatusServiceUnavailable || outcome.ErrorClass != "http-5xx" {
+						t.Errorf("unexpected outcome %+v", outcome)
+					}
+				default:
+					t.Errorf("unexpected backend %q", outcome.Backend)
+				}
+			}
+		})
+	}
+}
+
+func TestResponsePolicyFromEnv(t *testing.T) {
+	if policy, err := responsePolicyFromEnv(); err != nil || policy != (responsePolicy{}) {
+		t.Errorf("expected legacy response policy by default, got %+v, %v", policy, err)
+	}
+	for _, env := range []map[string]string{
+		{"SPRAYPROXY_RESPONSE_POLICY": "most"},
+		{"SPRAYPROXY_RESPONSE_POLICY": ResponsePolicyQuorum},
+		{"SPRAYPROXY_RESPONSE_POLICY": ResponsePolicyQuorum, "SPRAYPROXY_RESPONSE_QUORUM": "0"},
+		{"SPRAYPROXY_RESPONSE_BODY": "xml"},
+	} {
+		t.Run("", func(t *testing.T) {
+			for name, value := range env {
+				t.Setenv(name, value)
+			}
+			if _, err := responsePolicyFromEnv(); err == nil {
+				t.Errorf("expected error for %v", env)
+			}
+		})
+	}
+	t.Setenv("SPRAYPROXY_RESPONSE_POLICY", ResponsePolicyQuorum)
+	t.Setenv("SPRAYPROXY_RESPONSE_QUORUM", "2")
+	if policy, err := responsePolicyFromEnv(); err != nil || policy.quorum != 2 {
+		t.Errorf("expected quorum of 2, got %+v, %v", policy, err)
+	}
+}
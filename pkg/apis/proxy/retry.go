@@ -0,0 +1,133 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how failed forwards to a backend are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// A value of 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait time before the first retry. It doubles on every
+	// subsequent retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter randomizes the backoff by up to the given fraction (0 to 1) in either direction.
+	Jitter float64
+	// RetryableStatusCodes lists the backend response codes worth retrying.
+	// Transport errors are always retried.
+	RetryableStatusCodes []int
+}
+
+// defaultRetryPolicy does not retry, which matches the behavior before retries were introduced.
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:          1,
+		InitialBackoff:       500 * time.Millisecond,
+		MaxBackoff:           5 * time.Second,
+		Jitter:               0.2,
+		RetryableStatusCodes: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+}
+
+// retryPolicyFromEnv returns the default retry policy, overridden by SPRAYPROXY_RETRY_* env vars.
+func retryPolicyFromEnv() (RetryPolicy, error) {
+	policy := defaultRetryPolicy()
+	if v := os.Getenv("SPRAYPROXY_RETRY_MAX_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return policy, fmt.Errorf("invalid SPRAYPROXY_RETRY_MAX_ATTEMPTS %q", v)
+		}
+		policy.MaxAttempts = attempts
+	}
+	if v := os.Getenv("SPRAYPROXY_RETRY_INITIAL_BACKOFF"); v != "" {
+		backoff, err := time.ParseDuration(v)
+		if err != nil || backoff < 0 {
+			return policy, fmt.Errorf("invalid SPRAYPROXY_RETRY_INITIAL_BACKOFF %q", v)
+		}
+		policy.InitialBackoff = backoff
+	}
+	if v := os.Getenv("SPRAYPROXY_RETRY_MAX_BACKOFF"); v != "" {
+		backoff, err := time.ParseDuration(v)
+		if err != nil || backoff < 0 {
+			return policy, fmt.Errorf("invalid SPRAYPROXY_RETRY_MAX_BACKOFF %q", v)
+		}
+		policy.MaxBackoff = backoff
+	}
+	if v := os.Getenv("SPRAYPROXY_RETRY_JITTER"); v != "" {
+		jitter, err := strconv.ParseFloat(v, 64)
+		if err != nil || jitter < 0 || jitter > 1 {
+			return policy, fmt.Errorf("invalid SPRAYPROXY_RETRY_JITTER %q", v)
+		}
+		policy.Jitter = jitter
+	}
+	if v := os.Getenv("SPRAYPROXY_RETRY_STATUS_CODES"); v != "" {
+		codes := []int{}
+		for _, s := range strings.Split(v, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return policy, fmt.Errorf("invalid SPRAYPROXY_RETRY_STATUS_CODES %q", v)
+			}
+			codes = append(codes, code)
+		}
+		policy.RetryableStatusCodes = codes
+	}
+	return policy, nil
+}
+
+// retryable indicates if a forward which ended with the given status code or error should be retried.
+func (r RetryPolicy) retryable(statusCode int, err error) bool {
+	if err != nil {
+		return true
+	}
+	for _, code := range r.RetryableStatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the time to wait before the given retry attempt (2 being the first retry).
+// A Retry-After duration requested by the backend takes precedence over the computed backoff.
+// The second return value is false if the backend asked to wait longer than MaxBackoff, in which
+// case we give up instead of ignoring its request.
+func (r RetryPolicy) backoff(attempt int, retryAfter time.Duration) (time.Duration, bool) {
+	if retryAfter > 0 {
+		return retryAfter, retryAfter <= r.MaxBackoff
+	}
+	backoff := float64(r.InitialBackoff) * math.Pow(2, float64(attempt-2))
+	backoff += backoff * r.Jitter * (2*rand.Float64() - 1)
+	if backoff > float64(r.MaxBackoff) {
+		backoff = float64(r.MaxBackoff)
+	}
+	return time.Duration(backoff), true
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or a HTTP date.
+// Returns zero if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestRetryPolicyDefault(t *testing.T) {
+	policy, err := retryPolicyFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if policy.MaxAttempts != 1 {
+		t.Errorf("expected retries to be disabled by default, got %d max attempts", policy.MaxAttempts)
+	}
+}
+
+func TestRetryPolicyFromEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_RETRY_MAX_ATTEMPTS", "5")
+	t.Setenv("SPRAYPROXY_RETRY_INITIAL_BACKOFF", "100ms")
+	t.Setenv("SPRAYPROXY_RETRY_MAX_BACKOFF", "2s")
+	t.Setenv("SPRAYPROXY_RETRY_JITTER", "0")
+	t.Setenv("SPRAYPROXY_RETRY_STATUS_CODES", "500, 503")
+	policy, err := retryPolicyFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if policy.MaxAttempts != 5 {
+		t.Errorf("expected max attempts %d, got %d", 5, policy.MaxAttempts)
+	}
+	if policy.InitialBackoff != 100*time.Millisecond {
+		t.Errorf("expected initial backoff %s, got %s", 100*time.Millisecond, policy.InitialBackoff)
+	}
+	if policy.MaxBackoff != 2*time.Second {
+		t.Errorf("expected max backoff %s, got %s", 2*time.Second, policy.MaxBackoff)
+	}
+	if !policy.retryable(http.StatusInternalServerError, nil) || policy.retryable(http.StatusBadGateway, nil) {
+		t.Errorf("expected only status codes %v to be retryable", policy.RetryableStatusCodes)
+	}
+}
+
+func TestRetryPolicyInvalidEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"SPRAYPROXY_RETRY_MAX_ATTEMPTS":    "0",
+		"SPRAYPROXY_RETRY_INITIAL_BACKOFF": "foo",
+		"SPRAYPROXY_RETRY_MAX_BACKOFF":     "-1s",
+		"SPRAYPROXY_RETRY_JITTER":          "1.5",
+		"SPRAYPROXY_RETRY_STATUS_CODES":    "503,foo",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := retryPolicyFromEnv(); err == nil {
+				t.Errorf("expected error for %s=%q", name, value)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Jitter:         0.5,
+	}
+	for _, test := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 2, min: 50 * time.Millisecond, max: 150 * time.Millisecond},
+		{attempt: 3, min: 100 * time.Millisecond, max: 300 * time.Millisecond},
+		{attempt: 10, min: time.Second, max: time.Second},
+	} {
+		backoff, ok := policy.backoff(test.attempt, 0)
+		if !ok {
+			t.Errorf("attempt %d: expected retry to be allowed", test.attempt)
+		}
+		if backoff < test.min || backoff > test.max {
+			t.Errorf("attempt %d: expected backoff between %s and %s, got %s", test.attempt, test.min, test.max, backoff)
+		}
+	}
+	if backoff, ok := policy.backoff(2, 500*time.Millisecond); !ok || backoff != 500*time.Millisecond {
+		t.Errorf("expected Retry-After of %s to be respected, got %s", 500*time.Millisecond, backoff)
+	}
+	if _, ok := policy.backoff(2, 2*time.Second); ok {
+		t.Errorf("expected retry to be abandoned when Retry-After exceeds max backoff")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		header   string
+		expected time.Duration
+	}{
+		{header: "", expected: 0},
+		{header: "3", expected: 3 * time.Second},
+		{header: "foo", expected: 0},
+		{header: now.Add(time.Minute).Format(http.TimeFormat), expected: time.Minute},
+		{header: now.Add(-time.Minute).Format(http.TimeFormat), expected: 0},
+	} {
+		if got := parseRetryAfter(test.header, now); got != test.expected {
+			t.Errorf("header %q: expected %s, got %s", test.header, test.expected, got)
+		}
+	}
+}
+
+func TestHandleProxyRetry(t *testing.T) {
+	var buff bytes.Buffer
+	config := zap.NewProductionConfig()
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(config.EncoderConfig),
+		zapcore.AddSync(&buff),
+		config.Level,
+	)
+	logger := zap.New(core)
+	var calls int32
+	// fail twice before accepting the request
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("SPRAYPROXY_RETRY_INITIAL_BACKOFF", "10ms")
+	proxy, err := NewSprayProxy(false, true, false, logger, map[string]string{backend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if calls != 3 {
+		t.Errorf("expected %d attempts, got %d", 3, calls)
+	}
+	log := buff.String()
+	for _, expected := range []string{`"attempt":1,`, `"attempt":2,`, `"attempt":3,`, `"msg":"retrying request"`} {
+		if !strings.Contains(log, expected) {
+			t.Errorf("expected string %q did not appear in %q", expected, log)
+		}
+	}
+}
+
+func TestHandleProxyRetryCanceled(t *testing.T) {
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	t.Setenv("SPRAYPROXY_RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("SPRAYPROXY_RETRY_INITIAL_BACKOFF", "1m")
+	t.Setenv("SPRAYPROXY_RETRY_MAX_BACKOFF", "1m")
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{backend.URL: ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	reqCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ctx.Request = newProxyRequest().WithContext(reqCtx)
+	start := time.Now()
+	proxy.HandleProxy(ctx)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the backoff to stop with the inbound request, took %s", elapsed)
+	}
+	if calls != 1 {
+		t.Errorf("expected %d attempt, got %d", 1, calls)
+	}
+}
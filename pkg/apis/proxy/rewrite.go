@@ -0,0 +1,95 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+)
+
+// validatePathRewrite checks the regular expression of the rewrite rules.
+func validatePathRewrite(rewrite *v1alpha1.PathRewrite) error {
+	if rewrite == nil || rewrite.Replace == nil {
+		return nil
+	}
+	if _, err := regexp.Compile(rewrite.Replace.Pattern); err != nil {
+		return fmt.Errorf("invalid path replace pattern %q: %v", rewrite.Replace.Pattern, err)
+	}
+	return nil
+}
+
+// rewritePath applies the rewrite rules, with their compiled regular expression, to the escaped
+// inbound request path.
+func rewritePath(rewrite *v1alpha1.PathRewrite, regexes backendRegexes, p string, header http.Header) (string, error) {
+	if rewrite == nil {
+		return p, nil
+	}
+	if rewrite.StripPrefix != "" {
+		p = strings.TrimPrefix(p, rewrite.StripPrefix)
+	}
+	if rewrite.Replace != nil {
+		re := regexes[rewrite.Replace.Pattern]
+		if re == nil {
+			return "", fmt.Errorf("invalid path replace pattern %q", rewrite.Replace.Pattern)
+		}
+		p = re.ReplaceAllString(p, rewrite.Replace.Replacement)
+	}
+	if rewrite.Template != "" {
+		p = strings.NewReplacer(
+			"{path}", p,
+			"{event}", url.PathEscape(header.Get("X-GitHub-Event")),
+			"{delivery}", url.PathEscape(header.Get(deliveryHeader)),
+		).Replace(rewrite.Template)
+	}
+	return p, nil
+}
+
+// backendRequestURL builds the URL of the request forwarded to the backend. The inbound path,
+// after rewriting, is appended to the backend URL path, and the query parameters of both are kept.
+// Paths are handled in their escaped form, so encoded characters such as slashes are kept.
+func backendRequestURL(backendURL *url.URL, rewrite *v1alpha1.PathRewrite, regexes backendRegexes, req *http.Request) (*url.URL, error) {
+	inboundPath, err := rewritePath(rewrite, regexes, req.URL.EscapedPath(), req.Header)
+	if err != nil {
+		return nil, err
+	}
+	rawPath := joinPath(backendURL.EscapedPath(), inboundPath)
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewritten path %q: %v", rawPath, err)
+	}
+	newURL := &url.URL{
+		Scheme:   backendURL.Scheme,
+		User:     backendURL.User,
+		Host:     backendURL.Host,
+		Path:     path,
+		RawPath:  rawPath,
+		RawQuery: backendURL.RawQuery,
+	}
+	if req.URL.RawQuery != "" {
+		if newURL.RawQuery != "" {
+			newURL.RawQuery += "&"
+		}
+		newURL.RawQuery += req.URL.RawQuery
+	}
+	return newURL, nil
+}
+
+// joinPath appends the inbound path to the backend path. An empty or root inbound path leaves
+// the backend path unchanged, so a backend URL can point to the exact webhook endpoint.
+func joinPath(backendPath, inboundPath string) string {
+	if inboundPath == "" || inboundPath == "/" {
+		if backendPath == "" {
+			return inboundPath
+		}
+		return backendPath
+	}
+	return strings.TrimSuffix(backendPath, "/") + "/" + strings.TrimPrefix(inboundPath, "/")
+}
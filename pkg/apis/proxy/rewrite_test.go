@@ -0,0 +1,102 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+func TestBackendRequestURL(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		backend  string
+		rewrite  *v1alpha1.PathRewrite
+		inbound  string
+		expected string
+	}{
+		{name: "host only", backend: "https://cluster-a", inbound: "/", expected: "https://cluster-a/"},
+		{name: "host only with path", backend: "https://cluster-a", inbound: "/apis", expected: "https://cluster-a/apis"},
+		{name: "backend path", backend: "https://cluster-a/pipelines-as-code/hook", inbound: "/", expected: "https://cluster-a/pipelines-as-code/hook"},
+		{name: "backend and inbound path", backend: "https://cluster-a/pac/", inbound: "/apis", expected: "https://cluster-a/pac/apis"},
+		{name: "queries merged", backend: "https://cluster-a/hook?token=foo", inbound: "/?bar=baz", expected: "https://cluster-a/hook?token=foo&bar=baz"},
+		{name: "encoded slash", backend: "https://cluster-a/hook", inbound: "/repos/my-org%2Fmy-repo", expected: "https://cluster-a/hook/repos/my-org%2Fmy-repo"},
+		{name: "encoded backend path", backend: "https://cluster-a/a%2Fb", inbound: "/apis", expected: "https://cluster-a/a%2Fb/apis"},
+		{
+			name:     "replace keeps encoded slash",
+			backend:  "https://cluster-a",
+			rewrite:  &v1alpha1.PathRewrite{StripPrefix: "/github", Replace: &v1alpha1.PathReplace{Pattern: "^/v1/", Replacement: "/v2/"}},
+			inbound:  "/github/v1/my-org%2Fmy-repo",
+			expected: "https://cluster-a/v2/my-org%2Fmy-repo",
+		},
+		{name: "strip prefix", backend: "https://cluster-a/hook", rewrite: &v1alpha1.PathRewrite{StripPrefix: "/github"}, inbound: "/github/apis", expected: "https://cluster-a/hook/apis"},
+		{
+			name:     "replace",
+			backend:  "https://cluster-a",
+			rewrite:  &v1alpha1.PathRewrite{Replace: &v1alpha1.PathReplace{Pattern: "^/v1/(.*)$", Replacement: "/v2/${1}"}},
+			inbound:  "/v1/apis",
+			expected: "https://cluster-a/v2/apis",
+		},
+		{name: "template", backend: "https://cluster-a", rewrite: &v1alpha1.PathRewrite{Template: "/hooks/{event}{path}"}, inbound: "/apis", expected: "https://cluster-a/hooks/push/apis"},
+		{
+			name:     "all steps",
+			backend:  "https://cluster-a/base",
+			rewrite:  &v1alpha1.PathRewrite{StripPrefix: "/github", Replace: &v1alpha1.PathReplace{Pattern: "apis", Replacement: "api"}, Template: "{path}/{delivery}"},
+			inbound:  "/github/apis",
+			expected: "https://cluster-a/base/api/1234",
+		},
+	} {
+		backendURL, _ := url.Parse(test.backend)
+		req := httptest.NewRequest(http.MethodPost, test.inbound, nil)
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set(deliveryHeader, "1234")
+		got, err := backendRequestURL(backendURL, test.rewrite, compileBackendRegexes(&v1alpha1.Backend{PathRewrite: test.rewrite}), req)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got.String() != test.expected {
+			t.Errorf("%s: expected URL %q, got %q", test.name, test.expected, got.String())
+		}
+	}
+}
+
+func TestValidatePathRewrite(t *testing.T) {
+	if err := validatePathRewrite(&v1alpha1.PathRewrite{Replace: &v1alpha1.PathReplace{Pattern: "(foo"}}); err == nil {
+		t.Errorf("expected error for invalid replace pattern")
+	}
+	if err := validatePathRewrite(&v1alpha1.PathRewrite{StripPrefix: "/foo"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHandleProxyBackendPath(t *testing.T) {
+	paths := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		paths <- req.URL.RequestURI()
+	}))
+	defer backend.Close()
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), map[string]string{backend.URL + "/pipelines-as-code/hook": ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	proxy.HandleProxyEndpoint(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if path := <-paths; path != "/pipelines-as-code/hook" {
+		t.Errorf("expected request forwarded to %q, got %q", "/pipelines-as-code/hook", path)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+)
+
+// eventInfo holds the webhook attributes used for routing.
+type eventInfo struct {
+	Event          string
+	Action         string
+	Repository     string
+	InstallationID int64
+	Organization   string
+	Ref            string
+}
+
+// eventPayload is the subset of the GitHub webhook payload used for routing.
+type eventPayload struct {
+	Action     string `json:"action"`
+	Ref        string `json:"ref"`
+	Repository *struct {
+		FullName string `json:"full_name"`
+		Owner    struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+	Installation *struct {
+		ID int64 `json:"id"`
+	} `json:"installation"`
+	Organization *struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+	PullRequest *struct {
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+}
+
+// parseEventInfo extracts the routing attributes from a webhook. The payload is either JSON, or
+// form encoded in the payload field, depending on the content type configured for the webhook.
+func parseEventInfo(event, contentType string, body []byte) (*eventInfo, error) {
+	info := &eventInfo{Event: event}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return info, fmt.Errorf("failed to parse form payload: %v", err)
+		}
+		body = []byte(form.Get("payload"))
+	}
+	payload := eventPayload{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return info, fmt.Errorf("failed to parse payload: %v", err)
+	}
+	info.Action = payload.Action
+	info.Ref = payload.Ref
+	if payload.PullRequest != nil && info.Ref == "" {
+		info.Ref = payload.PullRequest.Base.Ref
+	}
+	if payload.Repository != nil {
+		info.Repository = payload.Repository.FullName
+		info.Organization = payload.Repository.Owner.Login
+	}
+	if payload.Organization != nil && payload.Organization.Login != "" {
+		info.Organization = payload.Organization.Login
+	}
+	if payload.Installation != nil {
+		info.InstallationID = payload.Installation.ID
+	}
+	return info, nil
+}
+
+// validateRoutingRules checks the glob patterns and regular expressions of the rules.
+func validateRoutingRules(rules *v1alpha1.RoutingRules) error {
+	if rules == nil {
+		return nil
+	}
+	for _, filter := range append(append([]v1alpha1.EventFilter{}, rules.Include...), rules.Exclude...) {
+		for _, pattern := range append(append([]string{}, filter.Repositories...), filter.Refs...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid glob pattern %q: %v", pattern, err)
+			}
+		}
+		for _, expr := range filter.RepositoryRegexes {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("invalid regular expression %q: %v", expr, err)
+			}
+		}
+	}
+	return nil
+}
+
+// routeMatches indicates if the event should be forwarded to a backend with the given rules, and
+// compiled regular expressions, along with a short reason for logging.
+func routeMatches(rules *v1alpha1.RoutingRules, regexes backendRegexes, info *eventInfo) (bool, string) {
+	if rules == nil {
+		return true, "no rules"
+	}
+	for i, filter := range rules.Exclude {
+		if filterMatches(filter, regexes, info) {
+			return false, fmt.Sprintf("exclude filter %d matched", i)
+		}
+	}
+	if len(rules.Include) == 0 {
+		return true, "no include filters"
+	}
+	for i, filter := range rules.Include {
+		if filterMatches(filter, regexes, info) {
+			return true, fmt.Sprintf("include filter %d matched", i)
+		}
+	}
+	return false, "no include filter matched"
+}
+
+func filterMatches(filter v1alpha1.EventFilter, regexes backendRegexes, info *eventInfo) bool {
+	if len(filter.Events) > 0 && !containsString(filter.Events, info.Event) {
+		return false
+	}
+	if len(filter.Actions) > 0 && !containsString(filter.Actions, info.Action) {
+		return false
+	}
+	if len(filter.Organizations) > 0 && !containsString(filter.Organizations, info.Organization) {
+		return false
+	}
+	if len(filter.InstallationIDs) > 0 {
+		found := false
+		for _, id := range filter.InstallationIDs {
+			if id == info.InstallationID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(filter.Repositories) > 0 || len(filter.RepositoryRegexes) > 0 {
+		if info.Repository == "" || !repositoryMatches(filter, regexes, info.Repository) {
+			return false
+		}
+	}
+	if len(filter.Refs) > 0 && (info.Ref == "" || !refMatches(filter.Refs, info.Ref)) {
+		return false
+	}
+	return true
+}
+
+func repositoryMatches(filter v1alpha1.EventFilter, regexes backendRegexes, repository string) bool {
+	for _, pattern := range filter.Repositories {
+		if matched, _ := path.Match(pattern, repository); matched {
+			return true
+		}
+	}
+	for _, expr := range filter.RepositoryRegexes {
+		if re := regexes[expr]; re != nil && re.MatchString(repository) {
+			return true
+		}
+	}
+	return false
+}
+
+func refMatches(patterns []string, ref string) bool {
+	short := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, ref); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, short); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+const pushPayload = `{
+	"ref": "refs/heads/main",
+	"repository": {"full_name": "my-org/my-repo", "owner": {"login": "my-org"}},
+	"installation": {"id": 42}
+}`
+
+const pullRequestPayload = `{
+	"action": "opened",
+	"pull_request": {"base": {"ref": "release-1.0"}},
+	"repository": {"full_name": "other-org/other-repo", "owner": {"login": "other-org"}},
+	"organization": {"login": "other-org"},
+	"installation": {"id": 7}
+}`
+
+func TestParseEventInfo(t *testing.T) {
+	t.Run("json payload", func(t *testing.T) {
+		info, err := parseEventInfo("push", "application/json", []byte(pushPayload))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := eventInfo{Event: "push", Repository: "my-org/my-repo", InstallationID: 42, Organization: "my-org", Ref: "refs/heads/main"}
+		if *info != expected {
+			t.Errorf("expected %+v, got %+v", expected, *info)
+		}
+	})
+	t.Run("form payload", func(t *testing.T) {
+		form := url.Values{}
+		form.Add("payload", pullRequestPayload)
+		info, err := parseEventInfo("pull_request", "application/x-www-form-urlencoded", []byte(form.Encode()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := eventInfo{Event: "pull_request", Action: "opened", Repository: "other-org/other-repo", InstallationID: 7, Organization: "other-org", Ref: "release-1.0"}
+		if *info != expected {
+			t.Errorf("expected %+v, got %+v", expected, *info)
+		}
+	})
+	t.Run("invalid payload", func(t *testing.T) {
+		info, err := parseEventInfo("push", "application/json", []byte("hello"))
+		if err == nil {
+			t.Errorf("expected error for invalid payload")
+		}
+		if info.Event != "push" {
+			t.Errorf("expected event %q to be kept, got %q", "push", info.Event)
+		}
+	})
+}
+
+func TestRouteMatches(t *testing.T) {
+	push := &eventInfo{Event: "push", Repository: "my-org/my-repo", InstallationID: 42, Organization: "my-org", Ref: "refs/heads/main"}
+	pr := &eventInfo{Event: "pull_request", Action: "opened", Repository: "other-org/other-repo", InstallationID: 7, Organization: "other-org", Ref: "release-1.0"}
+	for _, test := range []struct {
+		name     string
+		rules    *v1alpha1.RoutingRules
+		expected [2]bool
+	}{
+		{name: "no rules", rules: nil, expected: [2]bool{true, true}},
+		{name: "event", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Events: []string{"push"}}}}, expected: [2]bool{true, false}},
+		{name: "action", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Actions: []string{"opened", "synchronize"}}}}, expected: [2]bool{false, true}},
+		{name: "repository glob", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Repositories: []string{"my-org/*"}}}}, expected: [2]bool{true, false}},
+		{name: "repository regex", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{RepositoryRegexes: []string{"^other-.*-repo$"}}}}, expected: [2]bool{false, true}},
+		{name: "installation", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{InstallationIDs: []int64{7}}}}, expected: [2]bool{false, true}},
+		{name: "organization", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Organizations: []string{"my-org"}}}}, expected: [2]bool{true, false}},
+		{name: "short ref", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Refs: []string{"release-*"}}}}, expected: [2]bool{false, true}},
+		{name: "full ref", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Refs: []string{"refs/heads/main"}}}}, expected: [2]bool{true, false}},
+		{name: "all fields must match", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Events: []string{"push"}, Organizations: []string{"other-org"}}}}, expected: [2]bool{false, false}},
+		{name: "any include matches", rules: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Events: []string{"push"}}, {Events: []string{"pull_request"}}}}, expected: [2]bool{true, true}},
+		{name: "exclude only", rules: &v1alpha1.RoutingRules{Exclude: []v1alpha1.EventFilter{{Events: []string{"push"}}}}, expected: [2]bool{false, true}},
+		{name: "exclude wins over include", rules: &v1alpha1.RoutingRules{
+			Include: []v1alpha1.EventFilter{{Organizations: []string{"my-org", "other-org"}}},
+			Exclude: []v1alpha1.EventFilter{{Repositories: []string{"other-org/*"}}},
+		}, expected: [2]bool{true, false}},
+	} {
+		for i, info := range []*eventInfo{push, pr} {
+			if matched, reason := routeMatches(test.rules, compileBackendRegexes(&v1alpha1.Backend{Routing: test.rules}), info); matched != test.expected[i] {
+				t.Errorf("%s: expected %s event match to be %v, got %v (%s)", test.name, info.Event, test.expected[i], matched, reason)
+			}
+		}
+	}
+}
+
+func TestValidateRoutingRules(t *testing.T) {
+	for _, rules := range []*v1alpha1.RoutingRules{
+		{Include: []v1alpha1.EventFilter{{Repositories: []string{"[my-org/*"}}}},
+		{Exclude: []v1alpha1.EventFilter{{RepositoryRegexes: []string{"(my-org"}}}},
+	} {
+		if err := validateRoutingRules(rules); err == nil {
+			t.Errorf("expected error for invalid rules %+v", rules)
+		}
+	}
+}
+
+func TestLoadBackendsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.yaml")
+	data := `
+- url: http://localhost:8081
+  routing:
+    include:
+    - events: [push]
+      repositoryRegexes: ["^my-org/"]
+- url: http://localhost:8082
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("failed to write backends file: %v", err)
+	}
+	backends, err := loadBackendsFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(backends) != 2 {
+		t.Fatalf("expected %d backends, got %d", 2, len(backends))
+	}
+	if backends[0].Routing == nil || backends[0].Routing.Include[0].RepositoryRegexes[0] != "^my-org/" {
+		t.Errorf("expected routing rules to be loaded, got %+v", backends[0].Routing)
+	}
+	if backends[1].Routing != nil {
+		t.Errorf("expected no routing rules, got %+v", backends[1].Routing)
+	}
+}
+
+func TestHandleProxyRouting(t *testing.T) {
+	var pushCalls, prCalls int32
+	pushBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&pushCalls, 1)
+	}))
+	defer pushBackend.Close()
+	prBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&prCalls, 1)
+	}))
+	defer prBackend.Close()
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.backends = newBackendRegistry(map[string]*v1alpha1.Backend{
+		pushBackend.URL: {URL: pushBackend.URL, Routing: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Events: []string{"push"}}}}},
+		prBackend.URL:   {URL: prBackend.URL, Routing: &v1alpha1.RoutingRules{Include: []v1alpha1.EventFilter{{Events: []string{"pull_request"}}}}},
+	})
+	for _, test := range []struct {
+		event    string
+		payload  string
+		expected string
+	}{
+		{event: "push", payload: pushPayload, expected: "proxied"},
+		{event: "pull_request", payload: pullRequestPayload, expected: "proxied"},
+		{event: "issues", payload: `{"action":"opened"}`, expected: "no matching backends"},
+	} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "http://localhost:8080/", bytes.NewBufferString(test.payload))
+		ctx.Request.Header.Set("Content-Type", "application/json")
+		ctx.Request.Header.Set("X-GitHub-Event", test.event)
+		proxy.HandleProxy(ctx)
+		if w.Code != http.StatusOK || w.Body.String() != test.expected {
+			t.Errorf("%s: expected %d %q, got %d %q", test.event, http.StatusOK, test.expected, w.Code, w.Body.String())
+		}
+	}
+	if pushCalls != 1 || prCalls != 1 {
+		t.Errorf("expected each backend to receive 1 event, got %d push and %d pull_request", pushCalls, prCalls)
+	}
+
+	t.Run("reject invalid routing rules on registration", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		body := `{"url":"http://localhost:8083","routing":{"include":[{"repositoryRegexes":["(foo"]}]}}`
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/backends", bytes.NewBufferString(body))
+		proxy.RegisterBackend(ctx)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
@@ -0,0 +1,236 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/filewatch"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// file holding the GH_APP_WEBHOOK_SECRET secret, typically mounted from a Kubernetes Secret
+	envWebhookSecretFile = "GH_APP_WEBHOOK_SECRET_FILE"
+	// additional webhook secrets, to rotate the secret without rejecting deliveries
+	envWebhookSecrets = "SPRAYPROXY_WEBHOOK_SECRETS"
+	// file holding the SPRAYPROXY_WEBHOOK_SECRETS secrets
+	envWebhookSecretsFile = "SPRAYPROXY_WEBHOOK_SECRETS_FILE"
+	// name of the GH_APP_WEBHOOK_SECRET secret in logs and metrics
+	primaryWebhookSecret = "primary"
+)
+
+// webhookSecret is a secret the webhook signatures are validated with.
+type webhookSecret struct {
+	// Name identifies the secret in logs and metrics, without revealing it
+	Name   string `yaml:"name"`
+	Secret string `yaml:"secret"`
+	// Expires is the time a deprecated secret stops being accepted, nil for active secrets
+	Expires *time.Time `yaml:"expires,omitempty"`
+	// Providers are the webhook providers the secret is used with, GitHub only when empty, so a
+	// secret signing the requests of a provider is never accepted as the token of another one
+	Providers []string `yaml:"providers,omitempty"`
+}
+
+// expired indicates if the secret is deprecated and no longer accepted.
+func (s *webhookSecret) expired(now time.Time) bool {
+	return s.Expires != nil && !now.Before(*s.Expires)
+}
+
+// usedBy indicates if the secret is used with the webhook provider.
+func (s *webhookSecret) usedBy(provider string) bool {
+	if len(s.Providers) == 0 {
+		return provider == VerifierGitHub
+	}
+	return containsString(s.Providers, provider)
+}
+
+// webhookSecrets holds the secrets the webhook signatures are validated with. The secrets
+// loaded from files are reloaded when the files change, and replaced all at once.
+type webhookSecrets struct {
+	// primaryFile and additionalFile replace the GH_APP_WEBHOOK_SECRET and
+	// SPRAYPROXY_WEBHOOK_SECRETS env vars when set
+	primaryFile    string
+	additionalFile string
+	// providers are the enabled webhook providers, which must all have a secret
+	providers []string
+	logger    *zap.Logger
+	current   atomic.Pointer[[]webhookSecret]
+}
+
+// webhookSecretsFromEnv loads the webhook secrets set by the GH_APP_WEBHOOK_SECRET and
+// SPRAYPROXY_WEBHOOK_SECRETS env vars, or the files they point to, for the enabled providers.
+func webhookSecretsFromEnv(logger *zap.Logger, providers []string) (*webhookSecrets, error) {
+	w := &webhookSecrets{
+		primaryFile:    os.Getenv(envWebhookSecretFile),
+		additionalFile: os.Getenv(envWebhookSecretsFile),
+		providers:      providers,
+		logger:         logger,
+	}
+	for env, file := range map[string]string{envWebhookSecret: w.primaryFile, envWebhookSecrets: w.additionalFile} {
+		if file != "" && os.Getenv(env) != "" {
+			return nil, fmt.Errorf("%s and %s_FILE cannot be both set", env, env)
+		}
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// get returns the current secrets, the primary secret first.
+func (w *webhookSecrets) get() []webhookSecret {
+	return *w.current.Load()
+}
+
+// load reads the secrets from the env vars and files. The current secrets are only replaced if
+// the new ones are valid.
+func (w *webhookSecrets) load() error {
+	secrets := []webhookSecret{}
+	primary, err := w.read(envWebhookSecret, w.primaryFile)
+	if err != nil {
+		return err
+	}
+	if w.primaryFile != "" {
+		// tools writing secrets to files usually add a final newline, which is not part of the secret
+		primary = strings.TrimRight(primary, "\r\n")
+	}
+	if primary != "" {
+		secrets = append(secrets, webhookSecret{Name: primaryWebhookSecret, Secret: primary})
+	}
+	additional, err := w.read(envWebhookSecrets, w.additionalFile)
+	if err != nil {
+		return err
+	}
+	if additional != "" {
+		list := []webhookSecret{}
+		if err := yaml.Unmarshal([]byte(additional), &list); err != nil {
+			return fmt.Errorf("invalid %s, expected a list of secrets: %v", envWebhookSecrets, err)
+		}
+		secrets = append(secrets, list...)
+	}
+	if len(secrets) == 0 {
+		return errors.New("no webhook secret")
+	}
+	if err := validateWebhookSecrets(secrets, w.providers); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, s := range secrets {
+		switch {
+		case s.Expires == nil:
+			w.logger.Info(fmt.Sprintf("proxy webhook secret %s is active", s.Name))
+		case s.expired(now):
+			w.logger.Warn(fmt.Sprintf("proxy webhook secret %s expired at %s, it should be removed", s.Name, s.Expires.Format(time.RFC3339)))
+		default:
+			w.logger.Info(fmt.Sprintf("proxy webhook secret %s is deprecated, accepted until %s", s.Name, s.Expires.Format(time.RFC3339)))
+		}
+	}
+	w.current.Store(&secrets)
+	return nil
+}
+
+// read returns the content of the file if set, or the value of the env var.
+func (w *webhookSecrets) read(env, file string) (string, error) {
+	if file == "" {
+		return os.Getenv(env), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %v", env, err)
+	}
+	return string(data), nil
+}
+
+// files returns the secret files, which are watched for changes.
+func (w *webhookSecrets) files() []string {
+	files := []string{}
+	for _, file := range []string{w.primaryFile, w.additionalFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// watch reloads the secrets when the files change, until stopCh is closed.
+func (w *webhookSecrets) watch(stopCh <-chan struct{}) {
+	filewatch.Watch(stopCh, w.files(), "webhook secret", w.logger, func() {
+		if err := w.load(); err != nil {
+			metrics.IncWebhookSecretReloadCount("failure")
+			w.logger.Error("failed to reload webhook secrets, keeping the current ones", zap.Error(err))
+			return
+		}
+		metrics.IncWebhookSecretReloadCount("success")
+		w.logger.Info(fmt.Sprintf("reloaded %d webhook secrets", len(w.get())))
+	})
+}
+
+// validateWebhookSecrets checks that the secrets have a unique name and a value, and are used by
+// enabled providers, which all have a secret.
+func validateWebhookSecrets(secrets []webhookSecret, providers []string) error {
+	names := map[string]bool{}
+	for i, s := range secrets {
+		if s.Name == "" {
+			return fmt.Errorf("webhook secret %d has no name", i)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate webhook secret name %q", s.Name)
+		}
+		names[s.Name] = true
+		if s.Secret == "" {
+			return fmt.Errorf("webhook secret %q has no value", s.Name)
+		}
+		for _, provider := range s.Providers {
+			if !containsString(providers, provider) {
+				return fmt.Errorf("webhook secret %q is used by provider %q, which is not enabled", s.Name, provider)
+			}
+		}
+	}
+	for _, provider := range providers {
+		found := false
+		for i := range secrets {
+			if secrets[i].usedBy(provider) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no webhook secret for provider %q", provider)
+		}
+	}
+	return nil
+}
+
+// validateWebhookSignatures verifies the request with each secret of the provider which has not
+// expired, in order, and returns the name of the secret which matched.
+func validateWebhookSignatures(req *http.Request, body []byte, verifier Verifier, secrets []webhookSecret, now time.Time) (string, error) {
+	var firstErr error
+	for i := range secrets {
+		if !secrets[i].usedBy(verifier.Name()) || secrets[i].expired(now) {
+			continue
+		}
+		err := verifier.Verify(req, body, secrets[i].Secret)
+		if err == nil {
+			return secrets[i].Name, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return "", fmt.Errorf("validateWebhookSignature: all webhook secrets of provider %s expired", verifier.Name())
+	}
+	return "", firstErr
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/filewatch"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestWebhookSecretsFromEnv(t *testing.T) {
+	t.Setenv(envWebhookSecret, "new")
+	t.Setenv(envWebhookSecrets, `
+- name: previous
+  secret: old
+  expires: 2023-11-01T00:00:00Z
+- name: spare
+  secret: other
+`)
+	loaded, err := webhookSecretsFromEnv(zap.NewNop(), []string{VerifierGitHub})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secrets := loaded.get()
+	if len(secrets) != 3 || secrets[0].Name != primaryWebhookSecret || secrets[0].Secret != "new" {
+		t.Fatalf("expected primary secret first, got %+v", secrets)
+	}
+	expires := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+	if secrets[1].Expires == nil || !secrets[1].Expires.Equal(expires) || secrets[2].Expires != nil {
+		t.Errorf("unexpected expiry of the additional secrets: %+v", secrets[1:])
+	}
+
+	for name, value := range map[string]string{
+		"not a list":        "secret: old",
+		"no name":           "[{secret: old}]",
+		"no value":          "[{name: previous}]",
+		"duplicate name":    "[{name: primary, secret: old}]",
+		"invalid expiry":    "[{name: previous, secret: old, expires: soon}]",
+		"disabled provider": "[{name: previous, secret: old, providers: [gitlab]}]",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(envWebhookSecrets, value)
+			if _, err := webhookSecretsFromEnv(zap.NewNop(), []string{VerifierGitHub}); err == nil {
+				t.Errorf("expected error for %s=%s", envWebhookSecrets, value)
+			}
+		})
+	}
+}
+
+func TestWebhookSecretsProviders(t *testing.T) {
+	t.Setenv(envWebhookSecret, "github-secret")
+	providers := []string{VerifierGitHub, VerifierGitLab}
+	if _, err := webhookSecretsFromEnv(zap.NewNop(), providers); err == nil || !strings.Contains(err.Error(), `provider "gitlab"`) {
+		t.Errorf("expected error for provider without secret, got %v", err)
+	}
+	t.Setenv(envWebhookSecrets, "[{name: gitlab, secret: gitlab-token, providers: [gitlab]}]")
+	loaded, err := webhookSecretsFromEnv(zap.NewNop(), providers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secrets := loaded.get()
+	if !secrets[0].usedBy(VerifierGitHub) || secrets[0].usedBy(VerifierGitLab) {
+		t.Errorf("expected primary secret to be used by GitHub only")
+	}
+	if secrets[1].usedBy(VerifierGitHub) || !secrets[1].usedBy(VerifierGitLab) {
+		t.Errorf("expected additional secret to be used by GitLab only")
+	}
+}
+
+func TestWebhookSecretsReload(t *testing.T) {
+	dir := t.TempDir()
+	primaryFile := filepath.Join(dir, "secret")
+	additionalFile := filepath.Join(dir, "secrets.yaml")
+	if err := os.WriteFile(primaryFile, []byte("new\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(additionalFile, []byte("[{name: previous, secret: old}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envWebhookSecretFile, primaryFile)
+	t.Setenv(envWebhookSecretsFile, additionalFile)
+	secrets, err := webhookSecretsFromEnv(zap.NewNop(), []string{VerifierGitHub})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if current := secrets.get(); len(current) != 2 || current[0].Secret != "new" || current[1].Secret != "old" {
+		t.Fatalf("expected secrets loaded from the files, got %+v", current)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go secrets.watch(stopCh)
+	// let the watcher start before changing the files
+	time.Sleep(50 * time.Millisecond)
+
+	waitFor := func(check func([]webhookSecret) bool) []webhookSecret {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if current := secrets.get(); check(current) {
+				return current
+			}
+		}
+		return secrets.get()
+	}
+	if err := os.WriteFile(primaryFile, []byte("newer"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if current := waitFor(func(s []webhookSecret) bool { return s[0].Secret == "newer" }); current[0].Secret != "newer" {
+		t.Fatalf("expected the primary secret to be reloaded, got %+v", current)
+	}
+
+	// invalid secrets are not loaded, the current ones are kept
+	if err := os.WriteFile(additionalFile, []byte("[{name: previous}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * filewatch.ReloadDelay)
+	if current := secrets.get(); len(current) != 2 || current[1].Secret != "old" {
+		t.Fatalf("expected the current secrets to be kept, got %+v", current)
+	}
+
+	// Kubernetes updates mounted Secrets by swapping a symlink to a new directory
+	if err := os.Remove(additionalFile); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(dir, "..data_2")
+	if err := os.Mkdir(data, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, "secrets.yaml"), []byte("[{name: previous, secret: older}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(data, "secrets.yaml"), additionalFile); err != nil {
+		t.Fatal(err)
+	}
+	if current := waitFor(func(s []webhookSecret) bool { return len(s) == 2 && s[1].Secret == "older" }); current[1].Secret != "older" {
+		t.Fatalf("expected the additional secrets to be reloaded, got %+v", current)
+	}
+}
+
+func TestWebhookSecretsFromFileAndEnv(t *testing.T) {
+	t.Setenv(envWebhookSecret, "new")
+	t.Setenv(envWebhookSecretFile, filepath.Join(t.TempDir(), "secret"))
+	if _, err := webhookSecretsFromEnv(zap.NewNop(), []string{VerifierGitHub}); err == nil {
+		t.Errorf("expected error for secret set by both env var and file")
+	}
+	t.Setenv(envWebhookSecret, "")
+	if _, err := webhookSecretsFromEnv(zap.NewNop(), []string{VerifierGitHub}); err == nil {
+		t.Errorf("expected error for missing secret file")
+	}
+}
+
+func TestValidateWebhookSignatures(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for _, test := range []struct {
+		name     string
+		secrets  []webhookSecret
+		expected string
+		err      string
+	}{
+		{
+			name:     "primary secret",
+			secrets:  []webhookSecret{{Name: "primary", Secret: secret}, {Name: "previous", Secret: invalidSecret, Expires: &future}},
+			expected: "primary",
+		},
+		{
+			name:     "deprecated secret",
+			secrets:  []webhookSecret{{Name: "primary", Secret: invalidSecret}, {Name: "previous", Secret: secret, Expires: &future}},
+			expected: "previous",
+		},
+		{
+			name:    "expired secret",
+			secrets: []webhookSecret{{Name: "primary", Secret: invalidSecret}, {Name: "previous", Secret: secret, Expires: &past}},
+			err:     "validateWebhookSignature: payload signature check failed",
+		},
+		{
+			name:    "all secrets expired",
+			secrets: []webhookSecret{{Name: "previous", Secret: secret, Expires: &past}},
+			err:     "validateWebhookSignature: all webhook secrets of provider github expired",
+		},
+		{
+			name:    "secret of another provider",
+			secrets: []webhookSecret{{Name: "gitlab", Secret: secret, Providers: []string{VerifierGitLab}}},
+			err:     "validateWebhookSignature: all webhook secrets of provider github expired",
+		},
+		{
+			name:     "secret of several providers",
+			secrets:  []webhookSecret{{Name: "shared", Secret: secret, Providers: []string{VerifierGitea, VerifierGitHub}}},
+			expected: "shared",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			matched, err := validateWebhookSignatures(newProxyRequest(), []byte(newProxyRequestBody()), githubVerifier{}, test.secrets, now)
+			if test.err != "" {
+				expectErrorMessage(t, test.err, err)
+				return
+			}
+			if err != nil || matched != test.expected {
+				t.Errorf("expected secret %q to match, got %q, %v", test.expected, matched, err)
+			}
+		})
+	}
+}
+
+func TestHandleProxyWebhookSecretRotation(t *testing.T) {
+	t.Setenv(envWebhookSecret, invalidSecret)
+	t.Setenv(envWebhookSecrets, "[{name: previous, secret: "+secret+", expires: "+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+"}]")
+	var buff bytes.Buffer
+	config := zap.NewProductionConfig()
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(config.EncoderConfig), zapcore.AddSync(&buff), config.Level))
+	proxy, err := NewSprayProxy(false, false, false, logger, nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected request signed with the deprecated secret to be accepted, got %d", w.Code)
+	}
+	if log := buff.String(); !strings.Contains(log, `"msg":"spray summary"`) || !strings.Contains(log, `"webhook-secret":"previous"`) {
+		t.Errorf("expected matching secret in the spray summary, got %q", log)
+	}
+
+	w = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/proxy", bytes.NewBufferString(newProxyRequestBody()))
+	ctx.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx.Request.Header.Set("X-Hub-Signature-256", generateSignature(newProxyRequestBody(), "unknown"))
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "bad request") {
+		t.Errorf("expected request signed with an unknown secret to be rejected, got %d", w.Code)
+	}
+}
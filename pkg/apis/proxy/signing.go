@@ -0,0 +1,108 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"github.com/redhat-appstudio/sprayproxy/pkg/filewatch"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// secrets the requests forwarded to the backends are signed with, by static backend name or URL
+	envBackendSecrets = "SPRAYPROXY_BACKEND_SECRETS"
+	// file holding the SPRAYPROXY_BACKEND_SECRETS secrets
+	envBackendSecretsFile = "SPRAYPROXY_BACKEND_SECRETS_FILE"
+)
+
+// backendSecrets holds the secrets the requests forwarded to the backends are signed with, so
+// backends do not need the webhook secret. The secrets loaded from a file are reloaded when the
+// file changes. Nil backend secrets leave the inbound signatures unchanged.
+type backendSecrets struct {
+	file    string
+	logger  *zap.Logger
+	current atomic.Pointer[map[string]string]
+}
+
+// backendSecretsFromEnv loads the backend secrets set by the SPRAYPROXY_BACKEND_SECRETS env var,
+// or the file it points to. It returns nil if none is set.
+func backendSecretsFromEnv(logger *zap.Logger) (*backendSecrets, error) {
+	s := &backendSecrets{file: os.Getenv(envBackendSecretsFile), logger: logger}
+	if s.file != "" && os.Getenv(envBackendSecrets) != "" {
+		return nil, fmt.Errorf("%s and %s_FILE cannot be both set", envBackendSecrets, envBackendSecrets)
+	}
+	if s.file == "" && os.Getenv(envBackendSecrets) == "" {
+		return nil, nil
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the secrets from the env var or file. The current secrets are only replaced if the
+// new ones are valid.
+func (s *backendSecrets) load() error {
+	data := os.Getenv(envBackendSecrets)
+	if s.file != "" {
+		content, err := os.ReadFile(s.file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %v", envBackendSecrets, err)
+		}
+		data = string(content)
+	}
+	secrets := map[string]string{}
+	if err := yaml.Unmarshal([]byte(data), &secrets); err != nil {
+		return fmt.Errorf("invalid %s, expected secrets by backend name or URL: %v", envBackendSecrets, err)
+	}
+	for backend, secret := range secrets {
+		if backend == "" {
+			return errors.New("backend secret has no backend name or URL")
+		}
+		if secret == "" {
+			return fmt.Errorf("backend secret of %q has no value", backend)
+		}
+	}
+	s.current.Store(&secrets)
+	return nil
+}
+
+// get returns the secret of the backend, looked up by name and then by URL. Only the static
+// backends are looked up by name, as the API could otherwise register a backend with the name of
+// another one to get its secret.
+func (s *backendSecrets) get(url string, b *v1alpha1.Backend) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	secrets := *s.current.Load()
+	if b != nil && b.Static && b.Name != "" {
+		if secret, ok := secrets[b.Name]; ok {
+			return secret, true
+		}
+	}
+	secret, ok := secrets[url]
+	return secret, ok
+}
+
+// watch reloads the secrets when the file changes, until stopCh is closed.
+func (s *backendSecrets) watch(stopCh <-chan struct{}) {
+	filewatch.Watch(stopCh, []string{s.file}, "backend secret", s.logger, func() {
+		if err := s.load(); err != nil {
+			metrics.IncBackendSecretReloadCount("failure")
+			s.logger.Error("failed to reload backend secrets, keeping the current ones", zap.Error(err))
+			return
+		}
+		metrics.IncBackendSecretReloadCount("success")
+		s.logger.Info(fmt.Sprintf("reloaded %d backend secrets", len(*s.current.Load())))
+	})
+}
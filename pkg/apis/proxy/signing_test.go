@@ -0,0 +1,215 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+func TestBackendSecretsFromEnv(t *testing.T) {
+	secrets, err := backendSecretsFromEnv(zap.NewNop())
+	if err != nil || secrets != nil {
+		t.Errorf("expected no backend secrets by default, got %v, %v", secrets, err)
+	}
+	if _, ok := secrets.get("http://cluster-a", nil); ok {
+		t.Errorf("expected nil backend secrets to have no secret")
+	}
+
+	t.Setenv(envBackendSecrets, `
+cluster-a: secret-a
+http://cluster-b: secret-b
+`)
+	secrets, err = backendSecretsFromEnv(zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, test := range []struct {
+		url      string
+		backend  *v1alpha1.Backend
+		expected string
+	}{
+		{url: "http://cluster-a", backend: &v1alpha1.Backend{URL: "http://cluster-a", Name: "cluster-a", Static: true}, expected: "secret-a"},
+		{url: "http://cluster-b", backend: &v1alpha1.Backend{URL: "http://cluster-b", Name: "cluster-b", Static: true}, expected: "secret-b"},
+		// backends registered with the API are looked up by URL only
+		{url: "http://cluster-c", backend: &v1alpha1.Backend{URL: "http://cluster-c", Name: "cluster-a"}},
+		// backends without name are looked up by URL only
+		{url: "http://cluster-b", expected: "secret-b"},
+		{url: "http://cluster-a"},
+	} {
+		if secret, _ := secrets.get(test.url, test.backend); secret != test.expected {
+			t.Errorf("expected secret %q for %s, got %q", test.expected, test.url, secret)
+		}
+	}
+
+	for name, value := range map[string]string{
+		"not a map": "[secret-a]",
+		"no value":  "{cluster-a: ''}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(envBackendSecrets, value)
+			if _, err := backendSecretsFromEnv(zap.NewNop()); err == nil {
+				t.Errorf("expected error for %s=%s", envBackendSecrets, value)
+			}
+		})
+	}
+	t.Setenv(envBackendSecretsFile, filepath.Join(t.TempDir(), "secrets.yaml"))
+	if _, err := backendSecretsFromEnv(zap.NewNop()); err == nil {
+		t.Errorf("expected error for secrets set by both env var and file")
+	}
+}
+
+func TestBackendSecretsReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secrets.yaml")
+	if err := os.WriteFile(file, []byte("cluster-a: secret-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envBackendSecretsFile, file)
+	secrets, err := backendSecretsFromEnv(zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go secrets.watch(stopCh)
+	// let the watcher start before changing the file
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(file, []byte("cluster-a: secret-a2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	backend := &v1alpha1.Backend{URL: "http://cluster-a", Name: "cluster-a", Static: true}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if secret, _ := secrets.get(backend.URL, backend); secret == "secret-a2" {
+			return
+		}
+	}
+	t.Errorf("expected the backend secrets to be reloaded")
+}
+
+func TestVerifierSign(t *testing.T) {
+	acme, err := newHMACVerifier(hmacVerifierConfig{Name: "acme", Header: "X-Acme-Signature", Encoding: "base64", Prefix: "v1,"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	builtin := builtinVerifiers()
+	for _, test := range []struct {
+		verifier Verifier
+		header   map[string]string
+	}{
+		{verifier: builtin[VerifierGitHub], header: map[string]string{"X-Hub-Signature-256": generateSignature(jsonBody, secret)}},
+		{verifier: builtin[VerifierGitLab], header: map[string]string{"X-Gitlab-Token": secret}},
+		{verifier: builtin[VerifierBitbucket], header: map[string]string{"X-Hub-Signature": "sha256=" + hmacHex(jsonBody, secret)}},
+		{verifier: builtin[VerifierGitea], header: map[string]string{"X-Gitea-Signature": hmacHex(jsonBody, secret)}},
+		{verifier: acme, header: map[string]string{"X-Acme-Signature": "v1,signature"}},
+	} {
+		req := newWebhookRequest(test.header)
+		test.verifier.Sign(req.Header, []byte(jsonBody), "backendSecret")
+		if err := test.verifier.Verify(req, []byte(jsonBody), "backendSecret"); err != nil {
+			t.Errorf("%s: expected request signed with the backend secret, got %v", test.verifier.Name(), err)
+		}
+	}
+
+	// signature headers which are not set are not added
+	header := http.Header{"X-Hub-Signature": []string{"sha256=" + hmacHex(jsonBody, secret)}}
+	builtin[VerifierGitHub].Sign(header, []byte(jsonBody), "backendSecret")
+	if header.Get("X-Hub-Signature-256") != "" || header.Get("X-Hub-Signature") != "sha256="+hmacHex(jsonBody, secret) {
+		t.Errorf("expected GitHub verifier to leave other signatures unchanged, got %v", header)
+	}
+	header = http.Header{"X-Hub-Signature": []string{"sha1=signature"}}
+	builtin[VerifierGitHub].Sign(header, []byte(jsonBody), "backendSecret")
+	if header.Get("X-Hub-Signature") == "sha1=signature" {
+		t.Errorf("expected GitHub verifier to replace the SHA-1 signature")
+	}
+}
+
+func TestForwardSignsRequests(t *testing.T) {
+	t.Setenv(envWebhookSecret, secret)
+	t.Setenv(envBackendSecrets, "cluster-a: secret-a")
+	signatures := make(chan string, 2)
+	signed := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		signatures <- "signed " + req.Header.Get("X-Hub-Signature-256")
+	}))
+	defer signed.Close()
+	unsigned := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		signatures <- "unsigned " + req.Header.Get("X-Hub-Signature-256")
+	}))
+	defer unsigned.Close()
+	proxy, err := NewSprayProxy(false, false, false, zap.NewNop(), map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.backends = newBackendRegistry(map[string]*v1alpha1.Backend{
+		signed.URL:   {URL: signed.URL, Name: "cluster-a", Static: true},
+		unsigned.URL: {URL: unsigned.URL},
+	})
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	expected := map[string]bool{
+		"signed " + generateSignature(newProxyRequestBody(), "secret-a"): true,
+		"unsigned " + generateSignature(newProxyRequestBody(), secret):   true,
+	}
+	for i := 0; i < 2; i++ {
+		if signature := <-signatures; !expected[signature] {
+			t.Errorf("unexpected signature received by the backend: %s", signature)
+		}
+	}
+
+	// backends must not trust requests the proxy did not verify
+	if _, err := NewSprayProxy(false, true, false, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error for backend secrets without webhook verification")
+	}
+}
+
+func TestForwardStripsTokens(t *testing.T) {
+	t.Setenv(envWebhookSecrets, "[{name: gitlab, secret: gitlab-token, providers: [gitlab]}]")
+	t.Setenv(envBackendSecrets, "cluster-a: secret-a")
+	t.Setenv("SPRAYPROXY_WEBHOOK_PROVIDERS", "gitlab")
+	tokens := make(chan string, 2)
+	signed := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		tokens <- "signed " + req.Header.Get("X-Gitlab-Token")
+	}))
+	defer signed.Close()
+	unsigned := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		tokens <- "unsigned " + req.Header.Get("X-Gitlab-Token")
+	}))
+	defer unsigned.Close()
+	proxy, err := NewSprayProxy(false, false, false, zap.NewNop(), map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.backends = newBackendRegistry(map[string]*v1alpha1.Backend{
+		signed.URL:   {URL: signed.URL, Name: "cluster-a", Static: true},
+		unsigned.URL: {URL: unsigned.URL},
+	})
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newWebhookRequest(map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "gitlab-token"})
+	proxy.HandleProxy(ctx)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	// the backend without secret does not get the webhook secret
+	expected := map[string]bool{"signed secret-a": true, "unsigned ": true}
+	for i := 0; i < 2; i++ {
+		if token := <-tokens; !expected[token] {
+			t.Errorf("unexpected token received by the backend: %s", token)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+)
+
+// number of recent latencies the percentiles are computed from, for each backend
+const latencySamples = 512
+
+// backendStats tracks the outcome of the requests forwarded to a single backend.
+type backendStats struct {
+	lastSuccess         time.Time
+	lastError           string
+	lastErrorAt         time.Time
+	consecutiveFailures int
+	// latencies is a ring buffer of the recent latencies, next is the position of the next sample
+	latencies []time.Duration
+	next      int
+}
+
+// statsTracker holds the forwarding statistics of the backends, keyed by URL.
+type statsTracker struct {
+	mu       sync.Mutex
+	backends map[string]*backendStats
+}
+
+func newStatsTracker() *statsTracker {
+	return &statsTracker{backends: map[string]*backendStats{}}
+}
+
+// record updates the statistics of the backend with the result of a forward.
+func (t *statsTracker) record(result forwardResult, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.backends[result.backend]
+	if !ok {
+		s = &backendStats{}
+		t.backends[result.backend] = s
+	}
+	if result.failed() {
+		s.lastError = result.errorMessage()
+		s.lastErrorAt = now
+		s.consecutiveFailures++
+	} else {
+		s.lastSuccess = now
+		s.consecutiveFailures = 0
+	}
+	// requests which could not be sent have no latency
+	if result.latency == 0 {
+		return
+	}
+	if len(s.latencies) < latencySamples {
+		s.latencies = append(s.latencies, result.latency)
+		return
+	}
+	s.latencies[s.next] = result.latency
+	s.next = (s.next + 1) % latencySamples
+}
+
+// get returns the statistics of the backend. They are empty if nothing was forwarded to it yet.
+func (t *statsTracker) get(backend string) v1alpha1.BackendStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := v1alpha1.BackendStats{}
+	s, ok := t.backends[backend]
+	if !ok {
+		return stats
+	}
+	if !s.lastSuccess.IsZero() {
+		lastSuccess := s.lastSuccess.UTC()
+		stats.LastSuccess = &lastSuccess
+	}
+	if !s.lastErrorAt.IsZero() {
+		lastErrorAt := s.lastErrorAt.UTC()
+		stats.LastError, stats.LastErrorAt = s.lastError, &lastErrorAt
+	}
+	stats.ConsecutiveFailures = s.consecutiveFailures
+	if len(s.latencies) > 0 {
+		sorted := append([]time.Duration{}, s.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		stats.LatencyP50Ms = percentile(sorted, 0.50)
+		stats.LatencyP99Ms = percentile(sorted, 0.99)
+	}
+	return stats
+}
+
+// prune drops the statistics of the backends which are not registered anymore.
+func (t *statsTracker) prune(snapshot *backendSnapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for backend := range t.backends {
+		if _, ok := snapshot.get(backend); !ok {
+			delete(t.backends, backend)
+		}
+	}
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies, in milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return float64(sorted[rank]) / float64(time.Millisecond)
+}
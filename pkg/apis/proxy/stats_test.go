@@ -0,0 +1,133 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+func TestStatsTracker(t *testing.T) {
+	tracker := newStatsTracker()
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		tracker.record(forwardResult{backend: "http://a", status: http.StatusOK, latency: time.Duration(i) * time.Millisecond}, now)
+	}
+	tracker.record(forwardResult{backend: "http://a", status: http.StatusServiceUnavailable, latency: time.Second}, now.Add(time.Second))
+	tracker.record(forwardResult{backend: "http://a", err: errors.New("connection refused")}, now.Add(2*time.Second))
+
+	stats := tracker.get("http://a")
+	if stats.LastSuccess == nil || !stats.LastSuccess.Equal(now) {
+		t.Errorf("expected last success at %s, got %v", now, stats.LastSuccess)
+	}
+	if stats.LastError != "connection refused" || stats.LastErrorAt == nil || !stats.LastErrorAt.Equal(now.Add(2*time.Second)) {
+		t.Errorf("expected last error %q, got %q at %v", "connection refused", stats.LastError, stats.LastErrorAt)
+	}
+	if stats.ConsecutiveFailures != 2 {
+		t.Errorf("expected 2 consecutive failures, got %d", stats.ConsecutiveFailures)
+	}
+	// the failed connection has no latency, so there are 101 samples
+	if stats.LatencyP50Ms != 51 || stats.LatencyP99Ms != 100 {
+		t.Errorf("expected p50 51ms and p99 100ms, got %vms and %vms", stats.LatencyP50Ms, stats.LatencyP99Ms)
+	}
+
+	tracker.record(forwardResult{backend: "http://a", status: http.StatusOK, latency: time.Millisecond}, now)
+	if stats := tracker.get("http://a"); stats.ConsecutiveFailures != 0 {
+		t.Errorf("expected consecutive failures to be reset, got %d", stats.ConsecutiveFailures)
+	}
+	for i := 0; i < 2*latencySamples; i++ {
+		tracker.record(forwardResult{backend: "http://a", status: http.StatusOK, latency: time.Second}, now)
+	}
+	if stats := tracker.get("http://a"); stats.LatencyP50Ms != 1000 {
+		t.Errorf("expected only recent latencies to be kept, got p50 %vms", stats.LatencyP50Ms)
+	}
+
+	tracker.prune(newBackendSnapshot(1, map[string]*v1alpha1.Backend{}))
+	if stats := tracker.get("http://a"); stats.LastSuccess != nil {
+		t.Errorf("expected stats of unregistered backend to be dropped, got %+v", stats)
+	}
+}
+
+func TestGetBackends(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+	// a closed server, so that forwarding to it fails
+	closed := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	closed.Close()
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	proxy.backends = newBackendRegistry(map[string]*v1alpha1.Backend{
+		backend.URL: {URL: backend.URL, Name: "cluster-a", Owner: "build-team"},
+		closed.URL:  {URL: closed.URL},
+	})
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = newProxyRequest()
+	proxy.HandleProxy(ctx)
+
+	get := func(handler gin.HandlerFunc, target string, params ...gin.Param) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, target, nil)
+		ctx.Params = params
+		handler(ctx)
+		return w
+	}
+
+	w = get(proxy.GetBackends, "/backends")
+	list := v1alpha1.BackendList{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("expected a json response, got %q: %v", w.Body.String(), err)
+	}
+	items := map[string]v1alpha1.BackendStatus{}
+	for _, item := range list.Items {
+		items[item.URL] = item
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 backends, got %+v", list)
+	}
+	a := items[backend.URL]
+	if a.URL != backend.URL || a.ID != "cluster-a" || a.Owner != "build-team" {
+		t.Errorf("expected backend settings, got %+v", a)
+	}
+	if a.Stats.LastSuccess == nil || a.Stats.LatencyP50Ms <= 0 {
+		t.Errorf("expected forwarding statistics, got %+v", a.Stats)
+	}
+	b := items[closed.URL]
+	if b.ID == "" || b.Stats.ConsecutiveFailures != 1 || b.Stats.LastError == "" {
+		t.Errorf("expected failure statistics, got %+v", b)
+	}
+
+	if w := get(proxy.GetBackends, "/backends?format=text"); w.Body.String() != "Backend urls: "+strings.Join(proxy.Backends(), ", ") {
+		t.Errorf("expected plain text list of urls, got %q", w.Body.String())
+	}
+	if w := get(proxy.GetBackends, "/backends?format=xml"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for unsupported format, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = get(proxy.GetBackend, "/backends/"+b.ID, gin.Param{Key: "id", Value: b.ID})
+	status := v1alpha1.BackendStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status.URL != closed.URL {
+		t.Errorf("expected backend %q, got %q", closed.URL, w.Body.String())
+	}
+	if w := get(proxy.GetBackend, "/backends/unknown", gin.Param{Key: "id", Value: "unknown"}); w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w.Header().Get(backendsGenerationHeader) != "0" {
+		t.Errorf("expected generation header, got %q", w.Header().Get(backendsGenerationHeader))
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"github.com/redhat-appstudio/sprayproxy/pkg/kube"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// key of the backends in the ConfigMap data
+	configMapBackendsKey = "backends.yaml"
+	// number of attempts to update the stored backends on concurrent modifications
+	storeUpdateAttempts = 5
+	storeTimeout        = 10 * time.Second
+)
+
+// errStoreConflict is returned when the stored backends were modified since they were loaded.
+var errStoreConflict = errors.New("stored backends were modified concurrently")
+
+// backendStore persists the registered backends, so that they survive restarts and are shared
+// by the proxy replicas.
+type backendStore interface {
+	// load returns the stored backends, along with a version identifying their current state.
+	// The version is empty if nothing was stored yet.
+	load(ctx context.Context) ([]v1alpha1.Backend, string, error)
+	// save replaces the stored backends, and returns their new version. It fails with
+	// errStoreConflict if the backends were modified since version was loaded.
+	save(ctx context.Context, backends []v1alpha1.Backend, version string) (string, error)
+	// String describes the store for logging.
+	String() string
+}
+
+// backendStoreFromEnv creates the backend store configured by the environment, if any.
+func backendStoreFromEnv() (backendStore, error) {
+	file := os.Getenv("SPRAYPROXY_BACKENDS_STORE_FILE")
+	configMap := os.Getenv("SPRAYPROXY_BACKENDS_STORE_CONFIGMAP")
+	switch {
+	case file != "" && configMap != "":
+		return nil, errors.New("SPRAYPROXY_BACKENDS_STORE_FILE and SPRAYPROXY_BACKENDS_STORE_CONFIGMAP are mutually exclusive")
+	case file != "":
+		return newFileBackendStore(file), nil
+	case configMap != "":
+		namespace, name, found := strings.Cut(configMap, "/")
+		if !found {
+			name = namespace
+			var err error
+			if namespace, err = kube.InClusterNamespace(); err != nil {
+				return nil, fmt.Errorf("failed to read the namespace of the backends ConfigMap: %v", err)
+			}
+		}
+		client, err := kube.NewInClusterClient()
+		if err != nil {
+			return nil, err
+		}
+		return newConfigMapBackendStore(client.ConfigMaps(namespace), namespace, name), nil
+	}
+	return nil, nil
+}
+
+// fileBackendStore persists the backends in a local file, in YAML if the file has a .yaml or
+// .yml extension, in JSON otherwise.
+type fileBackendStore struct {
+	path string
+	// mu serializes the saves of this process, concurrent writers sharing the file are only
+	// detected by the version check
+	mu sync.Mutex
+}
+
+func newFileBackendStore(path string) *fileBackendStore {
+	return &fileBackendStore{path: path}
+}
+
+func (s *fileBackendStore) String() string {
+	return "file " + s.path
+}
+
+func (s *fileBackendStore) load(ctx context.Context) ([]v1alpha1.Backend, string, error) {
+	data, version, err := s.read()
+	if err != nil || version == "" {
+		return nil, version, err
+	}
+	backends, err := decodeBackends(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	return backends, version, nil
+}
+
+func (s *fileBackendStore) save(ctx context.Context, backends []v1alpha1.Backend, version string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, current, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	if current != version {
+		return "", errStoreConflict
+	}
+	ext := filepath.Ext(s.path)
+	data, err := encodeBackends(backends, ext == ".yaml" || ext == ".yml")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return "", err
+	}
+	return fileVersion(data), nil
+}
+
+// read returns the file content and its version, which is empty if the file does not exist.
+func (s *fileBackendStore) read() ([]byte, string, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, fileVersion(data), nil
+}
+
+func fileVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// configMapBackendStore persists the backends in a Kubernetes ConfigMap. The resource version
+// of the ConfigMap is used to detect concurrent modifications by other replicas.
+type configMapBackendStore struct {
+	configMaps kube.ConfigMapInterface
+	namespace  string
+	name       string
+}
+
+func newConfigMapBackendStore(configMaps kube.ConfigMapInterface, namespace, name string) *configMapBackendStore {
+	return &configMapBackendStore{configMaps: configMaps, namespace: namespace, name: name}
+}
+
+func (s *configMapBackendStore) String() string {
+	return fmt.Sprintf("configmap %s/%s", s.namespace, s.name)
+}
+
+func (s *configMapBackendStore) load(ctx context.Context) ([]v1alpha1.Backend, string, error) {
+	cm, err := s.configMaps.Get(ctx, s.name)
+	if kube.IsNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	backends, err := decodeBackends([]byte(cm.Data[configMapBackendsKey]))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse %s: %v", s, err)
+	}
+	return backends, cm.Metadata.ResourceVersion, nil
+}
+
+func (s *configMapBackendStore) save(ctx context.Context, backends []v1alpha1.Backend, version string) (string, error) {
+	data, err := encodeBackends(backends, true)
+	if err != nil {
+		return "", err
+	}
+	cm := &kube.ConfigMap{
+		Metadata: kube.ObjectMeta{Name: s.name, ResourceVersion: version},
+		Data:     map[string]string{configMapBackendsKey: string(data)},
+	}
+	if version == "" {
+		cm, err = s.configMaps.Create(ctx, cm)
+	} else {
+		cm, err = s.configMaps.Update(ctx, cm)
+	}
+	if kube.IsConflict(err) {
+		return "", errStoreConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	return cm.Metadata.ResourceVersion, nil
+}
+
+func decodeBackends(data []byte) ([]v1alpha1.Backend, error) {
+	backends := []v1alpha1.Backend{}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return backends, nil
+	}
+	if err := unmarshalYAMLOrJSON(data, &backends); err != nil {
+		return nil, err
+	}
+	for i := range backends {
+		if err := validateBackend(&backends[i]); err != nil {
+			return nil, fmt.Errorf("backend %s: %v", backends[i].URL, err)
+		}
+	}
+	return backends, nil
+}
+
+// encodeBackends serializes the backends in JSON, or in YAML with the JSON field names.
+func encodeBackends(backends []v1alpha1.Backend, asYAML bool) ([]byte, error) {
+	data, err := json.MarshalIndent(backends, "", "  ")
+	if err != nil || !asYAML {
+		return data, err
+	}
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+// updateStoredBackends applies the change to the stored backends, retrying on concurrent
+// modifications. The change returns false if there is nothing to save.
+func updateStoredBackends(ctx context.Context, store backendStore, change func(map[string]*v1alpha1.Backend) bool) (map[string]*v1alpha1.Backend, error) {
+	for attempt := 1; ; attempt++ {
+		stored, version, err := store.load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		backends := backendsByURL(stored)
+		if !change(backends) {
+			return backends, nil
+		}
+		_, err = store.save(ctx, sortedBackends(backends), version)
+		if err == nil {
+			return backends, nil
+		}
+		if !errors.Is(err, errStoreConflict) || attempt >= storeUpdateAttempts {
+			return nil, err
+		}
+	}
+}
+
+func backendsByURL(list []v1alpha1.Backend) map[string]*v1alpha1.Backend {
+	backends := make(map[string]*v1alpha1.Backend, len(list))
+	for i := range list {
+		backends[list[i].URL] = &list[i]
+	}
+	return backends
+}
+
+func sortedBackends(backends map[string]*v1alpha1.Backend) []v1alpha1.Backend {
+	list := make([]v1alpha1.Backend, 0, len(backends))
+	for _, url := range newBackendSnapshot(0, backends).urls {
+		list = append(list, *backends[url])
+	}
+	return list
+}
+
+// initBackendStore merges the configured backends into the stored ones, and registers them all.
+// The stored static backends which are no longer configured are removed.
+func (p *SprayProxy) initBackendStore(configured map[string]*v1alpha1.Backend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	backends, err := updateStoredBackends(ctx, p.store, func(stored map[string]*v1alpha1.Backend) bool {
+		changed := false
+		for url, b := range stored {
+			if _, ok := configured[url]; b.Static && !ok {
+				delete(stored, url)
+				changed = true
+			}
+		}
+		for url, b := range configured {
+			if existing, ok := stored[url]; !ok || !backendsEqual(existing, b) {
+				stored[url] = b
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return err
+	}
+	p.backends.replace(backends)
+	return nil
+}
+
+// updateBackend applies the change to the backend registered with the URL, saving it in the
+// store first if enabled. It returns false if there was nothing to change.
+func (p *SprayProxy) updateBackend(url string, change backendChange) (bool, error) {
+	if p.store == nil {
+		return p.backends.update(url, change), nil
+	}
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	applied := false
+	backends, err := updateStoredBackends(ctx, p.store, func(stored map[string]*v1alpha1.Backend) bool {
+		var next *v1alpha1.Backend
+		if next, applied = change(stored[url], stored); !applied {
+			return false
+		}
+		if next == nil {
+			delete(stored, url)
+		} else {
+			stored[url] = next
+		}
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+	// include the changes of the other replicas
+	p.backends.replace(backends)
+	return applied, nil
+}
+
+// addBackend registers the backend. It returns false if the backend is already registered, or
+// the URL of another backend with the same name.
+func (p *SprayProxy) addBackend(b *v1alpha1.Backend) (bool, string, error) {
+	conflict := ""
+	added, err := p.updateBackend(b.URL, func(existing *v1alpha1.Backend, backends map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool) {
+		if existing != nil {
+			return nil, false
+		}
+		if url, ok := backendNameConflict(backends, b); ok {
+			conflict = url
+			return nil, false
+		}
+		return b, true
+	})
+	return added, conflict, err
+}
+
+// removeBackend unregisters the backend. It returns false if the backend is not registered.
+func (p *SprayProxy) removeBackend(url string) (bool, error) {
+	return p.updateBackend(url, func(existing *v1alpha1.Backend, _ map[string]*v1alpha1.Backend) (*v1alpha1.Backend, bool) {
+		return nil, existing != nil
+	})
+}
+
+// reloadBackends registers the stored backends, picking up the changes made by other replicas.
+func (p *SprayProxy) reloadBackends() error {
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	stored, _, err := p.store.load(ctx)
+	if err != nil {
+		return err
+	}
+	p.backends.replace(backendsByURL(stored))
+	return nil
+}
+
+// runBackendStore reloads the stored backends periodically until stopCh is closed.
+func (p *SprayProxy) runBackendStore(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(p.storeSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := p.reloadBackends(); err != nil {
+				p.logger.Error("failed to reload backends: "+err.Error(), zap.String("store", p.store.String()))
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"github.com/redhat-appstudio/sprayproxy/pkg/kube/kubetest"
+	"go.uber.org/zap"
+)
+
+func TestBackendStores(t *testing.T) {
+	dir := t.TempDir()
+	for _, store := range []backendStore{
+		newFileBackendStore(filepath.Join(dir, "backends.json")),
+		newFileBackendStore(filepath.Join(dir, "backends.yaml")),
+		newConfigMapBackendStore(kubetest.NewConfigMaps(), "sprayproxy", "backends"),
+	} {
+		ctx := context.Background()
+		backends, version, err := store.load(ctx)
+		if err != nil || len(backends) != 0 || version != "" {
+			t.Fatalf("%s: expected empty store, got %v at version %q (%v)", store, backends, version, err)
+		}
+		saved := []v1alpha1.Backend{
+			{URL: "http://a", PathRewrite: &v1alpha1.PathRewrite{StripPrefix: "/github"}},
+			{URL: "http://b"},
+		}
+		version, err = store.save(ctx, saved, "")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", store, err)
+		}
+		if _, err := store.save(ctx, saved, ""); !errors.Is(err, errStoreConflict) {
+			t.Errorf("%s: expected conflict when saving an outdated version, got %v", store, err)
+		}
+		backends, loadedVersion, err := store.load(ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", store, err)
+		}
+		if loadedVersion != version {
+			t.Errorf("%s: expected version %q, got %q", store, version, loadedVersion)
+		}
+		if len(backends) != 2 || backends[0].PathRewrite == nil || backends[0].PathRewrite.StripPrefix != "/github" || backends[1].URL != "http://b" {
+			t.Errorf("%s: expected saved backends, got %+v", store, backends)
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "backends.yaml"))
+	if !strings.Contains(string(data), "stripPrefix: /github") {
+		t.Errorf("expected YAML with JSON field names, got %s", data)
+	}
+}
+
+func registerBackend(proxy *SprayProxy, handler gin.HandlerFunc, url string) int {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/backends", bytes.NewBufferString(fmt.Sprintf(`{"url":%q}`, url)))
+	handler(ctx)
+	return w.Code
+}
+
+func TestBackendsFileStore(t *testing.T) {
+	t.Setenv("SPRAYPROXY_BACKENDS_STORE_FILE", filepath.Join(t.TempDir(), "backends.yaml"))
+	proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{"http://static": ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	if code := registerBackend(proxy, proxy.RegisterBackend, "http://dynamic-1"); code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+	}
+	if code := registerBackend(proxy, proxy.RegisterBackend, "http://dynamic-2"); code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+	}
+	if code := registerBackend(proxy, proxy.UnregisterBackend, "http://dynamic-1"); code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	// restart the proxy
+	restarted, err := NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{"http://static": ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	expected := []string{"http://dynamic-2", "http://static"}
+	if backends := restarted.Backends(); strings.Join(backends, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected backends %v after restart, got %v", expected, backends)
+	}
+	if b, _ := restarted.backends.get("http://static"); !b.Static {
+		t.Errorf("expected configured backend to be static")
+	}
+	if b, _ := restarted.backends.get("http://dynamic-2"); b.Static {
+		t.Errorf("expected registered backend not to be static")
+	}
+
+	// restart the proxy without the static backend, which is removed from the store
+	restarted, err = NewSprayProxy(false, true, true, zap.NewNop(), map[string]string{"http://other": ""})
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	expected = []string{"http://dynamic-2", "http://other"}
+	if backends := restarted.Backends(); strings.Join(backends, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected backends %v after restart, got %v", expected, backends)
+	}
+}
+
+func TestBackendsConfigMapStore(t *testing.T) {
+	configMaps := kubetest.NewConfigMaps()
+	replicas := []*SprayProxy{}
+	for i := 0; i < 2; i++ {
+		proxy, err := NewSprayProxy(false, true, true, zap.NewNop(), nil)
+		if err != nil {
+			t.Fatalf("failed to set up proxy: %v", err)
+		}
+		proxy.store = newConfigMapBackendStore(configMaps, "sprayproxy", "backends")
+		if err := proxy.initBackendStore(nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		replicas = append(replicas, proxy)
+	}
+
+	// concurrent registrations on both replicas conflict, and are retried
+	wg := sync.WaitGroup{}
+	for i, proxy := range replicas {
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func(proxy *SprayProxy, url string) {
+				defer wg.Done()
+				if code := registerBackend(proxy, proxy.RegisterBackend, url); code != http.StatusOK {
+					t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+				}
+			}(proxy, fmt.Sprintf("http://replica-%d-%d", i, j))
+		}
+	}
+	wg.Wait()
+	if code := registerBackend(replicas[1], replicas[1].UnregisterBackend, "http://replica-0-0"); code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	for _, proxy := range replicas {
+		if err := proxy.reloadBackends(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if backends := proxy.Backends(); len(backends) != 5 || backends[0] != "http://replica-0-1" {
+			t.Errorf("expected the registrations of all replicas, got %v", backends)
+		}
+	}
+	cm, err := configMaps.Get(context.Background(), "backends")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(cm.Data[configMapBackendsKey], "url: http://replica-1-2") {
+		t.Errorf("expected backends in ConfigMap, got %q", cm.Data[configMapBackendsKey])
+	}
+}
+
+func TestBackendStoreEnv(t *testing.T) {
+	t.Setenv("SPRAYPROXY_BACKENDS_STORE_FILE", filepath.Join(t.TempDir(), "backends.json"))
+	t.Setenv("SPRAYPROXY_BACKENDS_STORE_CONFIGMAP", "sprayproxy/backends")
+	if _, err := NewSprayProxy(false, true, true, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error when both stores are set")
+	}
+	t.Setenv("SPRAYPROXY_BACKENDS_STORE_CONFIGMAP", "")
+	t.Setenv("SPRAYPROXY_BACKENDS_STORE_SYNC_INTERVAL", "soon")
+	if _, err := NewSprayProxy(false, true, true, zap.NewNop(), nil); err == nil {
+		t.Errorf("expected error for invalid sync interval")
+	}
+}
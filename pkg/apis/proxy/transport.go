@@ -0,0 +1,170 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// transportConfig holds the settings of the connections to the backends.
+type transportConfig struct {
+	keepAlive bool
+	// maxIdleConns is the number of idle connections kept for each backend
+	maxIdleConns        int
+	idleConnTimeout     time.Duration
+	http2               bool
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+}
+
+// transportConfigFromEnv returns the transport settings, overridden by the
+// SPRAYPROXY_TRANSPORT_* env vars.
+func transportConfigFromEnv() (transportConfig, error) {
+	config := transportConfig{
+		keepAlive:           true,
+		maxIdleConns:        16,
+		idleConnTimeout:     90 * time.Second,
+		http2:               true,
+		dialTimeout:         30 * time.Second,
+		tlsHandshakeTimeout: 10 * time.Second,
+	}
+	for env, value := range map[string]*bool{
+		"SPRAYPROXY_TRANSPORT_KEEP_ALIVE": &config.keepAlive,
+		"SPRAYPROXY_TRANSPORT_HTTP2":      &config.http2,
+	} {
+		if v := os.Getenv(env); v != "" {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				return config, fmt.Errorf("invalid %s %q", env, v)
+			}
+			*value = enabled
+		}
+	}
+	if v := os.Getenv("SPRAYPROXY_TRANSPORT_MAX_IDLE_CONNS_PER_BACKEND"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return config, fmt.Errorf("invalid SPRAYPROXY_TRANSPORT_MAX_IDLE_CONNS_PER_BACKEND %q", v)
+		}
+		config.maxIdleConns = n
+	}
+	for env, value := range map[string]*time.Duration{
+		"SPRAYPROXY_TRANSPORT_IDLE_CONN_TIMEOUT":     &config.idleConnTimeout,
+		"SPRAYPROXY_TRANSPORT_DIAL_TIMEOUT":          &config.dialTimeout,
+		"SPRAYPROXY_TRANSPORT_TLS_HANDSHAKE_TIMEOUT": &config.tlsHandshakeTimeout,
+	} {
+		if v := os.Getenv(env); v != "" {
+			duration, err := time.ParseDuration(v)
+			if err != nil || duration <= 0 {
+				return config, fmt.Errorf("invalid %s %q, expected a positive duration", env, v)
+			}
+			*value = duration
+		}
+	}
+	return config, nil
+}
+
+// transportEntry is the transport of a backend, along with the TLS settings it was created with.
+type transportEntry struct {
+	settings  string
+	transport *http.Transport
+}
+
+// transports holds a transport per backend, so connections are kept alive and reused across
+// requests. Transports are created on first use, and replaced when the TLS settings of the
+// backend change.
+type transports struct {
+	config   transportConfig
+	mu       sync.Mutex
+	backends map[string]*transportEntry
+}
+
+func newTransports(config transportConfig) *transports {
+	return &transports{config: config, backends: map[string]*transportEntry{}}
+}
+
+// get returns the transport of the backend, creating it with the TLS configuration returned by
+// tlsConfig if the backend has none yet or if its settings changed.
+func (t *transports) get(url, settings string, tlsConfig func() *tls.Config) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	existing, ok := t.backends[url]
+	if ok && existing.settings == settings {
+		return existing.transport
+	}
+	if ok {
+		existing.transport.CloseIdleConnections()
+	}
+	transport := t.newTransport(tlsConfig())
+	t.backends[url] = &transportEntry{settings: settings, transport: transport}
+	return transport
+}
+
+func (t *transports) newTransport(tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: t.config.dialTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   t.config.tlsHandshakeTimeout,
+		DisableKeepAlives:     !t.config.keepAlive,
+		MaxIdleConnsPerHost:   t.config.maxIdleConns,
+		IdleConnTimeout:       t.config.idleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     t.config.http2,
+	}
+	if !t.config.http2 {
+		// a non-nil empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// prune closes the transports of the backends which are no longer registered.
+func (t *transports) prune(snapshot *backendSnapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for url, existing := range t.backends {
+		if _, ok := snapshot.get(url); !ok {
+			existing.transport.CloseIdleConnections()
+			delete(t.backends, url)
+		}
+	}
+}
+
+// backendTransport returns the transport used to forward requests to the backend.
+func (p *SprayProxy) backendTransport(url string, b *v1alpha1.Backend) *http.Transport {
+	settings := ""
+	if b != nil && b.TLS != nil {
+		data, _ := json.Marshal(b.TLS)
+		settings = string(data)
+	}
+	return p.transports.get(url, settings, func() *tls.Config {
+		return p.backendTLSConfig(url, b)
+	})
+}
+
+// traceConnections reports in the metrics whether the request reused an idle connection.
+func traceConnections(req *http.Request) *http.Request {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metrics.IncBackendConnectionCount(host, info.Reused)
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy/v1alpha1"
+	"go.uber.org/zap"
+)
+
+func TestTransportConfigFromEnv(t *testing.T) {
+	config, err := transportConfigFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !config.keepAlive || !config.http2 || config.maxIdleConns != 16 || config.idleConnTimeout != 90*time.Second {
+		t.Errorf("unexpected default transport settings %+v", config)
+	}
+
+	t.Setenv("SPRAYPROXY_TRANSPORT_KEEP_ALIVE", "false")
+	t.Setenv("SPRAYPROXY_TRANSPORT_HTTP2", "false")
+	t.Setenv("SPRAYPROXY_TRANSPORT_MAX_IDLE_CONNS_PER_BACKEND", "4")
+	t.Setenv("SPRAYPROXY_TRANSPORT_IDLE_CONN_TIMEOUT", "30s")
+	t.Setenv("SPRAYPROXY_TRANSPORT_DIAL_TIMEOUT", "5s")
+	t.Setenv("SPRAYPROXY_TRANSPORT_TLS_HANDSHAKE_TIMEOUT", "2s")
+	config, err = transportConfigFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := transportConfig{maxIdleConns: 4, idleConnTimeout: 30 * time.Second, dialTimeout: 5 * time.Second, tlsHandshakeTimeout: 2 * time.Second}
+	if config != expected {
+		t.Errorf("expected transport settings %+v, got %+v", expected, config)
+	}
+
+	for env, value := range map[string]string{
+		"SPRAYPROXY_TRANSPORT_KEEP_ALIVE":                 "sometimes",
+		"SPRAYPROXY_TRANSPORT_MAX_IDLE_CONNS_PER_BACKEND": "-1",
+		"SPRAYPROXY_TRANSPORT_IDLE_CONN_TIMEOUT":          "0s",
+		"SPRAYPROXY_TRANSPORT_DIAL_TIMEOUT":               "soon",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := transportConfigFromEnv(); err == nil {
+				t.Errorf("expected error for %s=%s", env, value)
+			}
+		})
+	}
+}
+
+func TestBackendTransports(t *testing.T) {
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	b := &v1alpha1.Backend{URL: "https://cluster-a"}
+	transport := proxy.backendTransport(b.URL, b)
+	if proxy.backendTransport(b.URL, b) != transport {
+		t.Errorf("expected the transport to be reused")
+	}
+	if proxy.backendTransport("https://cluster-b", nil) == transport {
+		t.Errorf("expected a transport per backend")
+	}
+	updated := &v1alpha1.Backend{URL: b.URL, TLS: &v1alpha1.TLSConfig{ServerName: "cluster-a.internal"}}
+	if proxy.backendTransport(b.URL, updated) == transport {
+		t.Errorf("expected a new transport when the TLS settings change")
+	}
+	if proxy.backendTransport(b.URL, updated).TLSClientConfig.ServerName != "cluster-a.internal" {
+		t.Errorf("expected the transport to use the backend TLS settings")
+	}
+
+	proxy.transports.prune(newBackendSnapshot(1, map[string]*v1alpha1.Backend{b.URL: updated}))
+	if _, ok := proxy.transports.backends["https://cluster-b"]; ok || len(proxy.transports.backends) != 1 {
+		t.Errorf("expected the transports of unregistered backends to be removed")
+	}
+}
+
+// countConnections starts a backend, and counts the connections made to it.
+func countConnections(t testing.TB, connections *int32) *httptest.Server {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(connections, 1)
+		}
+	}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestForwardReusesConnections(t *testing.T) {
+	for _, test := range []struct {
+		keepAlive   string
+		connections int32
+	}{
+		{keepAlive: "true", connections: 1},
+		{keepAlive: "false", connections: 3},
+	} {
+		t.Run("keep-alive "+test.keepAlive, func(t *testing.T) {
+			t.Setenv("SPRAYPROXY_TRANSPORT_KEEP_ALIVE", test.keepAlive)
+			connections := int32(0)
+			backend := countConnections(t, &connections)
+			proxy, err := NewSprayProxy(true, true, false, zap.NewNop(), map[string]string{backend.URL: ""})
+			if err != nil {
+				t.Fatalf("failed to set up proxy: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				w := httptest.NewRecorder()
+				ctx, _ := gin.CreateTestContext(w)
+				ctx.Request = newProxyRequest()
+				proxy.HandleProxy(ctx)
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+				}
+			}
+			if got := atomic.LoadInt32(&connections); got != test.connections {
+				t.Errorf("expected %d connections to the backend, got %d", test.connections, got)
+			}
+		})
+	}
+}
+
+// BenchmarkForward compares forwarding over kept-alive connections with opening a connection,
+// and making a TLS handshake, for every request.
+func BenchmarkForward(b *testing.B) {
+	gin.SetMode(gin.ReleaseMode)
+	for _, keepAlive := range []string{"true", "false"} {
+		b.Run("keep-alive="+keepAlive, func(b *testing.B) {
+			b.Setenv("SPRAYPROXY_TRANSPORT_KEEP_ALIVE", keepAlive)
+			connections := int32(0)
+			backends := map[string]string{}
+			for i := 0; i < 3; i++ {
+				backends[countConnections(b, &connections).URL] = ""
+			}
+			proxy, err := NewSprayProxy(true, true, false, zap.NewNop(), backends)
+			if err != nil {
+				b.Fatalf("failed to set up proxy: %v", err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				ctx, _ := gin.CreateTestContext(w)
+				ctx.Request = newProxyRequest()
+				proxy.HandleProxy(ctx)
+				if w.Code != http.StatusOK {
+					b.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt32(&connections))/float64(b.N), "conns/op")
+		})
+	}
+}
@@ -1,5 +1,178 @@
 package v1alpha1
 
+import "time"
+
 type Backend struct {
 	URL string `json:"url"`
+	// Name identifies the backend, e.g. "cluster-a". It must be a lowercase DNS label, unique among
+	// the backends.
+	Name string `json:"name,omitempty"`
+	// Labels are arbitrary key and value pairs describing the backend, e.g. "env: staging".
+	Labels map[string]string `json:"labels,omitempty"`
+	// Owner is the team or person responsible for the backend.
+	Owner       string `json:"owner,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Timeout of the requests forwarded to the backend, e.g. "30s". Defaults to the proxy
+	// forwarding request timeout.
+	Timeout string `json:"timeout,omitempty"`
+	// Retry overrides the proxy retry policy for the backend.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// TLS overrides the TLS settings used to connect to the backend.
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// Headers are set on the requests forwarded to the backend, replacing the inbound values.
+	Headers map[string]string `json:"headers,omitempty"`
+	// HealthCheck overrides the proxy health check settings for the backend.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	// Paused backends stay registered, but no requests are forwarded to them.
+	Paused bool `json:"paused,omitempty"`
+	// CreatedAt is the registration time, set by the proxy.
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	// UpdatedAt is the time of the last registration or update, set by the proxy.
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	// TTL is the duration of the registration lease, e.g. "10m". A backend registered with a TTL
+	// is unregistered unless its lease is renewed in time. Registrations do not expire when unset.
+	TTL string `json:"ttl,omitempty"`
+	// ExpiresAt is the expiry time of the registration lease, set by the proxy.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Static is set by the proxy on the backends of its configuration, given by --backend or the
+	// backends file, as opposed to the backends registered with the API.
+	Static bool `json:"static,omitempty"`
+	// Routing selects the events forwarded to the backend. All events are forwarded when unset.
+	Routing *RoutingRules `json:"routing,omitempty"`
+	// PathRewrite changes the inbound request path before it is joined with the URL path.
+	PathRewrite *PathRewrite `json:"pathRewrite,omitempty"`
+}
+
+// RoutingRules select the events forwarded to a backend. An event is forwarded if it matches
+// any of the include filters, or there are no include filters, and none of the exclude filters.
+type RoutingRules struct {
+	Include []EventFilter `json:"include,omitempty"`
+	Exclude []EventFilter `json:"exclude,omitempty"`
+}
+
+// EventFilter matches an event if all of its set fields match. A field matches if any of its
+// values matches.
+type EventFilter struct {
+	// Events are matched against the X-GitHub-Event header, e.g. "push" or "pull_request".
+	Events []string `json:"events,omitempty"`
+	// Actions are matched against the payload action, e.g. "opened".
+	Actions []string `json:"actions,omitempty"`
+	// Repositories are glob patterns matched against the repository full name, e.g. "my-org/*".
+	Repositories []string `json:"repositories,omitempty"`
+	// RepositoryRegexes are regular expressions matched against the repository full name.
+	RepositoryRegexes []string `json:"repositoryRegexes,omitempty"`
+	InstallationIDs   []int64  `json:"installationIds,omitempty"`
+	// Organizations are matched against the organization, or the repository owner.
+	Organizations []string `json:"organizations,omitempty"`
+	// Refs are glob patterns matched against the git ref, both in full ("refs/heads/main") and
+	// short ("main") form. For pull requests, the base branch is used.
+	Refs []string `json:"refs,omitempty"`
+}
+
+// PathRewrite changes the inbound request path before it is joined with the backend URL path.
+// The steps are applied in order: StripPrefix, Replace, and then Template.
+type PathRewrite struct {
+	// StripPrefix is removed from the beginning of the path.
+	StripPrefix string `json:"stripPrefix,omitempty"`
+	// Replace substitutes the matches of a regular expression in the path.
+	Replace *PathReplace `json:"replace,omitempty"`
+	// Template builds a new path. The {path} placeholder is substituted with the path, {event}
+	// with the X-GitHub-Event header, and {delivery} with the X-GitHub-Delivery header.
+	Template string `json:"template,omitempty"`
+}
+
+// PathReplace substitutes the matches of Pattern with Replacement, which may refer to capture
+// groups such as ${1}.
+type PathReplace struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// RetryPolicy overrides the proxy retry policy. Unset fields keep the proxy settings.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one. A value of 1 disables
+	// retries.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// InitialBackoff is the wait time before the first retry, e.g. "500ms". It doubles on every
+	// subsequent retry, up to MaxBackoff.
+	InitialBackoff string `json:"initialBackoff,omitempty"`
+	MaxBackoff     string `json:"maxBackoff,omitempty"`
+	// StatusCodes lists the backend response codes worth retrying. Transport errors are always
+	// retried.
+	StatusCodes []int `json:"statusCodes,omitempty"`
+}
+
+// TLSConfig holds the TLS settings used to connect to a backend. Files are read by the proxy, and
+// reloaded when they change.
+type TLSConfig struct {
+	// InsecureSkipVerify skips the verification of the backend certificate.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// ServerName is used to verify the backend certificate, and sent with SNI, instead of the
+	// URL host.
+	ServerName string `json:"serverName,omitempty"`
+	// CAFile is a PEM bundle of the CA certificates the backend certificate is verified with,
+	// instead of the proxy CA bundle or the system roots.
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are the PEM client certificate and key presented to the backend,
+	// instead of the proxy client certificate.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// PinnedPublicKeys are base64 encoded SHA-256 hashes of the subject public key info of
+	// certificates of the backend certificate chain. One of them must match when set.
+	PinnedPublicKeys []string `json:"pinnedPublicKeys,omitempty"`
+}
+
+// HealthCheck overrides the proxy health check settings. Unset fields keep the proxy settings.
+type HealthCheck struct {
+	// Disabled skips the health checks of the backend, which is then never considered unhealthy.
+	Disabled bool `json:"disabled,omitempty"`
+	// Path of the health check request on the backend host, e.g. "/healthz".
+	Path string `json:"path,omitempty"`
+	// StatusCodes lists the response codes of a healthy backend.
+	StatusCodes []int `json:"statusCodes,omitempty"`
+}
+
+// BackendList is the list of registered backends returned by the proxy.
+type BackendList struct {
+	// Generation of the backend registry, incremented by every change.
+	Generation uint64          `json:"generation"`
+	Items      []BackendStatus `json:"items"`
+}
+
+// BackendStatus is a registered backend along with its forwarding statistics.
+type BackendStatus struct {
+	Backend
+	// ID identifies the backend in the API, it is the backend name if set.
+	ID string `json:"id"`
+	// CircuitState is the state of the backend circuit breaker, "closed", "open" or "half-open".
+	// It is empty when circuit breakers are disabled.
+	CircuitState string `json:"circuitState,omitempty"`
+	// Health is the outcome of the backend health checks. It is unset when health checks are
+	// disabled.
+	Health *HealthStatus `json:"health,omitempty"`
+	Stats  BackendStats  `json:"stats"`
+}
+
+// BackendStats describe the recent requests forwarded to a backend. The proxy only keeps them in
+// memory, they are reset on restart and differ between replicas.
+type BackendStats struct {
+	// LastSuccess is the time of the last request accepted by the backend.
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// LastError describes the last request the backend did not accept, at LastErrorAt.
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	// ConsecutiveFailures counts the requests not accepted since the last success.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// LatencyP50Ms and LatencyP99Ms are latency percentiles of the recent requests, in milliseconds.
+	LatencyP50Ms float64 `json:"latencyP50Ms"`
+	LatencyP99Ms float64 `json:"latencyP99Ms"`
+}
+
+// HealthStatus is the outcome of the health checks of a backend.
+type HealthStatus struct {
+	// State is "healthy" or "unhealthy" once enough consecutive checks agree, "unknown" before.
+	State     string     `json:"state"`
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	// LastError describes why the last check failed, it is empty if the last check succeeded.
+	LastError string `json:"lastError,omitempty"`
 }
@@ -24,9 +24,7 @@ const (
 
 // create GitHub webwook like HTTP request including signature
 func newProxyRequest() *http.Request {
-	form := url.Values{}
-	form.Add("payload", body)
-	formBody := form.Encode()
+	formBody := newProxyRequestBody()
 	req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/proxy", bytes.NewBufferString(formBody))
 	req.Header.Add("content-type", "application/x-www-form-urlencoded")
 	// signature generated by generateSignature(formBody, secret))
@@ -34,6 +32,13 @@ func newProxyRequest() *http.Request {
 	return req
 }
 
+// form encoded GitHub webhook payload
+func newProxyRequestBody() string {
+	form := url.Values{}
+	form.Add("payload", body)
+	return form.Encode()
+}
+
 func expectErrorMessage(t *testing.T, msg string, err error) {
 	if err == nil || err.Error() != msg {
 		t.Errorf("Expected %q, got %q", msg, err)
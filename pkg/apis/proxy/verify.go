@@ -0,0 +1,321 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// VerifierGitHub verifies the X-Hub-Signature-256 or X-Hub-Signature HMAC of GitHub webhooks.
+	VerifierGitHub = "github"
+	// VerifierGitLab verifies the X-Gitlab-Token secret token of GitLab webhooks.
+	VerifierGitLab = "gitlab"
+	// VerifierBitbucket verifies the X-Hub-Signature HMAC of Bitbucket Server webhooks.
+	VerifierBitbucket = "bitbucket"
+	// VerifierGitea verifies the X-Gitea-Signature HMAC of Gitea webhooks.
+	VerifierGitea = "gitea"
+)
+
+// verifierNameRegexp matches the verifier names, which are used in the endpoint paths.
+var verifierNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Verifier checks that webhook requests were sent by a provider knowing the shared secret.
+type Verifier interface {
+	// Name identifies the provider in endpoint paths, logs and metrics.
+	Name() string
+	// Detect indicates if the request headers are the ones of the provider.
+	Detect(req *http.Request) bool
+	// Verify checks the request with the secret, given the raw request body.
+	Verify(req *http.Request, body []byte, secret string) error
+	// Sign replaces the signature headers of the provider, if set, with ones computed with the
+	// secret.
+	Sign(header http.Header, body []byte, secret string)
+}
+
+// githubVerifier verifies GitHub webhooks. Request signatures are checked by go-github, which
+// also rejects unsupported content types.
+type githubVerifier struct{}
+
+func (githubVerifier) Name() string {
+	return VerifierGitHub
+}
+
+func (githubVerifier) Detect(req *http.Request) bool {
+	return req.Header.Get("X-GitHub-Event") != "" || req.Header.Get("X-Hub-Signature-256") != ""
+}
+
+func (githubVerifier) Verify(req *http.Request, body []byte, secret string) error {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return validateWebhookSignature(req, secret)
+}
+
+func (githubVerifier) Sign(header http.Header, body []byte, secret string) {
+	if header.Get("X-Hub-Signature-256") != "" {
+		header.Set("X-Hub-Signature-256", "sha256="+hmacSignature(sha256.New, "hex", body, secret))
+	}
+	// Bitbucket sends a SHA-256 signature in this header, which its verifier replaces
+	if strings.HasPrefix(header.Get("X-Hub-Signature"), "sha1=") {
+		header.Set("X-Hub-Signature", "sha1="+hmacSignature(sha1.New, "hex", body, secret))
+	}
+}
+
+// tokenVerifier verifies webhooks sending the secret itself in a header, as GitLab does.
+type tokenVerifier struct {
+	name        string
+	header      string
+	eventHeader string
+}
+
+func (v *tokenVerifier) Name() string {
+	return v.name
+}
+
+func (v *tokenVerifier) Detect(req *http.Request) bool {
+	return req.Header.Get(v.eventHeader) != "" || req.Header.Get(v.header) != ""
+}
+
+func (v *tokenVerifier) Verify(req *http.Request, body []byte, secret string) error {
+	token := req.Header.Get(v.header)
+	if token == "" {
+		return fmt.Errorf("validateWebhookSignature: missing %s header", v.header)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return fmt.Errorf("validateWebhookSignature: token check failed")
+	}
+	return nil
+}
+
+// Sign sets the token on the requests of the provider, including the ones whose token was removed
+// before being stored.
+func (v *tokenVerifier) Sign(header http.Header, body []byte, secret string) {
+	if header.Get(v.eventHeader) != "" || header.Get(v.header) != "" {
+		header.Set(v.header, secret)
+	}
+}
+
+// hmacVerifier verifies webhooks sending an HMAC of the request body in a header.
+type hmacVerifier struct {
+	name   string
+	header string
+	// eventHeader identifies the provider requests, the signature header is used if empty
+	eventHeader string
+	hash        func() hash.Hash
+	// encoding of the HMAC, hex or base64
+	encoding string
+	// prefix of the HMAC in the header, such as "sha256="
+	prefix string
+}
+
+func (v *hmacVerifier) Name() string {
+	return v.name
+}
+
+func (v *hmacVerifier) Detect(req *http.Request) bool {
+	if v.eventHeader != "" && req.Header.Get(v.eventHeader) != "" {
+		return true
+	}
+	return req.Header.Get(v.header) != ""
+}
+
+func (v *hmacVerifier) Verify(req *http.Request, body []byte, secret string) error {
+	signature := req.Header.Get(v.header)
+	if signature == "" {
+		return fmt.Errorf("validateWebhookSignature: missing %s header", v.header)
+	}
+	if !strings.HasPrefix(signature, v.prefix) {
+		return fmt.Errorf("validateWebhookSignature: %s header does not start with %q", v.header, v.prefix)
+	}
+	var received []byte
+	var err error
+	if v.encoding == "base64" {
+		received, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(signature, v.prefix))
+	} else {
+		received, err = hex.DecodeString(strings.TrimPrefix(signature, v.prefix))
+	}
+	if err != nil {
+		return fmt.Errorf("validateWebhookSignature: invalid %s header: %v", v.header, err)
+	}
+	mac := hmac.New(v.hash, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(received, mac.Sum(nil)) {
+		return fmt.Errorf("validateWebhookSignature: payload signature check failed")
+	}
+	return nil
+}
+
+func (v *hmacVerifier) Sign(header http.Header, body []byte, secret string) {
+	if signature := header.Get(v.header); signature != "" && strings.HasPrefix(signature, v.prefix) {
+		header.Set(v.header, v.prefix+hmacSignature(v.hash, v.encoding, body, secret))
+	}
+}
+
+// hmacSignature returns the HMAC of the body, hex or base64 encoded.
+func hmacSignature(h func() hash.Hash, encoding string, body []byte, secret string) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	if encoding == "base64" {
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hmacVerifierConfig configures a verifier of in-house webhooks signed with an HMAC.
+type hmacVerifierConfig struct {
+	Name   string `yaml:"name"`
+	Header string `yaml:"header"`
+	// Algorithm is sha1, sha256 or sha512, sha256 by default
+	Algorithm string `yaml:"algorithm"`
+	// Encoding is hex or base64, hex by default
+	Encoding string `yaml:"encoding"`
+	Prefix   string `yaml:"prefix"`
+}
+
+func newHMACVerifier(config hmacVerifierConfig) (*hmacVerifier, error) {
+	if !verifierNameRegexp.MatchString(config.Name) {
+		return nil, fmt.Errorf("invalid HMAC verifier name %q, expected lowercase letters, digits and dashes", config.Name)
+	}
+	if !httpguts.ValidHeaderFieldName(config.Header) {
+		return nil, fmt.Errorf("invalid header %q of HMAC verifier %s", config.Header, config.Name)
+	}
+	v := &hmacVerifier{name: config.Name, header: config.Header, prefix: config.Prefix}
+	switch config.Algorithm {
+	case "", "sha256":
+		v.hash = sha256.New
+	case "sha1":
+		v.hash = sha1.New
+	case "sha512":
+		v.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("invalid algorithm %q of HMAC verifier %s, expected sha1, sha256 or sha512", config.Algorithm, config.Name)
+	}
+	switch config.Encoding {
+	case "", "hex":
+		v.encoding = "hex"
+	case "base64":
+		v.encoding = "base64"
+	default:
+		return nil, fmt.Errorf("invalid encoding %q of HMAC verifier %s, expected hex or base64", config.Encoding, config.Name)
+	}
+	return v, nil
+}
+
+// builtinVerifiers returns the verifiers of the supported providers, by name.
+func builtinVerifiers() map[string]Verifier {
+	return map[string]Verifier{
+		VerifierGitHub: githubVerifier{},
+		VerifierGitLab: &tokenVerifier{name: VerifierGitLab, header: "X-Gitlab-Token", eventHeader: "X-Gitlab-Event"},
+		VerifierBitbucket: &hmacVerifier{name: VerifierBitbucket, header: "X-Hub-Signature", eventHeader: "X-Event-Key",
+			hash: sha256.New, encoding: "hex", prefix: "sha256="},
+		VerifierGitea: &hmacVerifier{name: VerifierGitea, header: "X-Gitea-Signature", eventHeader: "X-Gitea-Event",
+			hash: sha256.New, encoding: "hex"},
+	}
+}
+
+// verifiersFromEnv returns the verifiers enabled by the SPRAYPROXY_WEBHOOK_PROVIDERS env var, and
+// the HMAC verifiers configured by the SPRAYPROXY_WEBHOOK_HMAC_VERIFIERS env var. They are ordered
+// for detection: providers sending GitHub compatible headers, such as Gitea, come before GitHub.
+func verifiersFromEnv() ([]Verifier, error) {
+	builtin := builtinVerifiers()
+	enabled := map[string]bool{VerifierGitHub: true}
+	if v := os.Getenv("SPRAYPROXY_WEBHOOK_PROVIDERS"); v != "" {
+		enabled = map[string]bool{}
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := builtin[name]; !ok {
+				return nil, fmt.Errorf("invalid SPRAYPROXY_WEBHOOK_PROVIDERS %q, unknown provider %q", v, name)
+			}
+			enabled[name] = true
+		}
+	}
+	verifiers := []Verifier{}
+	for _, name := range []string{VerifierGitea, VerifierGitLab, VerifierBitbucket} {
+		if enabled[name] {
+			verifiers = append(verifiers, builtin[name])
+		}
+	}
+	if v := os.Getenv("SPRAYPROXY_WEBHOOK_HMAC_VERIFIERS"); v != "" {
+		configs := []hmacVerifierConfig{}
+		if err := yaml.Unmarshal([]byte(v), &configs); err != nil {
+			return nil, fmt.Errorf("invalid SPRAYPROXY_WEBHOOK_HMAC_VERIFIERS, expected a list of verifiers: %v", err)
+		}
+		names := map[string]bool{}
+		for _, config := range configs {
+			if _, ok := builtin[config.Name]; ok || names[config.Name] {
+				return nil, fmt.Errorf("invalid SPRAYPROXY_WEBHOOK_HMAC_VERIFIERS, duplicate verifier name %q", config.Name)
+			}
+			names[config.Name] = true
+			verifier, err := newHMACVerifier(config)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SPRAYPROXY_WEBHOOK_HMAC_VERIFIERS: %v", err)
+			}
+			verifiers = append(verifiers, verifier)
+		}
+	}
+	if enabled[VerifierGitHub] {
+		verifiers = append(verifiers, builtin[VerifierGitHub])
+	}
+	if len(verifiers) == 0 {
+		return nil, fmt.Errorf("invalid SPRAYPROXY_WEBHOOK_PROVIDERS %q, no provider enabled", os.Getenv("SPRAYPROXY_WEBHOOK_PROVIDERS"))
+	}
+	return verifiers, nil
+}
+
+// verifier returns the enabled verifier with the given name, or nil.
+func (p *SprayProxy) verifier(name string) Verifier {
+	for _, v := range p.verifiers {
+		if v.Name() == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// signRequest replaces the signature headers of the enabled providers with ones computed with
+// the secret, so the backend only sees signatures of its own secret.
+func (p *SprayProxy) signRequest(header http.Header, body []byte, secret string) {
+	for _, v := range p.verifiers {
+		v.Sign(header, body, secret)
+	}
+}
+
+// stripTokens removes the secret tokens of the enabled providers, which are the webhook secret
+// itself rather than a signature.
+func (p *SprayProxy) stripTokens(header http.Header) {
+	for _, v := range p.verifiers {
+		if token, ok := v.(*tokenVerifier); ok {
+			header.Del(token.header)
+		}
+	}
+}
+
+// detectVerifier returns the first enabled verifier which recognizes the request headers, or the
+// last one, GitHub if enabled, when none does.
+func (p *SprayProxy) detectVerifier(req *http.Request) Verifier {
+	for _, v := range p.verifiers {
+		if v.Detect(req) {
+			return v
+		}
+	}
+	return p.verifiers[len(p.verifiers)-1]
+}
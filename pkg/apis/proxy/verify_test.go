@@ -0,0 +1,233 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const jsonBody = `{"object_kind":"push"}`
+
+func hmacHex(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookRequest(header map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/proxy", bytes.NewBufferString(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+func TestVerifiers(t *testing.T) {
+	builtin := builtinVerifiers()
+	for _, test := range []struct {
+		name     string
+		verifier Verifier
+		header   map[string]string
+		err      string
+	}{
+		{
+			name:     "github",
+			verifier: builtin[VerifierGitHub],
+			header:   map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": generateSignature(jsonBody, secret)},
+		},
+		{
+			name:     "github with invalid signature",
+			verifier: builtin[VerifierGitHub],
+			header:   map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": generateSignature(jsonBody, invalidSecret)},
+			err:      "validateWebhookSignature: payload signature check failed",
+		},
+		{
+			name:     "gitlab",
+			verifier: builtin[VerifierGitLab],
+			header:   map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": secret},
+		},
+		{
+			name:     "gitlab with invalid token",
+			verifier: builtin[VerifierGitLab],
+			header:   map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": invalidSecret},
+			err:      "validateWebhookSignature: token check failed",
+		},
+		{
+			name:     "gitlab without token",
+			verifier: builtin[VerifierGitLab],
+			header:   map[string]string{"X-Gitlab-Event": "Push Hook"},
+			err:      "validateWebhookSignature: missing X-Gitlab-Token header",
+		},
+		{
+			name:     "bitbucket",
+			verifier: builtin[VerifierBitbucket],
+			header:   map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": "sha256=" + hmacHex(jsonBody, secret)},
+		},
+		{
+			name:     "bitbucket without prefix",
+			verifier: builtin[VerifierBitbucket],
+			header:   map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": hmacHex(jsonBody, secret)},
+			err:      `validateWebhookSignature: X-Hub-Signature header does not start with "sha256="`,
+		},
+		{
+			name:     "bitbucket with invalid signature",
+			verifier: builtin[VerifierBitbucket],
+			header:   map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": "sha256=" + hmacHex(jsonBody, invalidSecret)},
+			err:      "validateWebhookSignature: payload signature check failed",
+		},
+		{
+			name:     "gitea",
+			verifier: builtin[VerifierGitea],
+			header:   map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": hmacHex(jsonBody, secret)},
+		},
+		{
+			name:     "gitea with invalid signature",
+			verifier: builtin[VerifierGitea],
+			header:   map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": "not hex"},
+			err:      "validateWebhookSignature: invalid X-Gitea-Signature header: encoding/hex: invalid byte: U+006E 'n'",
+		},
+		{
+			name:     "gitea without signature",
+			verifier: builtin[VerifierGitea],
+			header:   map[string]string{"X-Gitea-Event": "push"},
+			err:      "validateWebhookSignature: missing X-Gitea-Signature header",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.verifier.Verify(newWebhookRequest(test.header), []byte(jsonBody), secret)
+			if test.err != "" {
+				expectErrorMessage(t, test.err, err)
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestHMACVerifier(t *testing.T) {
+	sha1MAC := hmac.New(sha1.New, []byte(secret))
+	sha1MAC.Write([]byte(jsonBody))
+	verifier, err := newHMACVerifier(hmacVerifierConfig{Name: "acme", Header: "X-Acme-Signature", Algorithm: "sha1", Encoding: "base64", Prefix: "v1,"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req := newWebhookRequest(map[string]string{"X-Acme-Signature": "v1," + base64.StdEncoding.EncodeToString(sha1MAC.Sum(nil))})
+	if !verifier.Detect(req) {
+		t.Errorf("expected request to be detected by its signature header")
+	}
+	if err := verifier.Verify(req, []byte(jsonBody), secret); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := verifier.Verify(req, []byte(jsonBody), invalidSecret); err == nil {
+		t.Errorf("expected error for invalid secret")
+	}
+
+	for name, config := range map[string]hmacVerifierConfig{
+		"invalid name":      {Name: "Acme", Header: "X-Acme-Signature"},
+		"invalid header":    {Name: "acme", Header: "X Acme Signature"},
+		"invalid algorithm": {Name: "acme", Header: "X-Acme-Signature", Algorithm: "md5"},
+		"invalid encoding":  {Name: "acme", Header: "X-Acme-Signature", Encoding: "base32"},
+	} {
+		if _, err := newHMACVerifier(config); err == nil {
+			t.Errorf("%s: expected error for %+v", name, config)
+		}
+	}
+}
+
+func TestDetectVerifier(t *testing.T) {
+	t.Setenv("SPRAYPROXY_WEBHOOK_PROVIDERS", "github,gitlab,bitbucket,gitea")
+	t.Setenv("SPRAYPROXY_WEBHOOK_HMAC_VERIFIERS", "[{name: acme, header: X-Acme-Signature}]")
+	proxy, err := NewSprayProxy(false, true, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for expected, header := range map[string]map[string]string{
+		VerifierGitHub: {"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=00"},
+		// Gitea also sends GitHub headers
+		VerifierGitea:     {"X-GitHub-Event": "push", "X-Gitea-Event": "push", "X-Hub-Signature-256": "sha256=00"},
+		VerifierGitLab:    {"X-Gitlab-Event": "Push Hook"},
+		VerifierBitbucket: {"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": "sha256=00"},
+		"acme":            {"X-Acme-Signature": "00"},
+		// requests without known headers are verified as GitHub ones
+		"": {},
+	} {
+		if expected == "" {
+			expected = VerifierGitHub
+		}
+		if v := proxy.detectVerifier(newWebhookRequest(header)); v.Name() != expected {
+			t.Errorf("expected %s verifier for %v, got %s", expected, header, v.Name())
+		}
+	}
+}
+
+func TestVerifiersFromEnv(t *testing.T) {
+	verifiers, err := verifiersFromEnv()
+	if err != nil || len(verifiers) != 1 || verifiers[0].Name() != VerifierGitHub {
+		t.Errorf("expected only the GitHub verifier by default, got %v, %v", verifiers, err)
+	}
+	for env, value := range map[string]string{
+		"SPRAYPROXY_WEBHOOK_PROVIDERS":      "github,svn",
+		"SPRAYPROXY_WEBHOOK_HMAC_VERIFIERS": "[{name: github, header: X-Hub-Signature-256}]",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := verifiersFromEnv(); err == nil {
+				t.Errorf("expected error for %s=%s", env, value)
+			}
+		})
+	}
+	t.Setenv("SPRAYPROXY_WEBHOOK_HMAC_VERIFIERS", "[{name: acme, header: X-Acme-Signature}, {name: acme, header: X-Acme-Signature}]")
+	if _, err := verifiersFromEnv(); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("expected duplicate verifier error, got %v", err)
+	}
+}
+
+func TestHandleProviderEndpoint(t *testing.T) {
+	t.Setenv(envWebhookSecret, secret)
+	t.Setenv(envWebhookSecrets, "[{name: gitlab, secret: gitlab-token, providers: [gitlab]}]")
+	t.Setenv("SPRAYPROXY_WEBHOOK_PROVIDERS", "github,gitlab")
+	proxy, err := NewSprayProxy(false, false, false, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatalf("failed to set up proxy: %v", err)
+	}
+	for _, test := range []struct {
+		provider string
+		header   map[string]string
+		expected int
+	}{
+		{provider: VerifierGitLab, header: map[string]string{"X-Gitlab-Token": "gitlab-token"}, expected: http.StatusOK},
+		// the GitHub secret is not a GitLab token
+		{provider: VerifierGitLab, header: map[string]string{"X-Gitlab-Token": secret}, expected: http.StatusBadRequest},
+		// the endpoint verifier is used whatever the request headers
+		{provider: VerifierGitHub, header: map[string]string{"X-Gitlab-Token": "gitlab-token"}, expected: http.StatusBadRequest},
+		{provider: VerifierGitea, header: map[string]string{"X-Gitea-Signature": hmacHex(jsonBody, secret)}, expected: http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = newWebhookRequest(test.header)
+		ctx.Request.URL.Path = "/proxy/" + test.provider
+		ctx.Params = gin.Params{{Key: "provider", Value: test.provider}}
+		proxy.HandleProviderEndpoint(ctx)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected status code %d, got %d", test.provider, test.expected, w.Code)
+		}
+	}
+}
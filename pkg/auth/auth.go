@@ -0,0 +1,316 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package auth authenticates and authorizes the callers of the backend registration API.
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/kube"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Scope is a permission granted to a caller.
+type Scope string
+
+const (
+	// ScopeRead allows to list the backends, the asynchronous deliveries and the dead letters.
+	ScopeRead Scope = "read"
+	// ScopeRegister allows to register and update backends, renew their lease, and redeliver or
+	// purge the dead letters.
+	ScopeRegister Scope = "register"
+	// ScopeUnregister allows to unregister backends.
+	ScopeUnregister Scope = "unregister"
+
+	// key of the caller identity in the gin context
+	identityKey = "identity"
+	// maximum size of the requests authenticated with HMAC signatures
+	maxSignedBodySize = 1024 * 1024
+)
+
+var (
+	// errNoCredentials is returned when the request has no credentials.
+	errNoCredentials = errors.New("no credentials")
+	errUnknownToken  = errors.New("unknown bearer token")
+)
+
+// Identity is an authenticated caller.
+type Identity struct {
+	Name string
+	// Method is the authentication method, one of "token", "hmac", "tokenreview" or "clientcert".
+	Method string
+	Scopes []Scope
+}
+
+// HasScope indicates if the caller was granted the scope.
+func (i *Identity) HasScope(scope Scope) bool {
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityFromContext returns the caller authenticated by the middleware, or nil.
+func IdentityFromContext(c *gin.Context) *Identity {
+	if identity, ok := c.Get(identityKey); ok {
+		return identity.(*Identity)
+	}
+	return nil
+}
+
+// Config lists the callers of the registration API, for each authentication method.
+type Config struct {
+	// Tokens are static bearer tokens.
+	Tokens []TokenConfig `yaml:"tokens"`
+	// HMAC are shared secrets used to sign requests.
+	HMAC []HMACConfig `yaml:"hmac"`
+	// TokenReview authenticates bearer tokens with the Kubernetes API server.
+	TokenReview *TokenReviewConfig `yaml:"tokenReview"`
+	// ClientCertificates are callers presenting a client certificate, verified by the TLS
+	// listener of the proxy against its client CA.
+	ClientCertificates []ClientCertificateConfig `yaml:"clientCertificates"`
+}
+
+// TokenConfig is a caller authenticated with a static bearer token.
+type TokenConfig struct {
+	Name   string  `yaml:"name"`
+	Token  string  `yaml:"token"`
+	Scopes []Scope `yaml:"scopes"`
+}
+
+// HMACConfig is a caller signing its requests with a shared secret.
+type HMACConfig struct {
+	Name   string  `yaml:"name"`
+	Secret string  `yaml:"secret"`
+	Scopes []Scope `yaml:"scopes"`
+}
+
+// ClientCertificateConfig grants scopes to the callers presenting a verified client certificate
+// with the common name.
+type ClientCertificateConfig struct {
+	CommonName string  `yaml:"commonName"`
+	Scopes     []Scope `yaml:"scopes"`
+}
+
+// TokenReviewConfig grants scopes to the Kubernetes users and groups.
+type TokenReviewConfig struct {
+	// Audiences the tokens must be valid for. Defaults to the API server audience.
+	Audiences []string        `yaml:"audiences"`
+	Subjects  []SubjectConfig `yaml:"subjects"`
+}
+
+// SubjectConfig grants scopes to a Kubernetes user, or to the members of a group.
+type SubjectConfig struct {
+	User   string  `yaml:"user"`
+	Group  string  `yaml:"group"`
+	Scopes []Scope `yaml:"scopes"`
+}
+
+// LoadConfig reads the configuration from a YAML or JSON file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse auth config %s: %v", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	scopes := [][]Scope{}
+	for _, t := range c.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return errors.New("tokens require a name and a token")
+		}
+		scopes = append(scopes, t.Scopes)
+	}
+	for _, h := range c.HMAC {
+		if h.Name == "" || h.Secret == "" {
+			return errors.New("hmac callers require a name and a secret")
+		}
+		scopes = append(scopes, h.Scopes)
+	}
+	for _, cert := range c.ClientCertificates {
+		if cert.CommonName == "" {
+			return errors.New("client certificates require a common name")
+		}
+		scopes = append(scopes, cert.Scopes)
+	}
+	if c.TokenReview != nil {
+		for _, s := range c.TokenReview.Subjects {
+			if (s.User == "") == (s.Group == "") {
+				return errors.New("tokenReview subjects require either a user or a group")
+			}
+			scopes = append(scopes, s.Scopes)
+		}
+	}
+	for _, list := range scopes {
+		for _, scope := range list {
+			if scope != ScopeRead && scope != ScopeRegister && scope != ScopeUnregister {
+				return fmt.Errorf("unknown scope %q", scope)
+			}
+		}
+	}
+	return nil
+}
+
+// Authenticator identifies the callers with the configured methods.
+type Authenticator struct {
+	tokens      []TokenConfig
+	hmac        map[string]HMACConfig
+	tokenReview *TokenReviewConfig
+	clientCerts []ClientCertificateConfig
+	reviewer    kube.TokenReviewer
+	logger      *zap.Logger
+	// now returns the current time, used to check the HMAC signature timestamps
+	now func() time.Time
+}
+
+// NewAuthenticator creates an authenticator for the configuration. The reviewer is required
+// if TokenReview is configured.
+func NewAuthenticator(config *Config, reviewer kube.TokenReviewer, logger *zap.Logger) (*Authenticator, error) {
+	if config.TokenReview != nil && reviewer == nil {
+		return nil, errors.New("tokenReview requires a kubernetes client")
+	}
+	a := &Authenticator{
+		tokens:      config.Tokens,
+		hmac:        map[string]HMACConfig{},
+		tokenReview: config.TokenReview,
+		clientCerts: config.ClientCertificates,
+		reviewer:    reviewer,
+		logger:      logger,
+		now:         time.Now,
+	}
+	for _, h := range config.HMAC {
+		a.hmac[h.Name] = h
+	}
+	return a, nil
+}
+
+// Authenticate returns the identity of the caller of the request.
+func (a *Authenticator) Authenticate(req *http.Request) (*Identity, error) {
+	// callers with an unknown client certificate may still present other credentials
+	var certErr error
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(a.clientCerts) > 0 {
+		identity, err := a.authenticateClientCert(req)
+		if err == nil {
+			return identity, nil
+		}
+		certErr = err
+	}
+	if req.Header.Get(hmacSignatureHeader) != "" {
+		return a.authenticateHMAC(req)
+	}
+	authorization := req.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization || token == "" {
+		if certErr != nil {
+			return nil, certErr
+		}
+		return nil, errNoCredentials
+	}
+	identity, err := a.authenticateToken(token)
+	if errors.Is(err, errUnknownToken) && a.tokenReview != nil {
+		return a.authenticateTokenReview(req, token)
+	}
+	return identity, err
+}
+
+// authenticateToken looks the token up in the static tokens.
+func (a *Authenticator) authenticateToken(token string) (*Identity, error) {
+	// compare hashes, so that the comparison time does not depend on the token length
+	sum := sha256.Sum256([]byte(token))
+	var identity *Identity
+	for _, t := range a.tokens {
+		expected := sha256.Sum256([]byte(t.Token))
+		if subtle.ConstantTimeCompare(sum[:], expected[:]) == 1 && identity == nil {
+			identity = &Identity{Name: t.Name, Method: "token", Scopes: t.Scopes}
+		}
+	}
+	if identity == nil {
+		return nil, errUnknownToken
+	}
+	return identity, nil
+}
+
+// authenticateClientCert looks the common name of the verified client certificate up in the
+// configured client certificates.
+func (a *Authenticator) authenticateClientCert(req *http.Request) (*Identity, error) {
+	commonName := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, cert := range a.clientCerts {
+		if cert.CommonName == commonName {
+			return &Identity{Name: commonName, Method: "clientcert", Scopes: cert.Scopes}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown client certificate %q", commonName)
+}
+
+// Require returns a middleware rejecting the requests of callers without the scope. The
+// caller identity is stored in the context for audit logging.
+func (a *Authenticator) Require(scope Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fields := []zap.Field{
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.String("request-id", c.GetString("requestId")),
+			zap.String("scope", string(scope)),
+		}
+		identity, err := a.Authenticate(c.Request)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="sprayproxy"`)
+			c.String(http.StatusUnauthorized, "unauthorized")
+			c.Abort()
+			a.logger.Info("request is rejected, authentication failed: "+err.Error(), fields...)
+			return
+		}
+		fields = append(fields, zap.String("caller", identity.Name), zap.String("auth-method", identity.Method))
+		if !identity.HasScope(scope) {
+			c.String(http.StatusForbidden, "forbidden")
+			c.Abort()
+			a.logger.Info("request is rejected, caller is missing scope", fields...)
+			return
+		}
+		c.Set(identityKey, identity)
+		c.Next()
+	}
+}
+
+// readBody reads the request body and restores it for the next handlers.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBodySize+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignedBodySize {
+		return nil, errors.New("request body too large")
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
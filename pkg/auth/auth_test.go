@@ -0,0 +1,202 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/kube"
+	"go.uber.org/zap"
+)
+
+const testConfig = `
+tokens:
+- name: ci
+  token: ci-token
+  scopes: [read, register, unregister]
+- name: reader
+  token: reader-token
+  scopes: [read]
+hmac:
+- name: cluster-a
+  secret: cluster-a-secret
+  scopes: [register]
+tokenReview:
+  subjects:
+  - user: system:serviceaccount:tenant:registrar
+    scopes: [register]
+  - group: sprayproxy-admins
+    scopes: [read, unregister]
+clientCertificates:
+- commonName: registrar.example.com
+  scopes: [register]
+`
+
+func newTestAuthenticator(t *testing.T) (*Authenticator, *kube.FakeTokenReviewer) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	if err := os.WriteFile(path, []byte(testConfig), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reviewer := kube.NewFakeTokenReviewer(map[string]kube.UserInfo{
+		"sa-token":    {Username: "system:serviceaccount:tenant:registrar"},
+		"admin-token": {Username: "jane", Groups: []string{"sprayproxy-admins"}},
+	})
+	authenticator, err := NewAuthenticator(config, reviewer, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return authenticator, reviewer
+}
+
+func TestAuthenticate(t *testing.T) {
+	authenticator, reviewer := newTestAuthenticator(t)
+	now := time.Now()
+	authenticator.now = func() time.Time { return now }
+	body := []byte(`{"url":"http://cluster-a"}`)
+
+	for _, test := range []struct {
+		name     string
+		request  func(req *http.Request)
+		expected *Identity
+	}{
+		{name: "no credentials", request: func(req *http.Request) {}},
+		{name: "static token", request: func(req *http.Request) { req.Header.Set("Authorization", "Bearer ci-token") },
+			expected: &Identity{Name: "ci", Method: "token", Scopes: []Scope{ScopeRead, ScopeRegister, ScopeUnregister}}},
+		{name: "basic auth", request: func(req *http.Request) { req.SetBasicAuth("ci", "ci-token") }},
+		{name: "hmac signature", request: func(req *http.Request) { SignRequest(req, "cluster-a", "cluster-a-secret", body, now) },
+			expected: &Identity{Name: "cluster-a", Method: "hmac", Scopes: []Scope{ScopeRegister}}},
+		{name: "hmac wrong secret", request: func(req *http.Request) { SignRequest(req, "cluster-a", "wrong", body, now) }},
+		{name: "hmac unknown key", request: func(req *http.Request) { SignRequest(req, "cluster-b", "cluster-a-secret", body, now) }},
+		{name: "hmac expired", request: func(req *http.Request) {
+			SignRequest(req, "cluster-a", "cluster-a-secret", body, now.Add(-10*time.Minute))
+		}},
+		{name: "hmac tampered body", request: func(req *http.Request) {
+			SignRequest(req, "cluster-a", "cluster-a-secret", body, now)
+			req.Body = io.NopCloser(bytes.NewBufferString(`{"url":"http://attacker"}`))
+		}},
+		{name: "token review user", request: func(req *http.Request) { req.Header.Set("Authorization", "Bearer sa-token") },
+			expected: &Identity{Name: "system:serviceaccount:tenant:registrar", Method: "tokenreview", Scopes: []Scope{ScopeRegister}}},
+		{name: "token review group", request: func(req *http.Request) { req.Header.Set("Authorization", "Bearer admin-token") },
+			expected: &Identity{Name: "jane", Method: "tokenreview", Scopes: []Scope{ScopeRead, ScopeUnregister}}},
+		{name: "token review invalid", request: func(req *http.Request) { req.Header.Set("Authorization", "Bearer unknown") }},
+		{name: "client certificate", request: func(req *http.Request) { setClientCert(req, "registrar.example.com") },
+			expected: &Identity{Name: "registrar.example.com", Method: "clientcert", Scopes: []Scope{ScopeRegister}}},
+		{name: "client certificate unknown", request: func(req *http.Request) { setClientCert(req, "other.example.com") }},
+		{name: "client certificate unknown with token", request: func(req *http.Request) {
+			setClientCert(req, "other.example.com")
+			req.Header.Set("Authorization", "Bearer reader-token")
+		}, expected: &Identity{Name: "reader", Method: "token", Scopes: []Scope{ScopeRead}}},
+		{name: "client certificate not verified", request: func(req *http.Request) {
+			setClientCert(req, "registrar.example.com")
+			req.TLS.VerifiedChains = nil
+		}},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/backends", bytes.NewReader(body))
+		test.request(req)
+		identity, err := authenticator.Authenticate(req)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected authentication to fail, got %+v", test.name, identity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if identity.Name != test.expected.Name || identity.Method != test.expected.Method || len(identity.Scopes) != len(test.expected.Scopes) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, identity)
+		}
+		for _, scope := range test.expected.Scopes {
+			if !identity.HasScope(scope) {
+				t.Errorf("%s: expected scope %s, got %v", test.name, scope, identity.Scopes)
+			}
+		}
+		if restored, _ := io.ReadAll(req.Body); test.expected.Method == "hmac" && !bytes.Equal(restored, body) {
+			t.Errorf("%s: expected body to be restored, got %q", test.name, restored)
+		}
+	}
+	// static tokens are not sent to the API server
+	for _, token := range reviewer.Tokens {
+		if token == "ci-token" {
+			t.Errorf("expected static token not to be reviewed")
+		}
+	}
+}
+
+// setClientCert sets the client certificate of the request, as verified by the TLS listener.
+func setClientCert(req *http.Request, commonName string) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestRequire(t *testing.T) {
+	authenticator, _ := newTestAuthenticator(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.DELETE("/backends", authenticator.Require(ScopeUnregister), func(c *gin.Context) {
+		c.String(http.StatusOK, IdentityFromContext(c).Name)
+	})
+	for _, test := range []struct {
+		token    string
+		expected int
+	}{
+		{token: "", expected: http.StatusUnauthorized},
+		{token: "wrong", expected: http.StatusUnauthorized},
+		{token: "reader-token", expected: http.StatusForbidden},
+		{token: "ci-token", expected: http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/backends", nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("token %q: expected status code %d, got %d", test.token, test.expected, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "ci" {
+			t.Errorf("expected caller identity in context, got %q", w.Body.String())
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, config := range []string{
+		"tokens: [{name: ci, scopes: [read]}]",
+		"tokens: [{name: ci, token: abc, scopes: [admin]}]",
+		"hmac: [{secret: abc}]",
+		"tokenReview: {subjects: [{user: jane, group: admins}]}",
+		"clientCertificates: [{scopes: [read]}]",
+		"tokens: {}",
+	} {
+		path := filepath.Join(t.TempDir(), "auth.yaml")
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("expected error for config %q", config)
+		}
+	}
+	if _, err := NewAuthenticator(&Config{TokenReview: &TokenReviewConfig{}}, nil, zap.NewNop()); err == nil {
+		t.Errorf("expected error for tokenReview without client")
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hmacKeyHeader       = "X-SprayProxy-Key"
+	hmacTimestampHeader = "X-SprayProxy-Timestamp"
+	hmacSignatureHeader = "X-SprayProxy-Signature"
+	// maximum difference between the signature timestamp and the current time, limiting the
+	// window in which a captured request can be replayed
+	hmacMaxSkew = 5 * time.Minute
+)
+
+// SignRequest signs the request with the shared secret of the caller. The body must be the
+// request body.
+func SignRequest(req *http.Request, name, secret string, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(hmacKeyHeader, name)
+	req.Header.Set(hmacTimestampHeader, timestamp)
+	req.Header.Set(hmacSignatureHeader, "sha256="+hex.EncodeToString(hmacSignature(secret, req, timestamp, body)))
+}
+
+// hmacSignature signs the method, path and query, timestamp and body of the request.
+func hmacSignature(secret string, req *http.Request, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// authenticateHMAC checks the request signature with the shared secret of the caller.
+func (a *Authenticator) authenticateHMAC(req *http.Request) (*Identity, error) {
+	name := req.Header.Get(hmacKeyHeader)
+	caller, ok := a.hmac[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hmac key %q", name)
+	}
+	timestamp := req.Header.Get(hmacTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid signature timestamp")
+	}
+	if skew := a.now().Sub(time.Unix(seconds, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+		return nil, errors.New("signature timestamp out of range")
+	}
+	signature := req.Header.Get(hmacSignatureHeader)
+	if !strings.HasPrefix(signature, "sha256=") {
+		return nil, errors.New("unsupported signature algorithm")
+	}
+	decoded, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(decoded, hmacSignature(caller.Secret, req, timestamp, body)) {
+		return nil, errors.New("invalid signature")
+	}
+	return &Identity{Name: caller.Name, Method: "hmac", Scopes: caller.Scopes}, nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const tokenReviewTimeout = 10 * time.Second
+
+// authenticateTokenReview authenticates the bearer token with the Kubernetes API server, and
+// grants the scopes of the matching subjects.
+func (a *Authenticator) authenticateTokenReview(req *http.Request, token string) (*Identity, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), tokenReviewTimeout)
+	defer cancel()
+	status, err := a.reviewer.ReviewToken(ctx, token, a.tokenReview.Audiences)
+	if err != nil {
+		return nil, fmt.Errorf("token review failed: %v", err)
+	}
+	if !status.Authenticated {
+		if status.Error != "" {
+			return nil, errors.New("token review: " + status.Error)
+		}
+		return nil, errors.New("token review: not authenticated")
+	}
+	identity := &Identity{Name: status.User.Username, Method: "tokenreview"}
+	for _, subject := range a.tokenReview.Subjects {
+		if (subject.User != "" && subject.User == status.User.Username) || (subject.Group != "" && containsString(status.User.Groups, subject.Group)) {
+			for _, scope := range subject.Scopes {
+				if !identity.HasScope(scope) {
+					identity.Scopes = append(identity.Scopes, scope)
+				}
+			}
+		}
+	}
+	return identity, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package filewatch reloads configuration files, such as mounted Kubernetes Secrets, when they change.
+package filewatch
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// ReloadDelay coalesces the changes to the files before reloading them, as Kubernetes updates
+// mounted volumes with several file operations.
+const ReloadDelay = 100 * time.Millisecond
+
+// Watch calls reload when the files change, until stopCh is closed. The directories of the
+// files are watched rather than the files, which Kubernetes replaces by swapping symlinks.
+func Watch(stopCh <-chan struct{}, files []string, kind string, logger *zap.Logger, reload func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to watch %s files, changes will not be reloaded", kind), zap.Error(err))
+		return
+	}
+	defer watcher.Close()
+	for _, file := range files {
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			logger.Error(fmt.Sprintf("failed to watch %s file, changes will not be reloaded", kind), zap.Error(err), zap.String("file", file))
+			return
+		}
+	}
+	timer := time.NewTimer(ReloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			timer.Reset(ReloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error(fmt.Sprintf("failed to watch %s files", kind), zap.Error(err))
+		case <-timer.C:
+			reload()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigMaps(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer my-token" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case req.Method == http.MethodGet && req.URL.Path == "/api/v1/namespaces/ns/configmaps/missing":
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"kind":"Status","message":"configmaps \"missing\" not found"}`))
+		case req.Method == http.MethodPut && req.URL.Path == "/api/v1/namespaces/ns/configmaps/cm":
+			rw.WriteHeader(http.StatusConflict)
+		case req.Method == http.MethodPost && req.URL.Path == "/api/v1/namespaces/ns/configmaps":
+			cm := &ConfigMap{}
+			json.NewDecoder(req.Body).Decode(cm)
+			cm.Metadata.ResourceVersion = "1"
+			rw.WriteHeader(http.StatusCreated)
+			json.NewEncoder(rw).Encode(cm)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("my-token\n"), 0o600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+	configMaps := NewClient(server.URL, tokenFile, server.Client()).ConfigMaps("ns")
+	ctx := context.Background()
+
+	_, err := configMaps.Get(ctx, "missing")
+	if !IsNotFound(err) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	cm, err := configMaps.Create(ctx, &ConfigMap{Metadata: ObjectMeta{Name: "cm"}, Data: map[string]string{"key": "value"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cm.Kind != "ConfigMap" || cm.Metadata.Namespace != "ns" || cm.Metadata.ResourceVersion != "1" || cm.Data["key"] != "value" {
+		t.Errorf("unexpected ConfigMap %+v", cm)
+	}
+	if _, err := configMaps.Update(ctx, cm); !IsConflict(err) {
+		t.Errorf("expected conflict error, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ObjectMeta is the subset of the Kubernetes object metadata used by the proxy.
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// ConfigMap is a Kubernetes ConfigMap.
+type ConfigMap struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+// ConfigMapInterface reads and writes the ConfigMaps of a namespace.
+type ConfigMapInterface interface {
+	Get(ctx context.Context, name string) (*ConfigMap, error)
+	Create(ctx context.Context, cm *ConfigMap) (*ConfigMap, error)
+	// Update replaces the ConfigMap. It fails with a conflict error if the resource version
+	// of cm is set and the ConfigMap was modified since.
+	Update(ctx context.Context, cm *ConfigMap) (*ConfigMap, error)
+}
+
+type configMaps struct {
+	client    *Client
+	namespace string
+}
+
+// ConfigMaps returns the interface to the ConfigMaps of the namespace.
+func (c *Client) ConfigMaps(namespace string) ConfigMapInterface {
+	return &configMaps{client: c, namespace: namespace}
+}
+
+func (c *configMaps) path(name string) string {
+	p := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", url.PathEscape(c.namespace))
+	if name != "" {
+		p += "/" + url.PathEscape(name)
+	}
+	return p
+}
+
+func (c *configMaps) Get(ctx context.Context, name string) (*ConfigMap, error) {
+	cm := &ConfigMap{}
+	if err := c.client.Do(ctx, http.MethodGet, c.path(name), nil, cm); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+func (c *configMaps) Create(ctx context.Context, cm *ConfigMap) (*ConfigMap, error) {
+	in := *cm
+	in.APIVersion, in.Kind = "v1", "ConfigMap"
+	in.Metadata.Namespace = c.namespace
+	out := &ConfigMap{}
+	if err := c.client.Do(ctx, http.MethodPost, c.path(""), &in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configMaps) Update(ctx context.Context, cm *ConfigMap) (*ConfigMap, error) {
+	in := *cm
+	in.APIVersion, in.Kind = "v1", "ConfigMap"
+	in.Metadata.Namespace = c.namespace
+	out := &ConfigMap{}
+	if err := c.client.Do(ctx, http.MethodPut, c.path(cm.Metadata.Name), &in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package kubetest provides an in-memory implementation of the Kubernetes client interfaces, for
+// the tests of the packages using them.
+package kubetest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/kube"
+)
+
+// ConfigMaps is an in-memory kube.ConfigMapInterface for tests, which behaves like the API
+// server regarding resource versions and conflicts.
+type ConfigMaps struct {
+	mu         sync.Mutex
+	configMaps map[string]*kube.ConfigMap
+	version    int
+}
+
+// NewConfigMaps creates an empty ConfigMaps.
+func NewConfigMaps() *ConfigMaps {
+	return &ConfigMaps{configMaps: map[string]*kube.ConfigMap{}}
+}
+
+func (f *ConfigMaps) Get(ctx context.Context, name string) (*kube.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cm, ok := f.configMaps[name]
+	if !ok {
+		return nil, &kube.StatusError{Code: http.StatusNotFound, Message: fmt.Sprintf("configmaps %q not found", name)}
+	}
+	return copyConfigMap(cm), nil
+}
+
+func (f *ConfigMaps) Create(ctx context.Context, cm *kube.ConfigMap) (*kube.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.configMaps[cm.Metadata.Name]; ok {
+		return nil, &kube.StatusError{Code: http.StatusConflict, Message: fmt.Sprintf("configmaps %q already exists", cm.Metadata.Name)}
+	}
+	return f.store(cm), nil
+}
+
+func (f *ConfigMaps) Update(ctx context.Context, cm *kube.ConfigMap) (*kube.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	existing, ok := f.configMaps[cm.Metadata.Name]
+	if !ok {
+		return nil, &kube.StatusError{Code: http.StatusNotFound, Message: fmt.Sprintf("configmaps %q not found", cm.Metadata.Name)}
+	}
+	if cm.Metadata.ResourceVersion != "" && cm.Metadata.ResourceVersion != existing.Metadata.ResourceVersion {
+		return nil, &kube.StatusError{Code: http.StatusConflict, Message: "the object has been modified"}
+	}
+	return f.store(cm), nil
+}
+
+func (f *ConfigMaps) store(cm *kube.ConfigMap) *kube.ConfigMap {
+	f.version++
+	stored := copyConfigMap(cm)
+	stored.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.configMaps[cm.Metadata.Name] = stored
+	return copyConfigMap(stored)
+}
+
+func copyConfigMap(cm *kube.ConfigMap) *kube.ConfigMap {
+	c := *cm
+	c.Data = make(map[string]string, len(cm.Data))
+	for k, v := range cm.Data {
+		c.Data[k] = v
+	}
+	return &c
+}
@@ -0,0 +1,31 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package kubetest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/kube"
+)
+
+func TestConfigMaps(t *testing.T) {
+	configMaps := NewConfigMaps()
+	ctx := context.Background()
+	created, err := configMaps.Create(ctx, &kube.ConfigMap{Metadata: kube.ObjectMeta{Name: "cm"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := configMaps.Create(ctx, &kube.ConfigMap{Metadata: kube.ObjectMeta{Name: "cm"}}); !kube.IsConflict(err) {
+		t.Errorf("expected conflict error, got %v", err)
+	}
+	if _, err := configMaps.Update(ctx, created); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := configMaps.Update(ctx, created); !kube.IsConflict(err) {
+		t.Errorf("expected conflict error for outdated resource version, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package kube
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// UserInfo is the user authenticated by a TokenReview.
+type UserInfo struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// TokenReviewStatus is the result of a TokenReview.
+type TokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          UserInfo `json:"user"`
+	Audiences     []string `json:"audiences,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     TokenReviewStatus `json:"status"`
+}
+
+// TokenReviewer authenticates bearer tokens with the API server.
+type TokenReviewer interface {
+	// ReviewToken returns the user the token belongs to. The token must be valid for one of the
+	// audiences, if set.
+	ReviewToken(ctx context.Context, token string, audiences []string) (*TokenReviewStatus, error)
+}
+
+// ReviewToken creates a TokenReview for the token.
+func (c *Client) ReviewToken(ctx context.Context, token string, audiences []string) (*TokenReviewStatus, error) {
+	review := &tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: audiences},
+	}
+	out := &tokenReview{}
+	if err := c.Do(ctx, http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", review, out); err != nil {
+		return nil, err
+	}
+	return &out.Status, nil
+}
+
+// FakeTokenReviewer is an in-memory TokenReviewer for tests.
+type FakeTokenReviewer struct {
+	mu     sync.Mutex
+	users  map[string]UserInfo
+	Tokens []string
+}
+
+// NewFakeTokenReviewer creates a FakeTokenReviewer authenticating the given tokens.
+func NewFakeTokenReviewer(users map[string]UserInfo) *FakeTokenReviewer {
+	return &FakeTokenReviewer{users: users}
+}
+
+func (f *FakeTokenReviewer) ReviewToken(ctx context.Context, token string, audiences []string) (*TokenReviewStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Tokens = append(f.Tokens, token)
+	user, ok := f.users[token]
+	if !ok {
+		return &TokenReviewStatus{Error: "invalid bearer token"}, nil
+	}
+	return &TokenReviewStatus{Authenticated: true, User: user, Audiences: audiences}, nil
+}
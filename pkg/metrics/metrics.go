@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"strconv"
 	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,18 +20,64 @@ const (
 	forwardedRequestsName     = subsystem + separator + forwarded + separator + requestsTotal
 	responseTime              = prefix + separator + "response" + separator + "time"
 	forwardedResponseTimeName = subsystem + separator + responseTime + separator + "duration_seconds"
+	duplicates                = inbound + separator + "duplicates_total"
+	inboundDuplicatesName     = subsystem + separator + duplicates
+	unrouted                  = inbound + separator + "unrouted_total"
+	inboundUnroutedName       = subsystem + separator + unrouted
+	rejected                  = inbound + separator + "rejected_total"
+	inboundRejectedName       = subsystem + separator + rejected
+	backendsName              = subsystem + separator + "backends"
+	backendsGenerationName    = backendsName + separator + "generation"
+	backendsEvictedName       = backendsName + separator + "evicted_total"
+	backendCircuitStateName   = subsystem + separator + "backend_circuit_state"
+	backendHealthyName        = subsystem + separator + "backend_healthy"
+	backendHealthChecksName   = subsystem + separator + "backend_health_checks_total"
+	asyncQueueLengthName      = subsystem + separator + "async_queued_requests"
+	webhookSecretMatchesName  = subsystem + separator + "webhook_secret_matches_total"
+	webhookSecretReloadsName  = subsystem + separator + "webhook_secret_reloads_total"
+	backendSecretReloadsName  = subsystem + separator + "backend_secret_reloads_total"
+	sourceRangesReloadsName   = subsystem + separator + "source_ranges_reloads_total"
+	tlsReloadsName            = subsystem + separator + "tls_certificate_reloads_total"
+	backendConnectionsName    = subsystem + separator + "backend_connections_total"
+	secretLabel               = "secret"
+	providerLabel             = "provider"
+	backendLabel              = "backend"
+	resultLabel               = "result"
 	hostLabel                 = "host"
 	errorLabel                = "error"
+	attemptLabel              = "attempt"
+	policyLabel               = "policy"
+	eventLabel                = "event"
+	reasonLabel               = "reason"
+	reusedLabel               = "reused"
 
 	MetricsPort = 9090
 )
 
 var (
-	initCalled        = false
-	lock              = sync.Mutex{}
-	inboundRequests   prometheus.Counter
-	forwardedRequests *prometheus.CounterVec
-	responseTimes     prometheus.Histogram
+	initCalled           = false
+	lock                 = sync.Mutex{}
+	inboundRequests      prometheus.Counter
+	forwardedRequests    *prometheus.CounterVec
+	responseTimes        prometheus.Histogram
+	inboundDuplicates    *prometheus.CounterVec
+	inboundUnrouted      *prometheus.CounterVec
+	backendCount         prometheus.Gauge
+	backendGeneration    prometheus.Gauge
+	backendEvictions     prometheus.Counter
+	circuitStates        *prometheus.GaugeVec
+	healthyBackends      *prometheus.GaugeVec
+	healthChecks         *prometheus.CounterVec
+	asyncQueueLength     prometheus.Gauge
+	secretMatches        *prometheus.CounterVec
+	secretReloads        *prometheus.CounterVec
+	backendSecretReloads *prometheus.CounterVec
+	inboundRejected      *prometheus.CounterVec
+	sourceRangesReloads  *prometheus.CounterVec
+	tlsReloads           *prometheus.CounterVec
+	backendConnections   *prometheus.CounterVec
+	// collectors holds all metrics created by the last InitMetrics call
+	collectors []prometheus.Collector
 )
 
 func InitMetrics(registry *prometheus.Registry) {
@@ -56,18 +103,111 @@ func createMetrics() []prometheus.Collector {
 		Name: forwardedRequestsName,
 		Help: "Counts forwarded attempts to backend server(s).",
 	},
-		[]string{hostLabel, errorLabel})
+		[]string{hostLabel, errorLabel, attemptLabel})
 	responseTimes = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name: forwardedResponseTimeName,
 		Help: "Forwarded request duration in seconds.",
 		// Create buckets of 0.005, 0.05, 0.5, 5, and +Infinity
 		Buckets: prometheus.ExponentialBuckets(0.005, 10, 4),
 	})
-	return []prometheus.Collector{
+	inboundDuplicates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: inboundDuplicatesName,
+		Help: "Counts incoming requests which were already received, by deduplication policy.",
+	},
+		[]string{policyLabel})
+	inboundUnrouted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: inboundUnroutedName,
+		Help: "Counts incoming requests which did not match the routing rules of any backend, by event type.",
+	},
+		[]string{eventLabel})
+	backendCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: backendsName,
+		Help: "Number of registered backend servers.",
+	})
+	backendGeneration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: backendsGenerationName,
+		Help: "Number of changes made to the registered backend servers.",
+	})
+	backendEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: backendsEvictedName,
+		Help: "Counts backend servers unregistered because their registration lease expired.",
+	})
+	circuitStates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: backendCircuitStateName,
+		Help: "State of the backend server circuit breaker: 0 closed, 1 half-open, 2 open.",
+	},
+		[]string{backendLabel})
+	healthyBackends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: backendHealthyName,
+		Help: "Health of the backend server according to the health checks: 1 healthy, 0 unhealthy.",
+	},
+		[]string{backendLabel})
+	healthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: backendHealthChecksName,
+		Help: "Counts health checks of backend servers, by result.",
+	},
+		[]string{backendLabel, resultLabel})
+	asyncQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: asyncQueueLengthName,
+		Help: "Number of requests accepted in asynchronous mode and waiting to be forwarded.",
+	})
+	secretMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: webhookSecretMatchesName,
+		Help: "Counts incoming requests whose signature matched a webhook secret, by webhook provider and secret name.",
+	},
+		[]string{providerLabel, secretLabel})
+	secretReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: webhookSecretReloadsName,
+		Help: "Counts reloads of the webhook secrets after their files changed, by result.",
+	},
+		[]string{resultLabel})
+	backendSecretReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: backendSecretReloadsName,
+		Help: "Counts reloads of the backend signing secrets after their file changed, by result.",
+	},
+		[]string{resultLabel})
+	inboundRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: inboundRejectedName,
+		Help: "Counts incoming requests rejected before verifying their signature, by reason.",
+	},
+		[]string{reasonLabel})
+	sourceRangesReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: sourceRangesReloadsName,
+		Help: "Counts reloads of the allowed source IP ranges after their file changed, by result.",
+	},
+		[]string{resultLabel})
+	tlsReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: tlsReloadsName,
+		Help: "Counts reloads of the TLS certificate of the proxy listener after its files changed, by result.",
+	},
+		[]string{resultLabel})
+	backendConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: backendConnectionsName,
+		Help: "Counts connections used to forward requests to backend servers, by host and whether they were reused from the idle pool.",
+	},
+		[]string{hostLabel, reusedLabel})
+	collectors = []prometheus.Collector{
 		inboundRequests,
 		forwardedRequests,
 		responseTimes,
+		inboundDuplicates,
+		inboundUnrouted,
+		backendCount,
+		backendGeneration,
+		backendEvictions,
+		circuitStates,
+		healthyBackends,
+		healthChecks,
+		asyncQueueLength,
+		secretMatches,
+		secretReloads,
+		backendSecretReloads,
+		inboundRejected,
+		sourceRangesReloads,
+		tlsReloads,
+		backendConnections,
 	}
+	return collectors
 }
 
 func IncInboundCount() {
@@ -76,12 +216,145 @@ func IncInboundCount() {
 	}
 }
 
-func IncForwardedCount(hostname, fwdErr string) {
+// IncForwardedCount counts a forwarding attempt to a backend. Retries are counted
+// separately with increasing attempt numbers, starting at 1.
+func IncForwardedCount(hostname, fwdErr string, attempt int) {
 	if forwardedRequests != nil {
 		if fwdErr == "" {
 			fwdErr = "none"
 		}
-		forwardedRequests.With(prometheus.Labels{hostLabel: hostname, errorLabel: fwdErr}).Inc()
+		forwardedRequests.With(prometheus.Labels{hostLabel: hostname, errorLabel: fwdErr, attemptLabel: strconv.Itoa(attempt)}).Inc()
+	}
+}
+
+// IncDuplicateCount counts an incoming request which was already received.
+func IncDuplicateCount(policy string) {
+	if inboundDuplicates != nil {
+		inboundDuplicates.With(prometheus.Labels{policyLabel: policy}).Inc()
+	}
+}
+
+// IncUnroutedCount counts an incoming request which was not forwarded to any backend because of routing rules.
+func IncUnroutedCount(event string) {
+	if inboundUnrouted != nil {
+		inboundUnrouted.With(prometheus.Labels{eventLabel: event}).Inc()
+	}
+}
+
+// SetBackends reports the number of registered backends and the generation of the registry.
+func SetBackends(count int, generation uint64) {
+	if backendCount != nil {
+		backendCount.Set(float64(count))
+	}
+	if backendGeneration != nil {
+		backendGeneration.Set(float64(generation))
+	}
+}
+
+// IncEvictedCount counts a backend unregistered because its registration lease expired.
+func IncEvictedCount() {
+	if backendEvictions != nil {
+		backendEvictions.Inc()
+	}
+}
+
+// SetCircuitState reports the state of the circuit breaker of a backend: 0 closed, 1 half-open, 2 open.
+func SetCircuitState(backend string, state int) {
+	if circuitStates != nil {
+		circuitStates.With(prometheus.Labels{backendLabel: backend}).Set(float64(state))
+	}
+}
+
+// DeleteCircuitState stops reporting the circuit breaker of an unregistered backend.
+func DeleteCircuitState(backend string) {
+	if circuitStates != nil {
+		circuitStates.Delete(prometheus.Labels{backendLabel: backend})
+	}
+}
+
+// IncHealthCheckCount counts a health check of a backend, whose result is "success" or "failure".
+func IncHealthCheckCount(backend, result string) {
+	if healthChecks != nil {
+		healthChecks.With(prometheus.Labels{backendLabel: backend, resultLabel: result}).Inc()
+	}
+}
+
+// SetBackendHealthy reports the health of a backend.
+func SetBackendHealthy(backend string, healthy bool) {
+	if healthyBackends != nil {
+		value := 0.0
+		if healthy {
+			value = 1
+		}
+		healthyBackends.With(prometheus.Labels{backendLabel: backend}).Set(value)
+	}
+}
+
+// DeleteBackendHealth stops reporting the health of an unregistered backend.
+func DeleteBackendHealth(backend string) {
+	if healthyBackends != nil {
+		healthyBackends.Delete(prometheus.Labels{backendLabel: backend})
+	}
+	if healthChecks != nil {
+		healthChecks.DeletePartialMatch(prometheus.Labels{backendLabel: backend})
+	}
+}
+
+// SetAsyncQueueLength reports the number of requests waiting to be forwarded in asynchronous mode.
+func SetAsyncQueueLength(length int) {
+	if asyncQueueLength != nil {
+		asyncQueueLength.Set(float64(length))
+	}
+}
+
+// IncWebhookSecretMatchCount counts an incoming request from the provider whose signature matched
+// the named webhook secret.
+func IncWebhookSecretMatchCount(provider, secret string) {
+	if secretMatches != nil {
+		secretMatches.With(prometheus.Labels{providerLabel: provider, secretLabel: secret}).Inc()
+	}
+}
+
+// IncWebhookSecretReloadCount counts a reload of the webhook secrets, whose result is "success" or "failure".
+func IncWebhookSecretReloadCount(result string) {
+	if secretReloads != nil {
+		secretReloads.With(prometheus.Labels{resultLabel: result}).Inc()
+	}
+}
+
+// IncBackendSecretReloadCount counts a reload of the backend signing secrets, whose result is "success" or "failure".
+func IncBackendSecretReloadCount(result string) {
+	if backendSecretReloads != nil {
+		backendSecretReloads.With(prometheus.Labels{resultLabel: result}).Inc()
+	}
+}
+
+// IncInboundRejectedCount counts an incoming request rejected for the reason, such as "source_ip".
+func IncInboundRejectedCount(reason string) {
+	if inboundRejected != nil {
+		inboundRejected.With(prometheus.Labels{reasonLabel: reason}).Inc()
+	}
+}
+
+// IncSourceRangesReloadCount counts a reload of the allowed source IP ranges, whose result is "success" or "failure".
+func IncSourceRangesReloadCount(result string) {
+	if sourceRangesReloads != nil {
+		sourceRangesReloads.With(prometheus.Labels{resultLabel: result}).Inc()
+	}
+}
+
+// IncTLSReloadCount counts a reload of the TLS certificate, whose result is "success" or "failure".
+func IncTLSReloadCount(result string) {
+	if tlsReloads != nil {
+		tlsReloads.With(prometheus.Labels{resultLabel: result}).Inc()
+	}
+}
+
+// IncBackendConnectionCount counts a connection used to forward a request to a backend host,
+// either reused from the idle pool or newly dialed.
+func IncBackendConnectionCount(hostname string, reused bool) {
+	if backendConnections != nil {
+		backendConnections.With(prometheus.Labels{hostLabel: hostname, reusedLabel: strconv.FormatBool(reused)}).Inc()
 	}
 }
 
@@ -30,6 +30,8 @@ func TestMetrics(t *testing.T) {
 		expected     []string
 		githubs      int
 		forwards     int
+		duplicates   int
+		backends     int
 		responseTime float64
 	}{
 		{
@@ -38,14 +40,45 @@ func TestMetrics(t *testing.T) {
 				`# TYPE ` + inboundRequestsName + ` counter`,
 				inboundRequestsName + ` 1`,
 				`# TYPE ` + forwardedRequestsName + ` counter`,
-				forwardedRequestsName + `{error="none",host="host1"} 2`,
+				forwardedRequestsName + `{attempt="1",error="none",host="host1"} 2`,
 				`# TYPE ` + forwardedResponseTimeName + ` histogram`,
 				forwardedResponseTimeName + `_sum 50`,
 				forwardedResponseTimeName + `_count 1`,
 				forwardedResponseTimeName + `_bucket`,
+				`# TYPE ` + inboundDuplicatesName + ` counter`,
+				inboundDuplicatesName + `{policy="drop"} 1`,
+				`# TYPE ` + backendsName + ` gauge`,
+				backendsName + ` 3`,
+				backendsGenerationName + ` 5`,
+				backendsEvictedName + ` 1`,
+				`# TYPE ` + backendCircuitStateName + ` gauge`,
+				backendCircuitStateName + `{backend="http://host1"} 2`,
+				`# TYPE ` + backendHealthyName + ` gauge`,
+				backendHealthyName + `{backend="http://host1"} 1`,
+				`# TYPE ` + backendHealthChecksName + ` counter`,
+				backendHealthChecksName + `{backend="http://host1",result="success"} 1`,
+				`# TYPE ` + asyncQueueLengthName + ` gauge`,
+				asyncQueueLengthName + ` 4`,
+				`# TYPE ` + webhookSecretMatchesName + ` counter`,
+				webhookSecretMatchesName + `{provider="github",secret="primary"} 1`,
+				`# TYPE ` + webhookSecretReloadsName + ` counter`,
+				webhookSecretReloadsName + `{result="failure"} 1`,
+				`# TYPE ` + backendSecretReloadsName + ` counter`,
+				backendSecretReloadsName + `{result="success"} 1`,
+				`# TYPE ` + inboundRejectedName + ` counter`,
+				inboundRejectedName + `{reason="source_ip"} 1`,
+				`# TYPE ` + sourceRangesReloadsName + ` counter`,
+				sourceRangesReloadsName + `{result="success"} 1`,
+				`# TYPE ` + tlsReloadsName + ` counter`,
+				tlsReloadsName + `{result="failure"} 1`,
+				`# TYPE ` + backendConnectionsName + ` counter`,
+				backendConnectionsName + `{host="host1",reused="false"} 1`,
+				backendConnectionsName + `{host="host1",reused="true"} 2`,
 			},
 			githubs:      1,
 			forwards:     2,
+			duplicates:   1,
+			backends:     3,
 			responseTime: float64(50),
 		},
 		{
@@ -71,7 +104,32 @@ func TestMetrics(t *testing.T) {
 			IncInboundCount()
 		}
 		for i := 0; i < test.forwards; i += 1 {
-			IncForwardedCount("host1", "")
+			IncForwardedCount("host1", "", 1)
+		}
+		for i := 0; i < test.duplicates; i += 1 {
+			IncDuplicateCount("drop")
+		}
+		if test.backends > 0 {
+			SetBackends(test.backends, 5)
+			IncEvictedCount()
+			SetCircuitState("http://host1", 2)
+			SetCircuitState("http://host2", 1)
+			DeleteCircuitState("http://host2")
+			IncHealthCheckCount("http://host1", "success")
+			SetBackendHealthy("http://host1", true)
+			IncHealthCheckCount("http://host2", "failure")
+			SetBackendHealthy("http://host2", false)
+			DeleteBackendHealth("http://host2")
+			SetAsyncQueueLength(4)
+			IncWebhookSecretMatchCount("github", "primary")
+			IncWebhookSecretReloadCount("failure")
+			IncBackendSecretReloadCount("success")
+			IncInboundRejectedCount("source_ip")
+			IncSourceRangesReloadCount("success")
+			IncTLSReloadCount("failure")
+			IncBackendConnectionCount("host1", false)
+			IncBackendConnectionCount("host1", true)
+			IncBackendConnectionCount("host1", true)
 		}
 		if test.responseTime > 0 {
 			AddForwardedResponseTime(test.responseTime)
@@ -88,6 +146,9 @@ func TestMetrics(t *testing.T) {
 				t.Errorf("testcase %s: expected string %s did not appear in %s", test.name, s, respStr)
 			}
 		}
+		if strings.Contains(respStr, `backend="http://host2"`) {
+			t.Errorf("testcase %s: expected deleted backend metrics not to appear in %s", test.name, respStr)
+		}
 
 	}
 }
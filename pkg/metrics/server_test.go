@@ -200,14 +200,8 @@ func TestMetricQueries(t *testing.T) {
 			forwards: 0,
 		},
 	} {
-		if inboundRequests != nil {
-			prometheus.Unregister(inboundRequests)
-		}
-		if forwardedRequests != nil {
-			prometheus.Unregister(forwardedRequests)
-		}
-		if responseTimes != nil {
-			prometheus.Unregister(responseTimes)
+		for _, collector := range collectors {
+			prometheus.Unregister(collector)
 		}
 		initCalled = false
 		InitMetrics(nil)
@@ -216,7 +210,7 @@ func TestMetricQueries(t *testing.T) {
 			IncInboundCount()
 		}
 		for i := 0; i < test.forwards; i += 1 {
-			IncForwardedCount("host", "")
+			IncForwardedCount("host", "", 1)
 		}
 
 		port, ch := runMetricsServer(t)
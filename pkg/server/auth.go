@@ -0,0 +1,52 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/auth"
+	"github.com/redhat-appstudio/sprayproxy/pkg/kube"
+)
+
+// newAuthenticator creates the authenticator of the backend registration API from the file set
+// by the SPRAYPROXY_AUTH_CONFIG env var. Returns nil if unset, leaving the API unauthenticated.
+func newAuthenticator() (*auth.Authenticator, error) {
+	path := os.Getenv("SPRAYPROXY_AUTH_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	config, err := auth.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	var reviewer kube.TokenReviewer
+	if config.TokenReview != nil {
+		client, err := kube.NewInClusterClient()
+		if err != nil {
+			return nil, fmt.Errorf("tokenReview requires a kubernetes client: %v", err)
+		}
+		reviewer = client
+	}
+	authenticator, err := auth.NewAuthenticator(config, reviewer, zapLogger)
+	if err != nil {
+		return nil, err
+	}
+	zapLogger.Info(fmt.Sprintf("backend registration API authentication enabled with %d tokens, %d hmac keys, %d client certificates, tokenReview %t",
+		len(config.Tokens), len(config.HMAC), len(config.ClientCertificates), config.TokenReview != nil))
+	return authenticator, nil
+}
+
+// requireScope rejects the callers without the scope, if authentication is enabled.
+func requireScope(authenticator *auth.Authenticator, scope auth.Scope) gin.HandlerFunc {
+	if authenticator == nil {
+		return func(c *gin.Context) {}
+	}
+	return authenticator.Require(scope)
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -18,6 +19,7 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/redhat-appstudio/sprayproxy/pkg/apis/proxy"
+	"github.com/redhat-appstudio/sprayproxy/pkg/auth"
 	"github.com/redhat-appstudio/sprayproxy/pkg/logger"
 )
 
@@ -28,6 +30,8 @@ type SprayProxyServer struct {
 	proxy  *proxy.SprayProxy
 	host   string
 	port   int
+	// tls is nil when serving plain HTTP
+	tls *tlsListener
 }
 
 func init() {
@@ -43,14 +47,27 @@ func NewServer(host string, port int, insecureSkipTLS, insecureSkipWebhookVerify
 	if err != nil {
 		return nil, err
 	}
+	authenticator, err := newAuthenticator()
+	if err != nil {
+		zapLogger.Error("invalid backend registration API authentication", zap.Error(err))
+		return nil, err
+	}
 	// comment/uncomment to switch between debug and release mode
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	// by default gin will trust all request headers that contain alternative client IP
 	// https://pkg.go.dev/github.com/gin-gonic/gin#Engine.SetTrustedProxies
-	r.SetTrustedProxies(nil)
-	// https://github.com/gin-gonic/gin/issues/3336#issuecomment-1272582870
-	r.TrustedPlatform = "X-Forwarded-For"
+	// The X-Forwarded-For header is only used when the request comes from a trusted proxy, such as
+	// the platform router, otherwise the client IP is the remote address of the connection.
+	trustedProxies := trustedProxiesFromEnv()
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		zapLogger.Error("invalid trusted proxies", zap.Error(err))
+		return nil, fmt.Errorf("invalid SPRAYPROXY_TRUSTED_PROXIES: %v", err)
+	}
+	r.RemoteIPHeaders = []string{"X-Forwarded-For"}
+	if len(trustedProxies) > 0 {
+		zapLogger.Info(fmt.Sprintf("X-Forwarded-For header trusted from %s", strings.Join(trustedProxies, ", ")))
+	}
 	// set middleware before routes, otherwise it does not work (gin bug).
 	// The addRequestId middleware must be set before the logging middleware.
 	r.Use(addRequestId())
@@ -66,10 +83,25 @@ func NewServer(host string, port int, insecureSkipTLS, insecureSkipWebhookVerify
 	r.POST("/", sprayProxy.HandleProxy)
 	r.GET("/proxy", handleHealthz)
 	r.POST("/proxy", sprayProxy.HandleProxyEndpoint)
+	r.POST("/proxy/:provider", sprayProxy.HandleProviderEndpoint)
 	if enableDynamicBackends {
-		r.GET("/backends", sprayProxy.GetBackends)
-		r.POST("/backends", sprayProxy.RegisterBackend)
-		r.DELETE("/backends", sprayProxy.UnregisterBackend)
+		r.GET("/backends", requireScope(authenticator, auth.ScopeRead), sprayProxy.GetBackends)
+		r.GET("/backends/:id", requireScope(authenticator, auth.ScopeRead), sprayProxy.GetBackend)
+		r.POST("/backends", requireScope(authenticator, auth.ScopeRegister), sprayProxy.RegisterBackend)
+		r.PUT("/backends", requireScope(authenticator, auth.ScopeRegister), sprayProxy.UpdateBackend)
+		r.DELETE("/backends", requireScope(authenticator, auth.ScopeUnregister), sprayProxy.UnregisterBackend)
+		r.POST("/backends/renew", requireScope(authenticator, auth.ScopeRegister), sprayProxy.RenewBackend)
+	}
+	if sprayProxy.DeadLetterEnabled() {
+		r.GET("/deadletters", requireScope(authenticator, auth.ScopeRead), sprayProxy.ListDeadLetters)
+		r.GET("/deadletters/:id", requireScope(authenticator, auth.ScopeRead), sprayProxy.GetDeadLetter)
+		r.POST("/deadletters/:id/redeliver", requireScope(authenticator, auth.ScopeRegister), sprayProxy.RedeliverDeadLetter)
+		r.POST("/deadletters/redeliver", requireScope(authenticator, auth.ScopeRegister), sprayProxy.RedeliverDeadLetters)
+		r.DELETE("/deadletters", requireScope(authenticator, auth.ScopeRegister), sprayProxy.PurgeDeadLetters)
+	}
+	if sprayProxy.AsyncEnabled() {
+		r.GET("/deliveries", requireScope(authenticator, auth.ScopeRead), sprayProxy.ListAsyncDeliveries)
+		r.GET("/deliveries/:id", requireScope(authenticator, auth.ScopeRead), sprayProxy.GetAsyncDelivery)
 	}
 	r.GET("/healthz", handleHealthz)
 	return &SprayProxyServer{
@@ -80,6 +112,18 @@ func NewServer(host string, port int, insecureSkipTLS, insecureSkipWebhookVerify
 	}, nil
 }
 
+// trustedProxiesFromEnv returns the IP addresses and CIDR ranges of the trusted proxies, set by the
+// comma separated SPRAYPROXY_TRUSTED_PROXIES env var.
+func trustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("SPRAYPROXY_TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
 // Run launches the proxy server with the pre-configured hostname and address.
 func (s *SprayProxyServer) Run(stopCh <-chan struct{}) {
 	address := fmt.Sprintf("%s:%d", s.host, s.port)
@@ -89,13 +133,26 @@ func (s *SprayProxyServer) Run(stopCh <-chan struct{}) {
 		zapLogger.Warn("Skipping TLS verification on backends")
 	}
 	defer zapLogger.Sync()
+	s.proxy.Start(stopCh)
 	// gin.Engine does not support graceful shutdown, so we explicitly leverage http.Server
 	srv := &http.Server{
 		Addr:    address,
 		Handler: s.router,
 	}
+	if s.tls != nil {
+		srv.TLSConfig = s.tls.config()
+		go s.tls.watch(stopCh)
+		zapLogger.Info(fmt.Sprintf("Serving TLS with certificate %s, reloaded on changes", s.tls.options.CertFile))
+	}
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.tls != nil {
+			// the certificate is set by the TLS config
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			zapLogger.Fatal(fmt.Sprintf("Running sprayproxy error %v", err))
 		}
 	}()
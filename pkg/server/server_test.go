@@ -12,11 +12,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/redhat-appstudio/sprayproxy/pkg/auth"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	utilnet "k8s.io/apimachinery/pkg/util/net"
@@ -87,10 +90,12 @@ func TestServerGracefulShutdown(t *testing.T) {
 	}
 
 	respCh := make(chan *http.Response, 1)
+	errCh := make(chan error, 1)
 	go func() {
 		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/", port))
 		if err != nil {
-			t.Fatalf("error making client request: %v", err)
+			errCh <- err
+			return
 		}
 		respCh <- resp
 	}()
@@ -98,7 +103,12 @@ func TestServerGracefulShutdown(t *testing.T) {
 	// the sleep in handler, so server shutdown is initiated while handling a request.
 	time.Sleep(time.Second)
 	close(stopCh)
-	resp := <-respCh
+	var resp *http.Response
+	select {
+	case resp = <-respCh:
+	case err := <-errCh:
+		t.Fatalf("error making client request: %v", err)
+	}
 	if (*resp).StatusCode != http.StatusOK {
 		t.Errorf("expected status code %d, got %d", http.StatusOK, (*resp).StatusCode)
 	}
@@ -273,3 +283,213 @@ func TestServerAccessLog(t *testing.T) {
 		}
 	})
 }
+
+func TestServerDeadLetters(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	t.Run("Dead letter routes when dead letter store is disabled", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		server, err := NewServer("localhost", 8080, false, true, false, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/deadletters", nil)
+		server.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+	t.Run("Dead letter routes when dead letter store is enabled", func(t *testing.T) {
+		t.Setenv("SPRAYPROXY_DEAD_LETTER_MAX_ENTRIES", "10")
+		server, err := NewServer("localhost", 8080, false, true, false, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, test := range []struct {
+			method   string
+			path     string
+			expected int
+		}{
+			{method: http.MethodGet, path: "/deadletters", expected: http.StatusOK},
+			{method: http.MethodGet, path: "/deadletters/foo", expected: http.StatusNotFound},
+			{method: http.MethodPost, path: "/deadletters/foo/redeliver", expected: http.StatusNotFound},
+			{method: http.MethodPost, path: "/deadletters/redeliver", expected: http.StatusOK},
+			{method: http.MethodDelete, path: "/deadletters", expected: http.StatusOK},
+		} {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(test.method, test.path, nil)
+			server.Handler().ServeHTTP(w, req)
+			if w.Code != test.expected {
+				t.Errorf("%s %s: expected status code %d, got %d", test.method, test.path, test.expected, w.Code)
+			}
+		}
+	})
+}
+
+func TestServerAsyncDeliveries(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	for _, async := range []bool{false, true} {
+		if async {
+			t.Setenv("SPRAYPROXY_ASYNC", "true")
+		}
+		server, err := NewServer("localhost", 8080, false, true, false, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for path, expected := range map[string]int{
+			"/deliveries":             http.StatusOK,
+			"/deliveries?state=bogus": http.StatusBadRequest,
+			"/deliveries/foo":         http.StatusNotFound,
+		} {
+			if !async {
+				expected = http.StatusNotFound
+			}
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, path, nil)
+			server.Handler().ServeHTTP(w, req)
+			if w.Code != expected {
+				t.Errorf("async %t: GET %s: expected status code %d, got %d", async, path, expected, w.Code)
+			}
+		}
+	}
+}
+
+func TestServerBackendsAuth(t *testing.T) {
+	var buff bytes.Buffer
+	config := zap.NewProductionConfig()
+	zapLogger = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(config.EncoderConfig), zapcore.AddSync(&buff), config.Level))
+	authConfig := filepath.Join(t.TempDir(), "auth.yaml")
+	data := `
+tokens:
+- name: ci
+  token: ci-token
+  scopes: [read, register]
+hmac:
+- name: cluster-a
+  secret: cluster-a-secret
+  scopes: [unregister]
+`
+	if err := os.WriteFile(authConfig, []byte(data), 0o600); err != nil {
+		t.Fatalf("failed to write auth config: %v", err)
+	}
+	t.Setenv("SPRAYPROXY_AUTH_CONFIG", authConfig)
+	t.Setenv("SPRAYPROXY_DEAD_LETTER_MAX_ENTRIES", "10")
+	server, err := NewServer("localhost", 8080, false, true, true, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body := `{"url":"https://test.com"}`
+	for _, test := range []struct {
+		name     string
+		method   string
+		path     string
+		sign     func(req *http.Request)
+		expected int
+	}{
+		{name: "no credentials", method: http.MethodGet, path: "/backends", expected: http.StatusUnauthorized},
+		{name: "read with token", method: http.MethodGet, path: "/backends", expected: http.StatusOK,
+			sign: func(req *http.Request) { req.Header.Set("Authorization", "Bearer ci-token") }},
+		{name: "register with token", method: http.MethodPost, path: "/backends", expected: http.StatusOK,
+			sign: func(req *http.Request) { req.Header.Set("Authorization", "Bearer ci-token") }},
+		{name: "unregister without scope", method: http.MethodDelete, path: "/backends", expected: http.StatusForbidden,
+			sign: func(req *http.Request) { req.Header.Set("Authorization", "Bearer ci-token") }},
+		{name: "unregister with hmac", method: http.MethodDelete, path: "/backends", expected: http.StatusOK,
+			sign: func(req *http.Request) {
+				auth.SignRequest(req, "cluster-a", "cluster-a-secret", []byte(body), time.Now())
+			}},
+		{name: "renew without credentials", method: http.MethodPost, path: "/backends/renew", expected: http.StatusUnauthorized},
+		{name: "get backend without credentials", method: http.MethodGet, path: "/backends/cluster-a", expected: http.StatusUnauthorized},
+		{name: "get unknown backend with token", method: http.MethodGet, path: "/backends/cluster-a", expected: http.StatusNotFound,
+			sign: func(req *http.Request) { req.Header.Set("Authorization", "Bearer ci-token") }},
+		{name: "list dead letters without credentials", method: http.MethodGet, path: "/deadletters", expected: http.StatusUnauthorized},
+		{name: "get dead letter without credentials", method: http.MethodGet, path: "/deadletters/foo", expected: http.StatusUnauthorized},
+		{name: "redeliver dead letter without credentials", method: http.MethodPost, path: "/deadletters/foo/redeliver", expected: http.StatusUnauthorized},
+		{name: "redeliver dead letters without credentials", method: http.MethodPost, path: "/deadletters/redeliver", expected: http.StatusUnauthorized},
+		{name: "purge dead letters without credentials", method: http.MethodDelete, path: "/deadletters", expected: http.StatusUnauthorized},
+		{name: "list dead letters with token", method: http.MethodGet, path: "/deadletters", expected: http.StatusOK,
+			sign: func(req *http.Request) { req.Header.Set("Authorization", "Bearer ci-token") }},
+		{name: "purge dead letters without scope", method: http.MethodDelete, path: "/deadletters", expected: http.StatusForbidden,
+			sign: func(req *http.Request) {
+				auth.SignRequest(req, "cluster-a", "cluster-a-secret", []byte(body), time.Now())
+			}},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.method, test.path, bytes.NewBufferString(body))
+		if test.sign != nil {
+			test.sign(req)
+		}
+		server.Handler().ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected status code %d, got %d", test.name, test.expected, w.Code)
+		}
+	}
+	// registration changes are logged with the caller identity
+	for _, expected := range []string{
+		`"msg":"server registered"`, `"caller":"ci","auth-method":"token"`,
+		`"msg":"server unregistered"`, `"caller":"cluster-a","auth-method":"hmac"`,
+	} {
+		if !strings.Contains(buff.String(), expected) {
+			t.Errorf("expected string %q did not appear in %q", expected, buff.String())
+		}
+	}
+
+	t.Setenv("SPRAYPROXY_AUTH_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := NewServer("localhost", 8080, false, true, true, nil); err == nil {
+		t.Errorf("expected error for missing auth config")
+	}
+}
+
+func TestServerSourceAllowlist(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	ranges := filepath.Join(t.TempDir(), "meta.json")
+	if err := os.WriteFile(ranges, []byte(`{"hooks": ["192.30.252.0/22"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SPRAYPROXY_ALLOWED_SOURCE_RANGES_FILE", ranges)
+	t.Setenv("SPRAYPROXY_TRUSTED_PROXIES", "10.0.0.0/8, 192.168.0.1")
+	server, err := NewServer("localhost", 8080, false, true, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, test := range []struct {
+		remoteAddr   string
+		forwardedFor string
+		expected     int
+	}{
+		// the client IP is the one set by the platform router
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "192.30.252.1", expected: http.StatusOK},
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "192.30.252.1, 203.0.113.1", expected: http.StatusForbidden},
+		// the addresses of the trusted proxies are skipped
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "203.0.113.1, 192.30.252.1, 192.168.0.1", expected: http.StatusOK},
+		// the header is ignored when the request does not come from a trusted proxy
+		{remoteAddr: "203.0.113.1:1234", forwardedFor: "192.30.252.1", expected: http.StatusForbidden},
+		{remoteAddr: "192.30.252.1:1234", forwardedFor: "203.0.113.1", expected: http.StatusOK},
+		// without the header, the remote address is used
+		{remoteAddr: "10.1.2.3:1234", expected: http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		req := newProxyRequest()
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		server.Handler().ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s with X-Forwarded-For %q: expected status code %d, got %d", test.remoteAddr, test.forwardedFor, test.expected, w.Code)
+		}
+	}
+
+	t.Setenv("SPRAYPROXY_TRUSTED_PROXIES", "router")
+	if _, err := NewServer("localhost", 8080, false, true, false, nil); err == nil {
+		t.Errorf("expected error for invalid trusted proxies")
+	}
+	// the allowlist only applies to webhooks
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d for health checks, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/redhat-appstudio/sprayproxy/pkg/filewatch"
+	"github.com/redhat-appstudio/sprayproxy/pkg/metrics"
+)
+
+// TLSOptions configures TLS on the proxy listener.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum TLS version, "1.2" or "1.3". Defaults to "1.2".
+	MinVersion string
+	// CipherSuites are the names of the cipher suites of TLS 1.2, such as
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Defaults to the Go defaults. TLS 1.3 cipher suites
+	// are not configurable.
+	CipherSuites []string
+	// ClientCAFile holds the CA certificates client certificates are verified with. Client
+	// certificates are requested but not required, the backend registration API authenticates
+	// the callers with them.
+	ClientCAFile string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsListener holds the TLS configuration of the proxy listener. The certificate and client CAs
+// are reloaded when their files change, as serving certificates are rotated.
+type tlsListener struct {
+	options      TLSOptions
+	minVersion   uint16
+	cipherSuites []uint16
+	certificate  atomic.Pointer[tls.Certificate]
+	clientCAs    atomic.Pointer[x509.CertPool]
+	logger       *zap.Logger
+}
+
+func newTLSListener(options TLSOptions, logger *zap.Logger) (*tlsListener, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, errors.New("TLS requires both a certificate and a key file")
+	}
+	l := &tlsListener{options: options, minVersion: tls.VersionTLS12, logger: logger}
+	if options.MinVersion != "" {
+		version, ok := tlsVersions[options.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS min version %q, expected 1.2 or 1.3", options.MinVersion)
+		}
+		l.minVersion = version
+	}
+	if len(options.CipherSuites) > 0 {
+		suites := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			// TLS 1.3 cipher suites are not configurable
+			for _, version := range suite.SupportedVersions {
+				if version == tls.VersionTLS12 {
+					suites[suite.Name] = suite.ID
+				}
+			}
+		}
+		for _, name := range options.CipherSuites {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("invalid TLS cipher suite %q, expected one of the secure TLS 1.2 cipher suites", name)
+			}
+			l.cipherSuites = append(l.cipherSuites, id)
+		}
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the certificate and the client CAs. The current ones are only replaced if the new
+// ones are valid.
+func (l *tlsListener) load() error {
+	certificate, err := tls.LoadX509KeyPair(l.options.CertFile, l.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	var clientCAs *x509.CertPool
+	if l.options.ClientCAFile != "" {
+		data, err := os.ReadFile(l.options.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS client CA: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in TLS client CA %s", l.options.ClientCAFile)
+		}
+	}
+	l.certificate.Store(&certificate)
+	l.clientCAs.Store(clientCAs)
+	return nil
+}
+
+// files returns the certificate, key and client CA files, which are watched for changes.
+func (l *tlsListener) files() []string {
+	files := []string{l.options.CertFile, l.options.KeyFile}
+	if l.options.ClientCAFile != "" {
+		files = append(files, l.options.ClientCAFile)
+	}
+	return files
+}
+
+// watch reloads the certificate and client CAs when the files change, until stopCh is closed.
+func (l *tlsListener) watch(stopCh <-chan struct{}) {
+	filewatch.Watch(stopCh, l.files(), "TLS certificate", l.logger, func() {
+		if err := l.load(); err != nil {
+			metrics.IncTLSReloadCount("failure")
+			l.logger.Error("failed to reload TLS certificate, keeping the current one", zap.Error(err))
+			return
+		}
+		metrics.IncTLSReloadCount("success")
+		l.logger.Info("reloaded TLS certificate")
+	})
+}
+
+// config returns the TLS configuration of the listener, which picks up the current certificate
+// and client CAs on every handshake.
+func (l *tlsListener) config() *tls.Config {
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return l.certificate.Load(), nil
+	}
+	base := &tls.Config{
+		MinVersion:     l.minVersion,
+		CipherSuites:   l.cipherSuites,
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	return &tls.Config{
+		MinVersion: l.minVersion,
+		// http.Server requires a certificate getter besides the config getter
+		GetCertificate: getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := base.Clone()
+			if clientCAs := l.clientCAs.Load(); clientCAs != nil {
+				config.ClientCAs = clientCAs
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return config, nil
+		},
+	}
+}
+
+// EnableTLS serves the proxy over TLS instead of plain HTTP.
+func (s *SprayProxyServer) EnableTLS(options TLSOptions) error {
+	listener, err := newTLSListener(options, zapLogger)
+	if err != nil {
+		zapLogger.Error("invalid TLS configuration", zap.Error(err))
+		return err
+	}
+	s.tls = listener
+	return nil
+}
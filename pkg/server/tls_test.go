@@ -0,0 +1,251 @@
+/*
+Copyright © 2023 The Spray Proxy Contributors
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testCA issues the certificates of the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate and key in PEM format, for 127.0.0.1 or a client.
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS serves the server handler over TLS on a random port, and returns its address.
+func serveTLS(t *testing.T, server *SprayProxyServer, stopCh <-chan struct{}) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: server.Handler(), TLSConfig: server.tls.config()}
+	go srv.ServeTLS(listener, "", "")
+	go server.tls.watch(stopCh)
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func tlsClient(ca *testCA, certificates ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+}
+
+func TestServerTLS(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	cert, key := ca.issue(t, 2, "sprayproxy", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+
+	server, err := NewServer("localhost", 8080, false, true, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := server.EnableTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	address := serveTLS(t, server, stopCh)
+	// let the watcher start before changing the files
+	time.Sleep(50 * time.Millisecond)
+
+	client := tlsClient(ca)
+	resp, err := client.Get(address + "/healthz")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("expected status code %d with certificate 2, got %d", http.StatusOK, resp.StatusCode)
+	}
+	oldClient := tlsClient(ca)
+	oldClient.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS12
+	if _, err := oldClient.Get(address + "/healthz"); err == nil {
+		t.Errorf("expected TLS 1.2 handshake to fail")
+	}
+
+	// rotated certificates are served to new connections
+	cert, key = ca.issue(t, 3, "sprayproxy", x509.ExtKeyUsageServerAuth)
+	writeFile(t, keyFile, key)
+	writeFile(t, certFile, cert)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		resp, err := tlsClient(ca).Get(address + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.TLS.PeerCertificates[0].SerialNumber.Int64() == 3 {
+				return
+			}
+		}
+	}
+	t.Errorf("expected the rotated certificate to be served")
+}
+
+func TestServerTLSClientCertificates(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	cert, key := ca.issue(t, 2, "sprayproxy", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	writeFile(t, caFile, ca.pem)
+	authConfig := filepath.Join(dir, "auth.yaml")
+	writeFile(t, authConfig, []byte("clientCertificates: [{commonName: registrar, scopes: [read]}]"))
+	t.Setenv("SPRAYPROXY_AUTH_CONFIG", authConfig)
+
+	server, err := NewServer("localhost", 8080, false, true, true, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := server.EnableTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	address := serveTLS(t, server, stopCh)
+
+	clientCert, clientKey := ca.issue(t, 4, "registrar", x509.ExtKeyUsageClientAuth)
+	registrar, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, otherKey := ca.issue(t, 5, "other", x509.ExtKeyUsageClientAuth)
+	other, err := tls.X509KeyPair(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		client   *http.Client
+		path     string
+		expected int
+	}{
+		{name: "registrar certificate", client: tlsClient(ca, registrar), path: "/backends", expected: http.StatusOK},
+		{name: "unknown certificate", client: tlsClient(ca, other), path: "/backends", expected: http.StatusUnauthorized},
+		{name: "no certificate", client: tlsClient(ca), path: "/backends", expected: http.StatusUnauthorized},
+		// client certificates are optional for the other routes
+		{name: "health without certificate", client: tlsClient(ca), path: "/healthz", expected: http.StatusOK},
+	} {
+		resp, err := test.client.Get(address + test.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Errorf("%s: expected status code %d, got %d", test.name, test.expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestEnableTLSErrors(t *testing.T) {
+	// override default logger with a nop one
+	zapLogger = zap.NewNop()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	cert, key := ca.issue(t, 2, "sprayproxy", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	writeFile(t, filepath.Join(dir, "empty.crt"), []byte{})
+
+	server, err := NewServer("localhost", 8080, false, true, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, options := range map[string]TLSOptions{
+		"no key":                {CertFile: certFile},
+		"missing certificate":   {CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile},
+		"invalid min version":   {CertFile: certFile, KeyFile: keyFile, MinVersion: "1.1"},
+		"insecure cipher suite": {CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		"TLS 1.3 cipher suite":  {CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		"empty client CA":       {CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "empty.crt")},
+	} {
+		if err := server.EnableTLS(options); err == nil {
+			t.Errorf("%s: expected error for %+v", name, options)
+		}
+	}
+	options := TLSOptions{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}
+	if err := server.EnableTLS(options); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -9,12 +9,14 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httptest"
+	"time"
 )
 
 type testBackend struct {
 	server  *httptest.Server
 	reqBody string
 	err     error
+	delay   time.Duration
 }
 
 func (b *testBackend) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -27,6 +29,7 @@ func (b *testBackend) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	b.reqBody = buf.String()
+	time.Sleep(b.delay)
 	rw.WriteHeader(http.StatusOK)
 }
 
@@ -43,7 +46,12 @@ func (b *testBackend) GetReqBody() string {
 }
 
 func NewTestServer() *testBackend {
-	testServer := &testBackend{}
+	return NewSlowTestServer(0)
+}
+
+// NewSlowTestServer creates a test backend which waits for the given delay before responding.
+func NewSlowTestServer(delay time.Duration) *testBackend {
+	testServer := &testBackend{delay: delay}
 	mux := http.NewServeMux()
 	mux.Handle("/", testServer)
 	testServer.server = httptest.NewServer(mux)
@@ -46,17 +46,24 @@ func TestLogRequestId(t *testing.T) {
 	server.Handler().ServeHTTP(w, req)
 	log := strings.TrimSuffix(buff.String(), "\n")
 	logLines := strings.Split(log, "\n")
-	if len(logLines) != 2 {
-		t.Errorf("expected 2 log lines, got %d", len(logLines))
+	// proxied request, spray summary and access log
+	if len(logLines) != 3 {
+		t.Errorf("expected 3 log lines, got %d", len(logLines))
 	}
-	var line1, line2 map[string]any
-	json.Unmarshal([]byte(logLines[0]), &line1)
-	json.Unmarshal([]byte(logLines[1]), &line2)
-	if line1["request-id"] == "" || line2["request-id"] == "" {
-		t.Errorf("request-id not set: %s, %s", line1["request-id"], line2["request-id"])
+	var first map[string]any
+	json.Unmarshal([]byte(logLines[0]), &first)
+	if first["request-id"] == "" {
+		t.Errorf("request-id not set: %s", first["request-id"])
 	}
-	if line1["request-id"] != line2["request-id"] {
-		t.Errorf("request-id does not match: %s, %s", line1["request-id"], line2["request-id"])
+	for _, logLine := range logLines[1:] {
+		var line map[string]any
+		json.Unmarshal([]byte(logLine), &line)
+		if line["request-id"] == "" {
+			t.Errorf("request-id not set: %s", line["request-id"])
+		}
+		if first["request-id"] != line["request-id"] {
+			t.Errorf("request-id does not match: %s, %s", first["request-id"], line["request-id"])
+		}
 	}
 }
 